@@ -0,0 +1,54 @@
+package audit
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	ActionLockout = "account.lockout"
+	ActionUnlock  = "account.unlock"
+)
+
+type Entry struct {
+	ID         primitive.ObjectID `json:"_id" bson:"_id"`
+	Action     string             `json:"action" bson:"action"`
+	Actor      string             `json:"actor" bson:"actor"`
+	Subject    string             `json:"subject" bson:"subject"`
+	IP         string             `json:"ip" bson:"ip"`
+	Details    map[string]string  `json:"details" bson:"details"`
+	Created_At time.Time          `json:"created_at" bson:"created_at"`
+}
+
+// Log records security relevant events that operators may need to review.
+type Log interface {
+	Record(ctx context.Context, entry Entry) error
+}
+
+type MongoLog struct {
+	collection *mongo.Collection
+}
+
+func NewMongoLog(collection *mongo.Collection) *MongoLog {
+	return &MongoLog{collection: collection}
+}
+
+func (l *MongoLog) Record(ctx context.Context, entry Entry) error {
+	entry.ID = primitive.NewObjectID()
+	if entry.Created_At.IsZero() {
+		entry.Created_At = time.Now()
+	}
+	_, err := l.collection.InsertOne(ctx, entry)
+	return err
+}
+
+type StdLog struct{}
+
+func (StdLog) Record(ctx context.Context, entry Entry) error {
+	log.Printf("audit: %s subject=%s actor=%s ip=%s %v", entry.Action, entry.Subject, entry.Actor, entry.IP, entry.Details)
+	return nil
+}
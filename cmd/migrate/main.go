@@ -0,0 +1,35 @@
+// Command migrate applies pending data migrations to the configured
+// database. It reads the same configuration as the API server.
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/mauroarnedo/ecommerce/config"
+	"github.com/mauroarnedo/ecommerce/database"
+	"github.com/mauroarnedo/ecommerce/migrations"
+)
+
+func main() {
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	client, err := database.DBSet(cfg.Mongo)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Disconnect(context.Background())
+
+	migrations.Currency = cfg.Store.Currency
+	applied, err := migrations.Run(context.Background(), client.Database(cfg.Mongo.Database))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(applied) == 0 {
+		log.Println("nothing to migrate")
+		return
+	}
+	log.Printf("applied %d migrations: %v", len(applied), applied)
+}
@@ -0,0 +1,95 @@
+// Command paywebhook stands in for the payment provider in local
+// development: it signs a webhook event the way the provider would and
+// delivers it to the API, or prints it with -dry-run.
+//
+//	paywebhook -type payment.refunded -ref fake_<intent id> -amount 5.00
+//
+// The secret defaults to PAYMENT_WEBHOOK_SECRET, then to the secret of the
+// development profile.
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/mauroarnedo/ecommerce/config"
+	"github.com/mauroarnedo/ecommerce/models"
+	"github.com/mauroarnedo/ecommerce/payment"
+)
+
+func main() {
+	defaults, err := config.Defaults(config.ProfileDevelopment)
+	if err != nil {
+		log.Fatal(err)
+	}
+	secret := os.Getenv("PAYMENT_WEBHOOK_SECRET")
+	if secret == "" {
+		secret = defaults.Payments.WebhookSecret
+	}
+
+	url := flag.String("url", "http://localhost:"+defaults.Server.Port+"/payments/webhook", "webhook endpoint")
+	flag.StringVar(&secret, "secret", secret, "signing secret")
+	eventID := flag.String("id", "", "event id, random when empty; reuse one to test deduplication")
+	eventType := flag.String("type", payment.EventCaptured, "event type")
+	providerRef := flag.String("ref", "", "provider reference of the payment, fake_<intent id> for the fake provider")
+	refundID := flag.String("refund-id", "", "provider id of the refund of a payment.refunded event")
+	amount := flag.String("amount", "", "decimal amount of a partial capture or refund, the whole payment when empty")
+	currency := flag.String("currency", defaults.Store.Currency, "currency of -amount")
+	skew := flag.Duration("skew", 0, "shift the signature timestamp, to test the tolerance")
+	dryRun := flag.Bool("dry-run", false, "print the signed request instead of sending it")
+	flag.Parse()
+
+	if *providerRef == "" {
+		log.Fatal("-ref is required")
+	}
+	if *eventID == "" {
+		*eventID = randomID()
+	}
+	event := payment.Event{ID: *eventID, Type: *eventType, Provider_Ref: *providerRef, Refund_ID: *refundID}
+	if *amount != "" {
+		money, err := models.ParseMoney(*amount, *currency)
+		if err != nil {
+			log.Fatal(err)
+		}
+		event.Amount = &money
+	}
+
+	body, signature, err := payment.SignedEvent(secret, event, time.Now().Add(*skew))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *dryRun {
+		fmt.Printf("POST %s\n%s: %s\n\n%s\n", *url, payment.SignatureHeader, signature, body)
+		return
+	}
+
+	request, err := http.NewRequest(http.MethodPost, *url, bytes.NewReader(body))
+	if err != nil {
+		log.Fatal(err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(payment.SignatureHeader, signature)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer response.Body.Close()
+	answer, _ := io.ReadAll(response.Body)
+	fmt.Printf("%s\n%s\n", response.Status, answer)
+}
+
+func randomID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+	return "evt_" + hex.EncodeToString(b)
+}
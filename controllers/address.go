@@ -4,100 +4,60 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/mauroarnedo/ecommerce/models"
-	"go.mongodb.org/mongo-driver/bson"
+	"github.com/mauroarnedo/ecommerce/repository"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
-func AddAddress() gin.HandlerFunc {
+func (app *Application) AddAddress() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		user_id := c.Query("id")
-
-		if user_id == "" {
-			c.Header("Content-Type", "application/json")
-			c.JSON(http.StatusNotFound, gin.H{"Error": "Invalid code"})
-			c.Abort()
-			return
-		}
-		address, err := primitive.ObjectIDFromHex(user_id)
-		if err != nil {
-			c.IndentedJSON(500, "Internal server error")
+		address, ok := actingUserObjectID(c)
+		if !ok {
 			return
 		}
 
 		var addresses models.Address
 		addresses.Address_ID = primitive.NewObjectID()
-		if err = c.BindJSON(&addresses); err != nil {
+		if err := c.BindJSON(&addresses); err != nil {
 			c.IndentedJSON(http.StatusNotAcceptable, err)
 			return
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
-
-		match_filter := bson.D{{Key: "$match", Value: bson.D{primitive.E{Key: "_id", Value: address}}}}
-		unwind := bson.D{{Key: "$unwind", Value: bson.D{primitive.E{Key: "path", Value: "$address"}}}}
-		group := bson.D{{Key: "$group", Value: bson.D{primitive.E{Key: "_id", Value: "$address_id"}, {Key: "count", Value: bson.D{primitive.E{Key: "$sum", Value: 1}}}}}}
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
 
-		cursor, err := UserCollection.Aggregate(ctx, mongo.Pipeline{match_filter, unwind, group})
+		err := app.users.AddAddress(ctx, address.Hex(), addresses)
+		if err == repository.ErrAddressLimit {
+			c.IndentedJSON(400, "Not Allowed")
+			return
+		}
 		if err != nil {
+			fmt.Println(err)
 			c.IndentedJSON(500, "Internal server error")
+			return
 		}
-
-		var addressInfo []bson.M
-		if err = cursor.All(ctx, &addressInfo); err != nil {
-			panic(err)
-		}
-
-		var size int32
-		for _, address_no := range addressInfo {
-			count := address_no["count"]
-			size = count.(int32)
-		}
-		if size < 2 {
-			filter := bson.D{primitive.E{Key: "_id", Value: address}}
-			update := bson.D{{Key: "$push", Value: bson.D{primitive.E{Key: "address", Value: addresses}}}}
-			_, err := UserCollection.UpdateOne(ctx, filter, update)
-			if err != nil {
-				fmt.Println(err)
-			}
-		} else {
-			c.IndentedJSON(400, "Not Allowed")
-		}
-		defer cancel()
-		ctx.Done()
+		c.IndentedJSON(200, "Successfully added the address")
 	}
 }
 
-func EditHomeAddress() gin.HandlerFunc {
+func (app *Application) EditHomeAddress() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		user_id := c.Query("id")
-		if user_id == "" {
-			c.Header("Content-Type", "application/json")
-			c.JSON(http.StatusNotFound, gin.H{"Error": "invalid code"})
-			c.Abort()
-			return
-		}
-		u_id, err := primitive.ObjectIDFromHex(user_id)
-		if err != nil {
-			c.IndentedJSON(500, err)
+		u_id, ok := actingUserObjectID(c)
+		if !ok {
 			return
 		}
 
 		var editAddress models.Address
-		if err = c.BindJSON(&editAddress); err != nil {
+		if err := c.BindJSON(&editAddress); err != nil {
 			c.IndentedJSON(http.StatusBadRequest, err.Error())
 			return
 		}
-		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
 		defer cancel()
 
-		filter := bson.D{primitive.E{Key: "_id", Value: u_id}}
-		update := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: "address.0.house", Value: editAddress.House}, {Key: "address.0.street", Value: editAddress.Street}, {Key: "address.0.city", Value: editAddress.City}, {Key: "address.0.pin_code", Value: editAddress.Pin_Code}}}}
-		_, err = UserCollection.UpdateOne(ctx, filter, update)
+		err := app.users.EditAddress(ctx, u_id.Hex(), 0, editAddress)
 		if err != nil {
 			c.IndentedJSON(500, "Something went wrong")
 			return
@@ -108,32 +68,22 @@ func EditHomeAddress() gin.HandlerFunc {
 	}
 }
 
-func EditWorkAddress() gin.HandlerFunc {
+func (app *Application) EditWorkAddress() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		query := c.Query("id")
-		if query == "" {
-			c.Header("Content-Type", "application/json")
-			c.JSON(http.StatusNotFound, gin.H{"Error": "invalid code"})
-			c.Abort()
-			return
-		}
-		user_id, err := primitive.ObjectIDFromHex(query)
-		if err != nil {
-			c.IndentedJSON(500, err)
+		user_id, ok := actingUserObjectID(c)
+		if !ok {
 			return
 		}
 		var editAddress models.Address
-		if err = c.BindJSON(&editAddress); err != nil {
-			c.IndentedJSON(http.StatusBadRequest, err.Error)
+		if err := c.BindJSON(&editAddress); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, err.Error())
 			return
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
 		defer cancel()
 
-		filter := bson.D{primitive.E{Key: "_id", Value: user_id}}
-		update := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: "address.1.house", Value: editAddress.House}, {Key: "address.1.street", Value: editAddress.Street}, {Key: "address.1.city", Value: editAddress.City}, {Key: "address.1.pin_code", Value: editAddress.Pin_Code}}}}
-		_, err = UserCollection.UpdateOne(ctx, filter, update)
+		err := app.users.EditAddress(ctx, user_id.Hex(), 1, editAddress)
 		if err != nil {
 			c.IndentedJSON(500, "Something went wrong")
 			return
@@ -144,29 +94,17 @@ func EditWorkAddress() gin.HandlerFunc {
 	}
 }
 
-func DeleteAddress() gin.HandlerFunc {
+func (app *Application) DeleteAddress() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		query := c.Query("id")
-		if query == "" {
-			c.Header("Content-Type", "application/json")
-			c.JSON(http.StatusNotFound, gin.H{"Error": "Invalid search index"})
-			c.Abort()
-			return
-		}
-
-		addresses := make([]models.Address, 0)
-		user_id, err := primitive.ObjectIDFromHex(query)
-		if err != nil {
-			c.IndentedJSON(500, "Internal server error")
+		user_id, ok := actingUserObjectID(c)
+		if !ok {
 			return
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
 		defer cancel()
 
-		filter := bson.D{primitive.E{Key: "_id", Value: user_id}}
-		update := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: "address", Value: addresses}}}}
-		_, err = UserCollection.UpdateOne(ctx, filter, update)
+		err := app.users.ClearAddresses(ctx, user_id.Hex())
 		if err != nil {
 			c.IndentedJSON(404, "wrong")
 			return
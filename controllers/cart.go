@@ -3,30 +3,18 @@ package controllers
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
-	"time"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/mauroarnedo/ecommerce/database"
 	"github.com/mauroarnedo/ecommerce/models"
-	"go.mongodb.org/mongo-driver/bson"
+	"github.com/mauroarnedo/ecommerce/repository"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
-type Application struct {
-	productCollection *mongo.Collection
-	userCollection    *mongo.Collection
-}
-
-func NewApplication(productCollection, userCollection *mongo.Collection) *Application {
-	return &Application{
-		productCollection: productCollection,
-		userCollection:    userCollection,
-	}
-}
-
 func (app *Application) AddToCart() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		productQueryID := c.Query("id")
@@ -36,10 +24,8 @@ func (app *Application) AddToCart() gin.HandlerFunc {
 			return
 		}
 
-		userQueryID := c.Query("user_ID")
-		if userQueryID == "" {
-			log.Println("user id is empty")
-			c.AbortWithError(http.StatusBadRequest, errors.New("user id is empty"))
+		userID, ok := actingUserID(c)
+		if !ok {
 			return
 		}
 		productID, err := primitive.ObjectIDFromHex(productQueryID)
@@ -49,11 +35,18 @@ func (app *Application) AddToCart() gin.HandlerFunc {
 			return
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		quantity := 1
+		if c.Query("quantity") != "" {
+			if quantity, ok = cartQuantity(c, 1); !ok {
+				return
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
 		defer cancel()
-		err = database.AddProductToCart(ctx, app.productCollection, app.userCollection, productID, userQueryID)
+		err = app.carts.Add(ctx, userID, productID, quantity)
 		if err != nil {
-			c.IndentedJSON(http.StatusInternalServerError, err)
+			cartError(c, err)
 			return
 		}
 		c.IndentedJSON(200, "Successfully added to the cart")
@@ -69,10 +62,8 @@ func (app *Application) RemoveItem() gin.HandlerFunc {
 			return
 		}
 
-		userQueryID := c.Query("user_ID")
-		if userQueryID == "" {
-			log.Println("user id is empty")
-			c.AbortWithError(http.StatusBadRequest, errors.New("user id is empty"))
+		userID, ok := actingUserID(c)
+		if !ok {
 			return
 		}
 
@@ -83,10 +74,10 @@ func (app *Application) RemoveItem() gin.HandlerFunc {
 			return
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
 		defer cancel()
 
-		err = database.RemoveCartItem(ctx, app.productCollection, app.userCollection, productID, userQueryID)
+		err = app.carts.Remove(ctx, userID, productID)
 		if err != nil {
 			c.IndentedJSON(http.StatusInternalServerError, err)
 			return
@@ -95,74 +86,234 @@ func (app *Application) RemoveItem() gin.HandlerFunc {
 	}
 }
 
-func (app *Application) GetItemFromCart() gin.HandlerFunc {
+// SetCartQuantity sets the quantity of a product already in the cart, zero
+// removes it.
+func (app *Application) SetCartQuantity() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userQuery_id := c.Query("id")
-		if userQuery_id == "" {
-			c.Header("Content-Type", "application/json")
-			c.JSON(http.StatusNotFound, gin.H{"Error": "Invalid id"})
-			c.Abort()
+		productID, ok := cartProductID(c)
+		if !ok {
 			return
 		}
-		user_id, err := primitive.ObjectIDFromHex(userQuery_id)
-		if err != nil {
-			c.IndentedJSON(500, "Internal server error")
+		quantity, ok := cartQuantity(c, 0)
+		if !ok {
+			return
+		}
+		userID, ok := actingUserID(c)
+		if !ok {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		if err := app.carts.SetQuantity(ctx, userID, productID, quantity); err != nil {
+			cartError(c, err)
+			return
+		}
+		c.IndentedJSON(200, "the quantity was updated")
+	}
+}
+
+func (app *Application) IncrementItem() gin.HandlerFunc {
+	return app.changeCartQuantity(1)
+}
+
+// DecrementItem takes one unit off a cart line, removing the line after
+// the last unit.
+func (app *Application) DecrementItem() gin.HandlerFunc {
+	return app.changeCartQuantity(-1)
+}
+
+func (app *Application) changeCartQuantity(delta int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		productID, ok := cartProductID(c)
+		if !ok {
+			return
+		}
+		userID, ok := actingUserID(c)
+		if !ok {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		if err := app.carts.ChangeQuantity(ctx, userID, productID, delta); err != nil {
+			cartError(c, err)
+			return
+		}
+		c.IndentedJSON(200, "the quantity was updated")
+	}
+}
+
+func cartProductID(c *gin.Context) (primitive.ObjectID, bool) {
+	productID, err := primitive.ObjectIDFromHex(c.Query("id"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "product id is not valid"})
+		return productID, false
+	}
+	return productID, true
+}
+
+func cartQuantity(c *gin.Context, min int) (int, bool) {
+	quantity, err := strconv.Atoi(c.Query("quantity"))
+	if err != nil || quantity < min || quantity > database.MaxCartQuantity {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("quantity must be between %d and %d", min, database.MaxCartQuantity)})
+		return 0, false
+	}
+	return quantity, true
+}
+
+func cartError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, database.ErrOutOfStock), errors.Is(err, models.ErrCurrencyMismatch):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case err == database.ErrNotInCart, err == database.ErrCantFindProduct, err == database.ErrUserNotFound, err == repository.ErrUserNotFound:
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case err == database.ErrCartQuantityTooLarge:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func (app *Application) GetItemFromCart() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := actingUserID(c)
+		if !ok {
 			return
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
 		defer cancel()
 
-		var filledCart models.User
-		err = app.userCollection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: user_id}}).Decode(&filledCart)
+		cart, total, err := app.carts.Items(ctx, userID)
 		if err != nil {
-			log.Println(err)
-			c.IndentedJSON(500, "not found")
+			cartError(c, err)
+			return
+		}
+		user, err := app.users.FindByID(ctx, userID)
+		if err != nil {
+			cartError(c, err)
 			return
 		}
+		c.IndentedJSON(200, app.cartList(ctx, userID, cart, total, user.Cart_Coupon))
+	}
+}
 
-		match_filter := bson.D{{Key: "$match", Value: bson.D{primitive.E{Key: "_id", Value: user_id}}}}
-		unwind := bson.D{{Key: "$unwind", Value: bson.D{primitive.E{Key: "path", Value: "$user_cart"}}}}
-		group := bson.D{{Key: "$group", Value: bson.D{primitive.E{Key: "_id", Value: "$_id"}, {Key: "total", Value: bson.D{primitive.E{Key: "$sum", Value: "$user_cart.price"}}}}}}
-		cursor, err := app.userCollection.Aggregate(ctx, mongo.Pipeline{match_filter, unwind, group})
+// ReserveCart holds the stock of everything in the cart while the user
+// completes the checkout. The next checkout uses the reservation until it
+// expires; reserving again replaces it.
+func (app *Application) ReserveCart() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := actingUserID(c)
+		if !ok {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		cart, _, err := app.carts.Items(ctx, userID)
 		if err != nil {
-			log.Println(err)
+			cartError(c, err)
 			return
 		}
-		var list []bson.M
-		if err = cursor.All(ctx, &list); err != nil {
-			log.Println(err)
-			c.AbortWithStatus(http.StatusInternalServerError)
+		if len(cart) == 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": database.ErrCartEmpty.Error()})
 			return
 		}
-		for _, json := range list {
-			c.IndentedJSON(200, json["total"])
-			c.IndentedJSON(200, filledCart.User_Cart)
+		reservation, err := app.inventory.Hold(ctx, userID, database.StockLines(cart), app.cfg.Inventory.ReservationTTL)
+		if err != nil {
+			cartError(c, err)
+			return
 		}
-		ctx.Done()
+		c.IndentedJSON(200, reservation)
 	}
 }
 
 func (app *Application) BuyFromCart() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userQueryID := c.Query("id")
-
-		if userQueryID == "" {
-			log.Panicln("user id is empty")
-			c.AbortWithError(http.StatusBadRequest, errors.New("UserID is empty"))
+		userID, ok := actingUserID(c)
+		if !ok {
+			return
+		}
+		payment, request, ok := app.checkoutPayment(c)
+		if !ok {
 			return
 		}
-		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
 		defer cancel()
 
-		err := database.BuyItemFromCart(ctx, app.userCollection, userQueryID)
+		if !app.checkoutAllowed(ctx, c, userID) {
+			return
+		}
+		code := request.Coupon_Code
+		if code == "" {
+			user, err := app.users.FindByID(ctx, userID)
+			if err != nil {
+				cartError(c, err)
+				return
+			}
+			code = user.Cart_Coupon
+		}
+		coupon, ok := app.checkoutCoupon(ctx, c, userID, code)
+		if !ok {
+			return
+		}
+
+		order, err := app.orders.BuyFromCart(ctx, userID, payment, coupon)
+		if err != nil && coupon != nil {
+			app.releaseCoupon(ctx, coupon.ID, userID)
+		}
+		if err == database.ErrCartEmpty {
+			c.IndentedJSON(http.StatusBadRequest, err.Error())
+			return
+		}
+		if err == database.ErrCartChanged {
+			app.reportCartChanges(ctx, c, userID)
+			return
+		}
+		if errors.Is(err, database.ErrOutOfStock) || errors.Is(err, models.ErrCurrencyMismatch) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if isCouponError(err) {
+			couponError(c, err)
+			return
+		}
 		if err != nil {
 			c.IndentedJSON(http.StatusInternalServerError, err)
 			return
 		}
+		if coupon != nil {
+			if err = app.users.SetCartCoupon(ctx, userID, ""); err != nil {
+				log.Println(err)
+			}
+		}
+		if payment.Digital {
+			intent, ok := app.payOrder(ctx, c, order, request.Payment_Token, true)
+			if !ok {
+				return
+			}
+			c.IndentedJSON(200, gin.H{"message": "Successfully placed and paid the order", "order_id": order.Order_ID, "payment": intent})
+			return
+		}
+
+		c.IndentedJSON(200, gin.H{"message": "Successfully placed the order", "order_id": order.Order_ID})
+	}
+}
 
-		c.IndentedJSON(200, "Successfully placed the order")
+// reportCartChanges refreshes the cart from the catalog and answers 409
+// with what changed. Checking out again confirms the new prices; lines of
+// deleted products must be removed first.
+func (app *Application) reportCartChanges(ctx context.Context, c *gin.Context, userID string) {
+	changes, err := app.carts.Revalidate(ctx, userID)
+	if err != nil {
+		cartError(c, err)
+		return
 	}
+	c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": database.ErrCartChanged.Error(), "changes": changes})
 }
 
 func (app *Application) InstantBuy() gin.HandlerFunc {
@@ -174,10 +325,8 @@ func (app *Application) InstantBuy() gin.HandlerFunc {
 			return
 		}
 
-		userQueryID := c.Query("user_ID")
-		if userQueryID == "" {
-			log.Println("user id is empty")
-			c.AbortWithError(http.StatusBadRequest, errors.New("user id is empty"))
+		userID, ok := actingUserID(c)
+		if !ok {
 			return
 		}
 
@@ -187,15 +336,46 @@ func (app *Application) InstantBuy() gin.HandlerFunc {
 			c.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
+		payment, request, ok := app.checkoutPayment(c)
+		if !ok {
+			return
+		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
 		defer cancel()
 
-		err = database.InstantBuy(ctx, app.productCollection, app.userCollection, productID, userQueryID)
+		if !app.checkoutAllowed(ctx, c, userID) {
+			return
+		}
+		coupon, ok := app.checkoutCoupon(ctx, c, userID, request.Coupon_Code)
+		if !ok {
+			return
+		}
+
+		order, err := app.orders.InstantBuy(ctx, userID, productID, payment, coupon)
+		if err != nil && coupon != nil {
+			app.releaseCoupon(ctx, coupon.ID, userID)
+		}
+		if errors.Is(err, database.ErrOutOfStock) || err == database.ErrCantFindProduct {
+			cartError(c, err)
+			return
+		}
+		if isCouponError(err) {
+			couponError(c, err)
+			return
+		}
 		if err != nil {
 			c.IndentedJSON(http.StatusInternalServerError, err)
 			return
 		}
-		c.IndentedJSON(200, "Successfully placed the instant order")
+		if payment.Digital {
+			intent, ok := app.payOrder(ctx, c, order, request.Payment_Token, false)
+			if !ok {
+				return
+			}
+			c.IndentedJSON(200, gin.H{"message": "Successfully placed and paid the instant order", "order_id": order.Order_ID, "payment": intent})
+			return
+		}
+		c.IndentedJSON(200, gin.H{"message": "Successfully placed the instant order", "order_id": order.Order_ID})
 	}
 }
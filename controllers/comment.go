@@ -8,11 +8,10 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/mauroarnedo/ecommerce/models"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-func AddComments() gin.HandlerFunc {
+func (app *Application) AddComments() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		productQueryID := c.Query("id")
 		if productQueryID == "" {
@@ -23,32 +22,23 @@ func AddComments() gin.HandlerFunc {
 			return
 		}
 
-		userQueryID := c.Query("user_id")
-		if userQueryID == "" {
-			log.Println("user id is empty")
-			c.Header("Content-Type", "application/json")
-			c.JSON(http.StatusNotFound, gin.H{"Error": "user id is empty"})
-			c.Abort()
+		userID, ok := actingUserObjectID(c)
+		if !ok {
 			return
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
 		defer cancel()
 
 		var user_comment models.Comment
-		userID, err := primitive.ObjectIDFromHex(userQueryID)
+		author, err := app.users.FindPublic(ctx, userID.Hex())
 		if err != nil {
 			log.Println(err)
 			c.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
-
-		if err = UserCollection.FindOne(ctx, bson.M{"_id": userID}).Decode(&user_comment.User); err != nil {
-			log.Println(err)
-			c.AbortWithStatus(http.StatusInternalServerError)
-			return
-		}
-		if err = c.BindJSON(&user_comment.Comment); err != nil {
+		user_comment.User = *author
+		if err := c.BindJSON(&user_comment.Comment); err != nil {
 			log.Println(err)
 			c.JSON(http.StatusBadRequest, gin.H{"error": err})
 			return
@@ -65,10 +55,7 @@ func AddComments() gin.HandlerFunc {
 			return
 		}
 
-		filter := bson.M{"_id": productID}
-		update := bson.D{{Key: "$push", Value: bson.D{primitive.E{Key: "product_comments", Value: user_comment}}}}
-
-		_, err = ProductCollection.UpdateOne(ctx, filter, update)
+		err = app.products.AddComment(ctx, productID, user_comment)
 		if err != nil {
 			c.IndentedJSON(http.StatusInternalServerError, "The comment cannot be added to the product")
 			return
@@ -79,7 +66,7 @@ func AddComments() gin.HandlerFunc {
 	}
 }
 
-func DeleteComments() gin.HandlerFunc {
+func (app *Application) DeleteComments() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		productQueryID := c.Query("id")
 		if productQueryID == "" {
@@ -88,7 +75,12 @@ func DeleteComments() gin.HandlerFunc {
 			return
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		userID, ok := actingUserObjectID(c)
+		if !ok {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
 		defer cancel()
 
 		productID, err := primitive.ObjectIDFromHex(productQueryID)
@@ -98,8 +90,7 @@ func DeleteComments() gin.HandlerFunc {
 			return
 		}
 
-		filter := bson.M{"_id": productID}
-		_, err = ProductCollection.DeleteOne(ctx, filter)
+		err = app.products.RemoveUserComments(ctx, productID, userID)
 		if err != nil {
 			log.Println(err)
 			c.IndentedJSON(http.StatusInternalServerError, "An error has occurred")
@@ -2,31 +2,107 @@ package controllers
 
 import (
 	"context"
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
-	"github.com/mauroarnedo/ecommerce/database"
+	"github.com/mauroarnedo/ecommerce/config"
+	"github.com/mauroarnedo/ecommerce/lockout"
 	"github.com/mauroarnedo/ecommerce/models"
+	"github.com/mauroarnedo/ecommerce/notify"
+	"github.com/mauroarnedo/ecommerce/payment"
+	"github.com/mauroarnedo/ecommerce/repository"
 	generate "github.com/mauroarnedo/ecommerce/tokens"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/crypto/bcrypt"
 )
 
-var (
-	UserCollection    *mongo.Collection = database.UserData(database.Client, "users")
-	ProductCollection *mongo.Collection = database.ProductData(database.Client, "products")
-	Validate                            = validator.New()
-)
+var Validate = validator.New()
+
+// Application holds everything the handlers depend on. main builds it once
+// and the routes package registers its handlers.
+type Application struct {
+	users          repository.UserRepository
+	products       repository.ProductRepository
+	carts          repository.CartRepository
+	orders         repository.OrderRepository
+	inventory      repository.InventoryRepository
+	payments       repository.PaymentRepository
+	paymentEvents  repository.PaymentEventRepository
+	returns        repository.ReturnRepository
+	coupons        repository.CouponRepository
+	passwordResets repository.PasswordResetRepository
+	verifications  repository.VerificationRepository
+	tokens         *generate.Manager
+	loginGuard     *lockout.Guard
+	notifier       notify.Notifier
+	provider       payment.Provider
+	cfg            *config.Config
+}
+
+func NewApplication(cfg *config.Config, repos *repository.Repositories, tokens *generate.Manager, loginGuard *lockout.Guard, notifier notify.Notifier, provider payment.Provider) *Application {
+	return &Application{
+		users:          repos.Users,
+		products:       repos.Products,
+		carts:          repos.Carts,
+		orders:         repos.Orders,
+		inventory:      repos.Inventory,
+		payments:       repos.Payments,
+		paymentEvents:  repos.PaymentEvents,
+		returns:        repos.Returns,
+		coupons:        repos.Coupons,
+		passwordResets: repos.PasswordResets,
+		verifications:  repos.Verifications,
+		tokens:         tokens,
+		loginGuard:     loginGuard,
+		notifier:       notifier,
+		provider:       provider,
+		cfg:            cfg,
+	}
+}
+
+// actingUserID resolves the account a request operates on. It is the caller
+// taken from the token claims, unless an admin explicitly targets another
+// account with ?user_id=.
+func actingUserID(c *gin.Context) (string, bool) {
+	uid := c.GetString("uid")
+	if uid == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "user is not authenticated"})
+		return "", false
+	}
+	override := c.Query("user_id")
+	if override == "" || override == uid {
+		return uid, true
+	}
+	if c.GetString("role") != models.RoleAdmin {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "only admins can act on another user's account"})
+		return "", false
+	}
+	return override, true
+}
+
+func actingUserObjectID(c *gin.Context) (primitive.ObjectID, bool) {
+	uid, ok := actingUserID(c)
+	if !ok {
+		return primitive.NilObjectID, false
+	}
+	id, err := primitive.ObjectIDFromHex(uid)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "user id is not valid"})
+		return primitive.NilObjectID, false
+	}
+	return id, true
+}
 
-func HashPassword(password string) string {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
+func HashPassword(password string, cost int) string {
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), cost)
 	if err != nil {
 		log.Panic(err)
 	}
@@ -44,9 +120,9 @@ func VerifyPassword(userPassword, givenPassword string) (bool, string) {
 	return valid, msg
 }
 
-func SignUp() gin.HandlerFunc {
+func (app *Application) SignUp() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var ctx, cancel = context.WithTimeout(context.Background(), 20*time.Second)
+		var ctx, cancel = context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
 		defer cancel()
 
 		var user models.User
@@ -55,69 +131,181 @@ func SignUp() gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		validationErr := Validate.Struct(user)
-		if validationErr != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": validationErr})
+		user.Role = models.RoleCustomer
+		if app.registerUser(ctx, c, &user, app.users.Create) {
+			c.JSON(http.StatusCreated, "Successfully Signed Up")
+		}
+	}
+}
+
+// BootstrapAdmin creates the first administrator. It only works while no
+// admin exists and the caller knows the admin bootstrap token; every
+// later admin has to be promoted through SetUserRole. Concurrent calls
+// that both find no admin are settled by CreateBootstrapAdmin, which lets
+// only one of them create theirs.
+func (app *Application) BootstrapAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var ctx, cancel = context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		bootstrapToken := app.cfg.Auth.AdminBootstrapToken
+		given := c.Request.Header.Get("bootstrap_token")
+		if bootstrapToken == "" || subtle.ConstantTimeCompare([]byte(given), []byte(bootstrapToken)) != 1 {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "invalid bootstrap token"})
 			return
 		}
 
-		count, err := UserCollection.CountDocuments(ctx, bson.M{"email": user.Email})
+		count, err := app.users.CountByRole(ctx, models.RoleAdmin)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err})
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err})
 			return
 		}
 		if count > 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "User already exists"})
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "an admin already exists"})
 			return
 		}
-		count, err = UserCollection.CountDocuments(ctx, bson.M{"phone": user.Phone})
-		if err != nil {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err})
+
+		var user models.User
+		if err := c.BindJSON(&user); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		if count > 0 {
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Phone is already in use"})
-			return
+		user.Role = models.RoleAdmin
+		if app.registerUser(ctx, c, &user, app.users.CreateBootstrapAdmin) {
+			c.JSON(http.StatusCreated, "Successfully created the admin")
 		}
-		password := HashPassword(*user.Password)
-		user.Password = &password
+	}
+}
 
-		user.Created_At, _ = time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
-		user.Updated_At, _ = time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
-		user.ID = primitive.NewObjectID()
-		user.User_ID = user.ID.Hex()
-		token, refreshToken, _ := generate.TokenGenerator(*user.Email, *user.First_Name, *user.Last_Name, user.User_ID)
-		user.Token = &token
-		user.Refresh_Token = &refreshToken
-		user.User_Cart = make([]models.ProductUser, 0)
-		user.User_Favorites = make([]models.ProductUser, 0)
-		user.Address_Details = make([]models.Address, 0)
-		user.Order_Status = make([]models.Order, 0)
-		_, insertErr := UserCollection.InsertOne(ctx, user)
-		if insertErr != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "not created"})
+// SetUserRole changes the role of a user and revokes their sessions, whose
+// tokens still carry the old role. The last admin cannot be demoted.
+func (app *Application) SetUserRole() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userQueryID := c.Query("id")
+		role := c.Query("role")
+		if userQueryID == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "user id is empty"})
+			return
+		}
+		if role != models.RoleAdmin && role != models.RoleCustomer {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "role must be ADMIN or CUSTOMER"})
 			return
 		}
+		if _, err := primitive.ObjectIDFromHex(userQueryID); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "user id is not valid"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
 		defer cancel()
-		c.JSON(http.StatusCreated, "Successfully Signed Up")
+
+		changed, err := app.users.SetRole(ctx, userQueryID, role)
+		if err == repository.ErrUserNotFound {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			return
+		}
+		if err == repository.ErrLastAdmin {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "user cannot be updated"})
+			return
+		}
+		if !changed {
+			c.JSON(http.StatusOK, "The user already has this role")
+			return
+		}
+		if err = app.tokens.LogoutAll(ctx, userQueryID); err != nil {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "the role was updated but the user's sessions could not be revoked"})
+			return
+		}
+		c.JSON(http.StatusOK, "The role was updated, the user has to log in again")
+	}
+}
+
+// registerUser validates user and stores it with create.
+func (app *Application) registerUser(ctx context.Context, c *gin.Context, user *models.User, create func(ctx context.Context, user *models.User) error) bool {
+	validationErr := Validate.Struct(user)
+	if validationErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": validationErr})
+		return false
+	}
+
+	exists, err := app.users.EmailExists(ctx, *user.Email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err})
+		return false
+	}
+	if exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User already exists"})
+		return false
+	}
+	exists, err = app.users.PhoneExists(ctx, *user.Phone)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err})
+		return false
+	}
+	if exists {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Phone is already in use"})
+		return false
 	}
+	password := HashPassword(*user.Password, app.cfg.Auth.BcryptCost)
+	user.Password = &password
+
+	user.Created_At, _ = time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+	user.Updated_At, _ = time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+	user.ID = primitive.NewObjectID()
+	user.User_ID = user.ID.Hex()
+	user.Email_Verified = false
+	user.Phone_Verified = false
+	user.TOTP_Enabled = false
+	token, refreshToken, _ := app.tokens.TokenGenerator(ctx, *user.Email, *user.First_Name, *user.Last_Name, user.User_ID, user.Role)
+	user.Token = &token
+	user.Refresh_Token = &refreshToken
+	user.User_Cart = make([]models.ProductUser, 0)
+	user.User_Favorites = make([]models.ProductUser, 0)
+	user.Address_Details = make([]models.Address, 0)
+	insertErr := create(ctx, user)
+	if insertErr == repository.ErrAdminExists {
+		c.JSON(http.StatusConflict, gin.H{"error": insertErr.Error()})
+		return false
+	}
+	if insertErr != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "not created"})
+		return false
+	}
+	for _, channel := range []string{notify.ChannelEmail, notify.ChannelSMS} {
+		if err := app.sendVerification(ctx, user, channel); err != nil {
+			log.Println(err)
+		}
+	}
+	return true
 }
 
-func Login() gin.HandlerFunc {
+func (app *Application) Login() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
 		defer cancel()
 
 		var user models.User
-		var foundUser models.User
 
 		if err := c.BindJSON(&user); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err})
 			return
 		}
-		err := UserCollection.FindOne(ctx, bson.M{"email": user.Email}).Decode(&foundUser)
+		if user.Email == nil || user.Password == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "email and password are required"})
+			return
+		}
+		if !app.loginAllowed(ctx, c, *user.Email) {
+			return
+		}
+		foundUser, err := app.users.FindByEmail(ctx, *user.Email)
 		defer cancel()
 		if err != nil {
+			app.loginGuard.Fail(ctx, *user.Email, c.ClientIP())
 			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "login or password incorrect"})
 			return
 		}
@@ -127,79 +315,224 @@ func Login() gin.HandlerFunc {
 
 		if !passwordValid {
 			fmt.Println(msg)
+			app.loginGuard.Fail(ctx, *user.Email, c.ClientIP())
 			c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
 			return
 		}
-		token, refreshToken, _ := generate.TokenGenerator(*foundUser.Email, *foundUser.First_Name, *foundUser.Last_Name, foundUser.User_ID)
-		defer cancel()
-		generate.UpdateAllTokens(token, refreshToken, foundUser.User_ID)
-		c.JSON(http.StatusFound, foundUser)
+		if foundUser.TOTP_Enabled {
+			app.loginGuard.Release(ctx, *user.Email, c.ClientIP())
+			challenge, err := app.tokens.GenerateChallengeToken(ctx, foundUser.User_ID)
+			if err != nil {
+				log.Println(err)
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "login failed"})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"two_factor_required": true, "challenge_token": challenge})
+			return
+		}
+		app.issueTokens(c, foundUser)
+	}
+}
+
+// loginAllowed consults LoginGuard before any password is compared, so
+// throttled callers do not cost a bcrypt comparison.
+func (app *Application) loginAllowed(ctx context.Context, c *gin.Context, email string) bool {
+	wait, err := app.loginGuard.Check(ctx, email, c.ClientIP())
+	if err == lockout.ErrLocked || err == lockout.ErrTooEarly {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return false
+	}
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "login failed"})
+		return false
 	}
+	return true
 }
 
-func GetUser() gin.HandlerFunc {
+func (app *Application) UnlockAccount() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userQueryID := c.Query("id")
-		if userQueryID == "" {
-			log.Println("user id is empty")
-			c.AbortWithError(http.StatusBadRequest, errors.New("user id is empty"))
+		email := c.Query("email")
+		ip := c.Query("ip")
+		if email == "" && ip == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "email or ip is required"})
 			return
 		}
 
-		var user []models.User
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
 		defer cancel()
 
-		id, err := primitive.ObjectIDFromHex(userQueryID)
+		var keys []string
+		if email != "" {
+			keys = append(keys, lockout.AccountKey(email))
+		}
+		if ip != "" {
+			keys = append(keys, lockout.IPKey(ip))
+		}
+		for _, key := range keys {
+			if err := app.loginGuard.Unlock(ctx, key, c.GetString("uid")); err != nil {
+				log.Println(err)
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "cannot unlock " + key})
+				return
+			}
+		}
+		c.JSON(http.StatusOK, "Successfully unlocked")
+	}
+}
+
+func (app *Application) issueTokens(c *gin.Context, user *models.User) {
+	app.loginGuard.Succeed(c.Request.Context(), *user.Email, c.ClientIP())
+	token, refreshToken, err := app.tokens.TokenGenerator(c.Request.Context(), *user.Email, *user.First_Name, *user.Last_Name, user.User_ID, user.Role)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "login failed"})
+		return
+	}
+	if err = app.tokens.UpdateAllTokens(c.Request.Context(), token, refreshToken, user.User_ID); err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "login failed"})
+		return
+	}
+	c.JSON(http.StatusOK, models.AuthResponse{
+		Token:         token,
+		Refresh_Token: refreshToken,
+		User:          models.PublicUser{ID: user.ID, First_Name: user.First_Name, Last_Name: user.Last_Name},
+		User_ID:       user.User_ID,
+		Role:          user.Role,
+	})
+}
+
+func (app *Application) RefreshToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		var body struct {
+			Refresh_Token string `json:"refresh_token" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "refresh_token is required"})
+			return
+		}
+
+		token, refreshToken, err := app.tokens.RefreshAllTokens(ctx, body.Refresh_Token)
+		if errors.Is(err, generate.ErrRefreshTokenInvalid) || errors.Is(err, generate.ErrRefreshTokenReused) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
 		if err != nil {
 			log.Println(err)
-			c.AbortWithStatus(http.StatusInternalServerError)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "tokens cannot be refreshed"})
 			return
 		}
+		c.JSON(http.StatusOK, gin.H{"token": token, "refresh_token": refreshToken})
+	}
+}
 
-		cursor, err := UserCollection.Find(ctx, bson.M{"_id": id})
+func (app *Application) JWKS() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, app.tokens.JWKS())
+	}
+}
+
+func (app *Application) Logout() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		err := app.tokens.Logout(ctx, c.GetString("uid"), c.GetString("jti"), c.GetTime("expires_at"))
 		if err != nil {
 			log.Println(err)
-			c.AbortWithStatusJSON(http.StatusInternalServerError, "something went wrong, please try after some time")
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "logout failed"})
 			return
 		}
+		c.JSON(http.StatusOK, "Successfully logged out")
+	}
+}
 
-		if err = cursor.All(ctx, &user); err != nil {
+func (app *Application) LogoutAll() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		err := app.tokens.LogoutAll(ctx, c.GetString("uid"))
+		if err != nil {
 			log.Println(err)
-			c.AbortWithStatus(http.StatusInternalServerError)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "logout failed"})
 			return
 		}
-		defer cursor.Close(ctx)
+		c.JSON(http.StatusOK, "Successfully logged out of all sessions")
+	}
+}
 
-		if err := cursor.Err(); err != nil {
-			log.Println(err)
-			c.JSON(400, "invalid")
+func (app *Application) GetUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := actingUserObjectID(c)
+		if !ok {
 			return
 		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
 		defer cancel()
-		c.IndentedJSON(200, user[0])
+
+		var user interface{}
+		var err error
+		if c.GetString("role") == models.RoleAdmin && id.Hex() != c.GetString("uid") {
+			user, err = app.users.FindAdminView(ctx, id.Hex())
+		} else {
+			user, err = app.users.FindProfile(ctx, id.Hex())
+		}
+		if err == repository.ErrUserNotFound {
+			c.AbortWithStatusJSON(http.StatusNotFound, "user not found")
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, "something went wrong, please try after some time")
+			return
+		}
+		c.IndentedJSON(200, user)
 	}
 }
 
-func DeleteUser() gin.HandlerFunc {
+func (app *Application) GetPublicProfile() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userQueryID := c.Query("id")
-		if userQueryID == "" {
-			log.Println("user id is empty")
-			c.AbortWithError(http.StatusBadRequest, errors.New("user id is empty"))
+		id, err := primitive.ObjectIDFromHex(c.Query("id"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, "user id is not valid")
 			return
 		}
 
-		id, err := primitive.ObjectIDFromHex(userQueryID)
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		user, err := app.users.FindPublic(ctx, id.Hex())
+		if err == repository.ErrUserNotFound {
+			c.AbortWithStatusJSON(http.StatusNotFound, "user not found")
+			return
+		}
 		if err != nil {
-			c.AbortWithStatus(http.StatusInternalServerError)
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, "something went wrong, please try after some time")
+			return
+		}
+		c.IndentedJSON(200, user)
+	}
+}
+
+func (app *Application) DeleteUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := actingUserObjectID(c)
+		if !ok {
 			return
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
 		defer cancel()
 
-		_, err = UserCollection.DeleteOne(ctx, bson.M{"_id": id})
+		err := app.users.Delete(ctx, id.Hex())
 		if err != nil {
 			c.AbortWithStatusJSON(http.StatusInternalServerError, err)
 			return
@@ -210,7 +543,7 @@ func DeleteUser() gin.HandlerFunc {
 	}
 }
 
-func AddFavorite() gin.HandlerFunc {
+func (app *Application) AddFavorite() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		productQueryID := c.Query("id")
 		if productQueryID == "" {
@@ -221,14 +554,6 @@ func AddFavorite() gin.HandlerFunc {
 			return
 		}
 
-		userQueryID := c.Query("user_id")
-		if userQueryID == "" {
-			log.Println("user id is empty")
-			c.Header("Content-Type", "application/json")
-			c.JSON(http.StatusNotFound, gin.H{"Error": "user id is empty"})
-			return
-		}
-
 		productID, err := primitive.ObjectIDFromHex(productQueryID)
 		if err != nil {
 			log.Println(err)
@@ -236,29 +561,30 @@ func AddFavorite() gin.HandlerFunc {
 			return
 		}
 
-		userID, err := primitive.ObjectIDFromHex(userQueryID)
-		if err != nil {
-			log.Println(err)
-			c.AbortWithStatus(http.StatusInternalServerError)
+		userID, ok := actingUserObjectID(c)
+		if !ok {
 			return
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
 		defer cancel()
 
-		var favorite_product models.ProductUser
-		filter := bson.M{"_id": productID}
-
-		err = ProductCollection.FindOne(ctx, filter).Decode(&favorite_product)
+		product, err := app.products.FindByID(ctx, productID)
 		if err != nil {
 			c.IndentedJSON(http.StatusInternalServerError, "something went wrong, please try after some time")
 			return
 		}
 		defer cancel()
 
-		filter = bson.M{"_id": userID}
-		update := bson.M{"$push": bson.D{primitive.E{Key: "user_favorites", Value: favorite_product}}}
-		_, err = UserCollection.UpdateOne(ctx, filter, update)
+		favorite_product := models.ProductUser{
+			Product_ID:   product.Product_ID,
+			Product_Name: product.Product_Name,
+			Price:        product.Price,
+			Rating:       product.Rating,
+			Description:  product.Description,
+			Image:        product.Image,
+		}
+		err = app.users.AddFavorite(ctx, userID.Hex(), favorite_product)
 		if err != nil {
 			c.IndentedJSON(http.StatusInternalServerError, "The product cannot be added to favorites")
 			return
@@ -267,7 +593,7 @@ func AddFavorite() gin.HandlerFunc {
 	}
 }
 
-func RemoveFavorites() gin.HandlerFunc {
+func (app *Application) RemoveFavorites() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		productQueryID := c.Query("id")
 		if productQueryID == "" {
@@ -276,13 +602,6 @@ func RemoveFavorites() gin.HandlerFunc {
 			return
 		}
 
-		userQueryID := c.Query("user_id")
-		if userQueryID == "" {
-			log.Println("user id is empty")
-			c.AbortWithError(http.StatusBadRequest, errors.New("user id is empty"))
-			return
-		}
-
 		productID, err := primitive.ObjectIDFromHex(productQueryID)
 		if err != nil {
 			log.Println(err)
@@ -290,20 +609,15 @@ func RemoveFavorites() gin.HandlerFunc {
 			return
 		}
 
-		userID, err := primitive.ObjectIDFromHex(userQueryID)
-		if err != nil {
-			log.Println(err)
-			c.AbortWithStatus(http.StatusInternalServerError)
+		userID, ok := actingUserObjectID(c)
+		if !ok {
 			return
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
 		defer cancel()
 
-		filter := bson.M{"_id": userID}
-		update := bson.M{"$pull": bson.M{"user_favorites": bson.M{"_id": productID}}}
-
-		_, err = UserCollection.UpdateOne(ctx, filter, update)
+		err = app.users.RemoveFavorite(ctx, userID.Hex(), productID)
 		if err != nil {
 			c.AbortWithStatusJSON(http.StatusInternalServerError, "user cannot be updated")
 			return
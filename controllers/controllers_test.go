@@ -0,0 +1,472 @@
+package controllers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mauroarnedo/ecommerce/audit"
+	"github.com/mauroarnedo/ecommerce/config"
+	"github.com/mauroarnedo/ecommerce/controllers"
+	"github.com/mauroarnedo/ecommerce/database"
+	"github.com/mauroarnedo/ecommerce/lockout"
+	"github.com/mauroarnedo/ecommerce/middleware"
+	"github.com/mauroarnedo/ecommerce/models"
+	"github.com/mauroarnedo/ecommerce/notify"
+	"github.com/mauroarnedo/ecommerce/payment"
+	"github.com/mauroarnedo/ecommerce/repository"
+	"github.com/mauroarnedo/ecommerce/routes"
+	"github.com/mauroarnedo/ecommerce/tokens"
+	"github.com/mauroarnedo/ecommerce/totp"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const adminBootstrapToken = "test-bootstrap-token"
+
+type testServer struct {
+	t      *testing.T
+	router *gin.Engine
+	cfg    *config.Config
+	repos  *repository.Repositories
+}
+
+// newTestServer wires the application to in-memory repositories and
+// registers the routes the way main does.
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	cfg, err := config.Defaults(config.ProfileTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Auth.CheckoutRequiresVerified = config.VerifyNone
+	cfg.Auth.AdminBootstrapToken = adminBootstrapToken
+
+	keys, err := tokens.LoadKeys("", "test-secret", cfg.Auth.KeyGracePeriod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repos := repository.NewMemoryRepositories()
+	tokenManager := tokens.NewManager(keys, repos.Users, tokens.NewMemoryRevocationStore(), cfg.Auth.AccessTokenTTL, cfg.Auth.RefreshTokenTTL)
+	loginGuard := lockout.NewGuard(lockout.NewMemoryStore(), audit.StdLog{})
+	provider, err := payment.New(cfg.Payments.Provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := controllers.NewApplication(cfg, repos, tokenManager, loginGuard, notify.New(""), provider)
+
+	router := gin.New()
+	routes.UserRoutes(router, app, tokenManager)
+	routes.AdminRoutes(router, app, tokenManager)
+	routes.PaymentRoutes(router, app)
+	router.Use(middleware.Authentication(tokenManager), middleware.Authorization(models.RoleCustomer, models.RoleAdmin))
+	router.GET("/addtocart", app.AddToCart())
+	router.GET("/listcart", app.GetItemFromCart())
+	router.POST("/cartcheckout", app.BuyFromCart())
+	return &testServer{t: t, router: router, cfg: cfg, repos: repos}
+}
+
+// do sends a request with body encoded as JSON and the token header set
+// when token is not empty.
+func (s *testServer) do(method string, path string, body interface{}, token string) *httptest.ResponseRecorder {
+	s.t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			s.t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &buf)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("token", token)
+	}
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	return w
+}
+
+// expect fails the test unless the response has the wanted status, and
+// decodes its body into out when out is not nil.
+func (s *testServer) expect(w *httptest.ResponseRecorder, status int, out interface{}) {
+	s.t.Helper()
+	if w.Code != status {
+		s.t.Fatalf("status = %d, want %d: %s", w.Code, status, w.Body.String())
+	}
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			s.t.Fatalf("decoding %s: %v", w.Body.String(), err)
+		}
+	}
+}
+
+func signUpBody(email string, phone string) gin.H {
+	return gin.H{"first_name": "Jane", "last_name": "Doe", "email": email, "phone": phone, "password": "secret-password"}
+}
+
+// login signs a customer up and returns the access token of their session.
+func (s *testServer) login(email string, phone string) models.AuthResponse {
+	s.t.Helper()
+	s.expect(s.do(http.MethodPost, "/users/signup", signUpBody(email, phone), ""), http.StatusCreated, nil)
+	var auth models.AuthResponse
+	s.expect(s.do(http.MethodPost, "/users/login", gin.H{"email": email, "password": "secret-password"}, ""), http.StatusOK, &auth)
+	return auth
+}
+
+// bootstrap sends the request that creates the first admin.
+func (s *testServer) bootstrap(email string, phone string) *httptest.ResponseRecorder {
+	s.t.Helper()
+	body, err := json.Marshal(gin.H{"first_name": "Admin", "last_name": "Owner", "email": email, "phone": phone, "password": "secret-password"})
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/admin/bootstrap", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("bootstrap_token", adminBootstrapToken)
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	return w
+}
+
+// webhook delivers event the way the provider does, signed with the
+// configured secret.
+func (s *testServer) webhook(event payment.Event) *httptest.ResponseRecorder {
+	s.t.Helper()
+	body, err := json.Marshal(event)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/payments/webhook", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(payment.SignatureHeader, payment.Sign(s.cfg.Payments.WebhookSecret, time.Now(), body))
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	return w
+}
+
+// product stores a product priced 12.50 USD with stock units on the shelf.
+func (s *testServer) product(stock int) primitive.ObjectID {
+	s.t.Helper()
+	name := "mug"
+	price := models.NewMoney(1250, "USD")
+	product := models.Product{Product_ID: primitive.NewObjectID(), Product_Name: &name, Price: &price, Stock: &stock}
+	if err := s.repos.Products.Create(context.Background(), &product); err != nil {
+		s.t.Fatal(err)
+	}
+	return product.Product_ID
+}
+
+func (s *testServer) stock(productID primitive.ObjectID) int {
+	s.t.Helper()
+	product, err := s.repos.Products.FindByID(context.Background(), productID)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if product.Stock == nil {
+		s.t.Fatalf("product %s does not track its stock", productID.Hex())
+	}
+	return *product.Stock
+}
+
+func TestSignUpAndLogin(t *testing.T) {
+	s := newTestServer(t)
+
+	auth := s.login("jane@example.com", "+15550100")
+	if auth.Token == "" || auth.Refresh_Token == "" {
+		t.Fatalf("login returned no tokens: %+v", auth)
+	}
+	if auth.Role != models.RoleCustomer {
+		t.Errorf("role = %q, want %q", auth.Role, models.RoleCustomer)
+	}
+
+	s.expect(s.do(http.MethodPost, "/users/signup", signUpBody("jane@example.com", "+15550101"), ""), http.StatusBadRequest, nil)
+	s.expect(s.do(http.MethodPost, "/users/signup", signUpBody("john@example.com", "+15550100"), ""), http.StatusBadRequest, nil)
+
+	w := s.do(http.MethodPost, "/users/login", gin.H{"email": "jane@example.com", "password": "wrong-password"}, "")
+	if w.Code == http.StatusOK {
+		t.Fatalf("login with a wrong password succeeded: %s", w.Body.String())
+	}
+
+	var user models.User
+	s.expect(s.do(http.MethodGet, "/users/userinfo", nil, auth.Token), http.StatusOK, &user)
+	if user.Email == nil || *user.Email != "jane@example.com" {
+		t.Errorf("userinfo email = %v, want jane@example.com", user.Email)
+	}
+
+	s.expect(s.do(http.MethodPost, "/users/logout", nil, auth.Token), http.StatusOK, nil)
+	s.expect(s.do(http.MethodGet, "/users/userinfo", nil, auth.Token), http.StatusUnauthorized, nil)
+}
+
+func TestLogoutAll(t *testing.T) {
+	s := newTestServer(t)
+	first := s.login("jane@example.com", "+15550100")
+	var second models.AuthResponse
+	s.expect(s.do(http.MethodPost, "/users/login", gin.H{"email": "jane@example.com", "password": "secret-password"}, ""), http.StatusOK, &second)
+
+	s.expect(s.do(http.MethodPost, "/users/logout-all", nil, first.Token), http.StatusOK, nil)
+	s.expect(s.do(http.MethodGet, "/users/userinfo", nil, first.Token), http.StatusUnauthorized, nil)
+	s.expect(s.do(http.MethodGet, "/users/userinfo", nil, second.Token), http.StatusUnauthorized, nil)
+
+	// A login right after, within the same second, is not caught by it.
+	var again models.AuthResponse
+	s.expect(s.do(http.MethodPost, "/users/login", gin.H{"email": "jane@example.com", "password": "secret-password"}, ""), http.StatusOK, &again)
+	s.expect(s.do(http.MethodGet, "/users/userinfo", nil, again.Token), http.StatusOK, nil)
+}
+
+// TestRefreshTokenReuseRevokesFamily replays a rotated refresh token; every
+// token of that login, access tokens included, stops working.
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	s := newTestServer(t)
+	first := s.login("jane@example.com", "+15550100")
+
+	var second models.AuthResponse
+	s.expect(s.do(http.MethodPost, "/users/refresh", gin.H{"refresh_token": first.Refresh_Token}, ""), http.StatusOK, &second)
+	s.expect(s.do(http.MethodGet, "/users/userinfo", nil, second.Token), http.StatusOK, nil)
+	s.expect(s.do(http.MethodPost, "/users/refresh", gin.H{"refresh_token": first.Refresh_Token}, ""), http.StatusUnauthorized, nil)
+
+	s.expect(s.do(http.MethodGet, "/users/userinfo", nil, first.Token), http.StatusUnauthorized, nil)
+	s.expect(s.do(http.MethodGet, "/users/userinfo", nil, second.Token), http.StatusUnauthorized, nil)
+	s.expect(s.do(http.MethodPost, "/users/refresh", gin.H{"refresh_token": second.Refresh_Token}, ""), http.StatusUnauthorized, nil)
+}
+
+// TestLoginThrottlesParallelAttempts sends wrong passwords all at once; only
+// the free attempts and the one after them may reach the password check.
+func TestLoginThrottlesParallelAttempts(t *testing.T) {
+	s := newTestServer(t)
+	s.login("jane@example.com", "+15550100")
+
+	const attempts = 10
+	codes := make(chan int, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- s.do(http.MethodPost, "/users/login", gin.H{"email": "jane@example.com", "password": "wrong-password"}, "").Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	checked := 0
+	for code := range codes {
+		if code != http.StatusTooManyRequests {
+			checked++
+		}
+	}
+	if want := lockout.AccountPolicy.FreeAttempts + 1; checked > want {
+		t.Errorf("%d attempts reached the password check, want at most %d", checked, want)
+	}
+}
+
+// TestDisableTOTPThrottlesGuesses guesses the code of an enabled second
+// factor until the login throttle answers instead.
+func TestDisableTOTPThrottlesGuesses(t *testing.T) {
+	s := newTestServer(t)
+	auth := s.login("jane@example.com", "+15550100")
+
+	var enrollment struct {
+		Secret string `json:"secret"`
+	}
+	s.expect(s.do(http.MethodPost, "/users/2fa/enroll", nil, auth.Token), http.StatusOK, &enrollment)
+	code, err := totp.CodeAt(enrollment.Secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.expect(s.do(http.MethodPost, "/users/2fa/confirm", gin.H{"code": code}, auth.Token), http.StatusOK, nil)
+
+	for i := 0; i <= lockout.AccountPolicy.FreeAttempts; i++ {
+		s.expect(s.do(http.MethodPost, "/users/2fa/disable", gin.H{"recovery_code": "wrong-code"}, auth.Token), http.StatusUnauthorized, nil)
+	}
+	s.expect(s.do(http.MethodPost, "/users/2fa/disable", gin.H{"recovery_code": "wrong-code"}, auth.Token), http.StatusTooManyRequests, nil)
+}
+
+func TestCartCheckoutAndOrders(t *testing.T) {
+	s := newTestServer(t)
+	auth := s.login("jane@example.com", "+15550100")
+	productID := s.product(5)
+
+	s.expect(s.do(http.MethodGet, "/addtocart?id="+productID.Hex()+"&quantity=2", nil, auth.Token), http.StatusOK, nil)
+	var cart models.CartList
+	s.expect(s.do(http.MethodGet, "/listcart", nil, auth.Token), http.StatusOK, &cart)
+	if len(cart.Items) != 1 || cart.Items[0].Quantity != 2 {
+		t.Fatalf("cart items = %+v, want 2 units of one product", cart.Items)
+	}
+	if cart.Total != models.NewMoney(2500, "USD") {
+		t.Errorf("cart total = %+v, want 25.00 USD", cart.Total)
+	}
+
+	var placed struct {
+		Order_ID primitive.ObjectID `json:"order_id"`
+	}
+	s.expect(s.do(http.MethodPost, "/cartcheckout", gin.H{"payment_method": "cod"}, auth.Token), http.StatusOK, &placed)
+	if placed.Order_ID.IsZero() {
+		t.Fatal("checkout returned no order id")
+	}
+	if got := s.stock(productID); got != 3 {
+		t.Errorf("stock after checkout = %d, want 3", got)
+	}
+	s.expect(s.do(http.MethodGet, "/listcart", nil, auth.Token), http.StatusOK, &cart)
+	if len(cart.Items) != 0 {
+		t.Errorf("cart after checkout = %+v, want empty", cart.Items)
+	}
+	s.expect(s.do(http.MethodPost, "/cartcheckout", gin.H{"payment_method": "cod"}, auth.Token), http.StatusBadRequest, nil)
+
+	var list models.OrderList
+	s.expect(s.do(http.MethodGet, "/users/orders", nil, auth.Token), http.StatusOK, &list)
+	if list.Total != 1 || len(list.Orders) != 1 || list.Orders[0].Order_ID != placed.Order_ID {
+		t.Fatalf("orders = %+v, want the placed order", list)
+	}
+	var order models.Order
+	s.expect(s.do(http.MethodGet, "/users/orders/detail?id="+placed.Order_ID.Hex(), nil, auth.Token), http.StatusOK, &order)
+	if order.Status != models.OrderPending || order.Price != models.NewMoney(2500, "USD") {
+		t.Errorf("order status %q price %+v, want pending 25.00 USD", order.Status, order.Price)
+	}
+
+	other := s.login("john@example.com", "+15550101")
+	s.expect(s.do(http.MethodGet, "/users/orders/detail?id="+placed.Order_ID.Hex(), nil, other.Token), http.StatusNotFound, nil)
+	s.expect(s.do(http.MethodPost, "/users/orders/cancel?id="+placed.Order_ID.Hex(), nil, other.Token), http.StatusNotFound, nil)
+
+	s.expect(s.do(http.MethodPost, "/users/orders/cancel?id="+placed.Order_ID.Hex(), nil, auth.Token), http.StatusOK, nil)
+	if got := s.stock(productID); got != 5 {
+		t.Errorf("stock after cancelling = %d, want 5", got)
+	}
+	s.expect(s.do(http.MethodPost, "/users/orders/cancel?id="+placed.Order_ID.Hex(), nil, auth.Token), http.StatusConflict, nil)
+}
+
+func TestCheckoutOutOfStock(t *testing.T) {
+	s := newTestServer(t)
+	auth := s.login("jane@example.com", "+15550100")
+	productID := s.product(1)
+
+	s.expect(s.do(http.MethodGet, "/addtocart?id="+productID.Hex(), nil, auth.Token), http.StatusOK, nil)
+	sold := 0
+	if err := s.repos.Inventory.SetStock(context.Background(), productID, &sold); err != nil {
+		t.Fatal(err)
+	}
+	s.expect(s.do(http.MethodPost, "/cartcheckout", gin.H{"payment_method": "cod"}, auth.Token), http.StatusConflict, nil)
+	if got := s.stock(productID); got != 0 {
+		t.Errorf("stock after a failed checkout = %d, want 0", got)
+	}
+	var cart models.CartList
+	s.expect(s.do(http.MethodGet, "/listcart", nil, auth.Token), http.StatusOK, &cart)
+	if len(cart.Items) != 1 {
+		t.Errorf("cart after a failed checkout = %+v, want the line kept", cart.Items)
+	}
+}
+
+func TestAdminTransitionOrder(t *testing.T) {
+	s := newTestServer(t)
+	auth := s.login("jane@example.com", "+15550100")
+	productID := s.product(5)
+
+	s.expect(s.bootstrap("admin@example.com", "+15550199"), http.StatusCreated, nil)
+	var admin models.AuthResponse
+	s.expect(s.do(http.MethodPost, "/users/login", gin.H{"email": "admin@example.com", "password": "secret-password"}, ""), http.StatusOK, &admin)
+
+	s.expect(s.do(http.MethodGet, "/addtocart?id="+productID.Hex()+"&quantity=2", nil, auth.Token), http.StatusOK, nil)
+	var placed struct {
+		Order_ID primitive.ObjectID `json:"order_id"`
+	}
+	s.expect(s.do(http.MethodPost, "/cartcheckout", gin.H{"payment_method": "cod"}, auth.Token), http.StatusOK, &placed)
+
+	transition := func(status string) *httptest.ResponseRecorder {
+		return s.do(http.MethodPost, "/admin/orders/transition", gin.H{"order_id": placed.Order_ID.Hex(), "status": status}, admin.Token)
+	}
+	s.expect(transition(models.OrderRefunded), http.StatusBadRequest, nil)
+	s.expect(s.do(http.MethodPost, "/admin/orders/transition", gin.H{"order_id": placed.Order_ID.Hex(), "status": models.OrderCancelled}, auth.Token), http.StatusForbidden, nil)
+
+	var order models.Order
+	s.expect(transition(models.OrderCancelled), http.StatusOK, &order)
+	if order.Status != models.OrderCancelled {
+		t.Errorf("status = %q, want %q", order.Status, models.OrderCancelled)
+	}
+	if got := s.stock(productID); got != 5 {
+		t.Errorf("stock after an admin cancellation = %d, want 5", got)
+	}
+	s.expect(transition(models.OrderCancelled), http.StatusConflict, nil)
+}
+
+func TestSetUserRole(t *testing.T) {
+	s := newTestServer(t)
+	s.expect(s.bootstrap("admin@example.com", "+15550199"), http.StatusCreated, nil)
+	s.expect(s.bootstrap("second@example.com", "+15550198"), http.StatusConflict, nil)
+	var admin models.AuthResponse
+	s.expect(s.do(http.MethodPost, "/users/login", gin.H{"email": "admin@example.com", "password": "secret-password"}, ""), http.StatusOK, &admin)
+	jane := s.login("jane@example.com", "+15550100")
+
+	setRole := func(userID string, role string, token string) *httptest.ResponseRecorder {
+		return s.do(http.MethodPut, "/admin/setrole?id="+userID+"&role="+role, nil, token)
+	}
+	s.expect(setRole(admin.User_ID, models.RoleCustomer, admin.Token), http.StatusConflict, nil)
+
+	s.expect(setRole(jane.User_ID, models.RoleAdmin, admin.Token), http.StatusOK, nil)
+	s.expect(s.do(http.MethodGet, "/users/userinfo", nil, jane.Token), http.StatusUnauthorized, nil)
+	s.expect(s.do(http.MethodPost, "/users/login", gin.H{"email": "jane@example.com", "password": "secret-password"}, ""), http.StatusOK, &jane)
+	if jane.Role != models.RoleAdmin {
+		t.Errorf("role after promotion = %q, want %q", jane.Role, models.RoleAdmin)
+	}
+
+	s.expect(setRole(admin.User_ID, models.RoleCustomer, jane.Token), http.StatusOK, nil)
+	s.expect(s.do(http.MethodGet, "/admin/orders", nil, admin.Token), http.StatusUnauthorized, nil)
+	s.expect(setRole(jane.User_ID, models.RoleCustomer, jane.Token), http.StatusConflict, nil)
+}
+
+func TestPaymentWebhookReclaimsStaleEvent(t *testing.T) {
+	s := newTestServer(t)
+	event := payment.Event{ID: "evt_stale", Type: payment.EventCaptured, Provider_Ref: "pay_unknown"}
+	record := database.PaymentEvent{ID: event.ID, Type: event.Type, Provider_Ref: event.Provider_Ref}
+	if _, claimed, err := s.repos.PaymentEvents.Claim(context.Background(), record, s.cfg.Payments.EventLease); err != nil || !claimed {
+		t.Fatalf("claim = %v, %v, want a new claim", claimed, err)
+	}
+
+	s.expect(s.webhook(event), http.StatusConflict, nil)
+
+	// The first delivery never finished; once its lease ran out a retry
+	// takes the event over.
+	s.cfg.Payments.EventLease = time.Nanosecond
+	s.expect(s.webhook(event), http.StatusOK, nil)
+	stored, err := s.repos.PaymentEvents.Find(context.Background(), event.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != database.EventProcessed || stored.Attempts != 2 {
+		t.Errorf("event status %q after %d attempts, want processed after 2", stored.Status, stored.Attempts)
+	}
+}
+
+func TestCheckoutCaptureUnknown(t *testing.T) {
+	s := newTestServer(t)
+	auth := s.login("jane@example.com", "+15550100")
+	productID := s.product(5)
+
+	s.expect(s.do(http.MethodGet, "/addtocart?id="+productID.Hex(), nil, auth.Token), http.StatusOK, nil)
+	var pending struct {
+		Order_ID primitive.ObjectID     `json:"order_id"`
+		Payment  database.PaymentIntent `json:"payment"`
+	}
+	body := gin.H{"payment_method": "digital", "payment_token": payment.CardCaptureFails}
+	s.expect(s.do(http.MethodPost, "/cartcheckout", body, auth.Token), http.StatusAccepted, &pending)
+	if pending.Payment.Status != database.PaymentCaptureUnknown {
+		t.Fatalf("payment status = %q, want %q", pending.Payment.Status, database.PaymentCaptureUnknown)
+	}
+	var order models.Order
+	s.expect(s.do(http.MethodGet, "/users/orders/detail?id="+pending.Order_ID.Hex(), nil, auth.Token), http.StatusOK, &order)
+	if order.Status != models.OrderPending {
+		t.Fatalf("order status = %q before the webhook, want %q", order.Status, models.OrderPending)
+	}
+
+	captured := payment.Event{ID: "evt_capture", Type: payment.EventCaptured, Provider_Ref: pending.Payment.Provider_Ref}
+	s.expect(s.webhook(captured), http.StatusOK, nil)
+	s.expect(s.do(http.MethodGet, "/users/orders/detail?id="+pending.Order_ID.Hex(), nil, auth.Token), http.StatusOK, &order)
+	if order.Status != models.OrderPaid {
+		t.Errorf("order status = %q after the capture webhook, want %q", order.Status, models.OrderPaid)
+	}
+}
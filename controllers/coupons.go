@@ -0,0 +1,279 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mauroarnedo/ecommerce/database"
+	"github.com/mauroarnedo/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// CreateCoupon adds a promotion code. The code is case insensitive and the
+// coupon is active from the start; uses are counted by the store.
+func (app *Application) CreateCoupon() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var coupon models.Coupon
+		if err := c.BindJSON(&coupon); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		coupon.Code = models.NormalizeCouponCode(coupon.Code)
+		if err := app.checkCoupon(&coupon); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		now := time.Now()
+		coupon.ID = primitive.NewObjectID()
+		coupon.Uses = 0
+		coupon.Active = true
+		coupon.Created_At = now
+		coupon.Updated_At = now
+
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		if err := app.coupons.Create(ctx, &coupon); err != nil {
+			couponError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusCreated, coupon)
+	}
+}
+
+// checkCoupon validates a new coupon; amounts default to the store currency.
+func (app *Application) checkCoupon(coupon *models.Coupon) error {
+	if coupon.Code == "" {
+		return errors.New("code is required")
+	}
+	switch coupon.Type {
+	case models.CouponPercentage:
+		if coupon.Basis_Points <= 0 || coupon.Basis_Points > 10000 {
+			return errors.New("basis_points must be between 1 and 10000")
+		}
+		coupon.Amount = nil
+	case models.CouponFixed:
+		if err := app.checkPrice(coupon.Amount); err != nil {
+			return errors.New("amount: " + err.Error())
+		}
+		if coupon.Amount.IsZero() {
+			return errors.New("amount must be positive")
+		}
+		coupon.Basis_Points = 0
+	case models.CouponFreeShipping:
+		coupon.Amount = nil
+		coupon.Basis_Points = 0
+	default:
+		return errors.New("type must be percentage, fixed or free_shipping")
+	}
+	if coupon.Min_Total != nil {
+		if err := app.checkPrice(coupon.Min_Total); err != nil {
+			return errors.New("min_total: " + err.Error())
+		}
+	}
+	if coupon.Max_Uses < 0 || coupon.Max_Uses_Per_User < 0 {
+		return errors.New("usage limits cannot be negative")
+	}
+	if !coupon.Starts_At.IsZero() && !coupon.Ends_At.IsZero() && !coupon.Ends_At.After(coupon.Starts_At) {
+		return errors.New("ends_at must be after starts_at")
+	}
+	return nil
+}
+
+func (app *Application) ListCoupons() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		coupons, err := app.coupons.List(ctx)
+		if err != nil {
+			couponError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusOK, gin.H{"coupons": coupons})
+	}
+}
+
+// SetCouponActive switches a coupon off, or back on. Orders already placed
+// keep their discount.
+func (app *Application) SetCouponActive() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Code   string `json:"code" binding:"required"`
+			Active *bool  `json:"active" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "code and active are required"})
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		if err := app.coupons.SetActive(ctx, body.Code, *body.Active); err != nil {
+			couponError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusOK, gin.H{"code": models.NormalizeCouponCode(body.Code), "active": *body.Active})
+	}
+}
+
+// ApplyCoupon checks the coupon against the cart and keeps it for the
+// checkout, replacing the one applied before.
+func (app *Application) ApplyCoupon() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		code := c.Query("code")
+		if code == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "coupon code is empty"})
+			return
+		}
+		userID, ok := actingUserID(c)
+		if !ok {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		coupon, err := app.coupons.FindByCode(ctx, code)
+		if err == nil {
+			err = app.couponUsable(ctx, coupon, userID)
+		}
+		if err != nil {
+			couponError(c, err)
+			return
+		}
+		cart, total, err := app.carts.Items(ctx, userID)
+		if err != nil {
+			cartError(c, err)
+			return
+		}
+		if len(cart) == 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": database.ErrCartEmpty.Error()})
+			return
+		}
+		if _, _, err = database.CouponDiscount(coupon, cart, time.Now()); err != nil {
+			couponError(c, err)
+			return
+		}
+		if err = app.users.SetCartCoupon(ctx, userID, coupon.Code); err != nil {
+			cartError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusOK, app.cartList(ctx, userID, cart, total, coupon.Code))
+	}
+}
+
+func (app *Application) RemoveCoupon() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := actingUserID(c)
+		if !ok {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		if err := app.users.SetCartCoupon(ctx, userID, ""); err != nil {
+			cartError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusOK, "the coupon was removed from the cart")
+	}
+}
+
+// cartList prices the cart with the coupon applied to it, if any. A coupon
+// that no longer applies is reported instead of failing the listing.
+func (app *Application) cartList(ctx context.Context, userID string, items []models.ProductUser, total models.Money, code string) models.CartList {
+	list := models.CartList{Items: items, Total: total, Coupon: code}
+	if code == "" {
+		return list
+	}
+	coupon, err := app.coupons.FindByCode(ctx, code)
+	if err == nil {
+		err = app.couponUsable(ctx, coupon, userID)
+	}
+	var discount models.Money
+	if err == nil {
+		discount, _, err = database.CouponDiscount(coupon, items, time.Now())
+	}
+	if err != nil {
+		if !isCouponError(err) {
+			log.Println(err)
+		}
+		list.Coupon_Error = err.Error()
+		return list
+	}
+	list.Discount = &discount
+	return list
+}
+
+// couponUsable checks the usage limits of the coupon for the user. They are
+// enforced again when the checkout redeems it.
+func (app *Application) couponUsable(ctx context.Context, coupon *models.Coupon, userID string) error {
+	if !coupon.ValidAt(time.Now()) {
+		return database.ErrCouponInactive
+	}
+	if coupon.Max_Uses > 0 && coupon.Uses >= coupon.Max_Uses {
+		return database.ErrCouponUsedUp
+	}
+	if coupon.Max_Uses_Per_User == 0 {
+		return nil
+	}
+	used, err := app.coupons.Redemptions(ctx, coupon.ID, userID)
+	if err != nil {
+		return err
+	}
+	if used >= coupon.Max_Uses_Per_User {
+		return database.ErrCouponUserLimit
+	}
+	return nil
+}
+
+// checkoutCoupon redeems the coupon named by code for a checkout, nil when
+// there is none. The caller releases it if the order is not placed.
+func (app *Application) checkoutCoupon(ctx context.Context, c *gin.Context, userID string, code string) (*models.Coupon, bool) {
+	if code == "" {
+		return nil, true
+	}
+	coupon, err := app.coupons.FindByCode(ctx, code)
+	if err == nil && !coupon.ValidAt(time.Now()) {
+		err = database.ErrCouponInactive
+	}
+	if err == nil {
+		err = app.coupons.Redeem(ctx, coupon, userID)
+	}
+	if err != nil {
+		couponError(c, err)
+		return nil, false
+	}
+	return coupon, true
+}
+
+func (app *Application) releaseCoupon(ctx context.Context, couponID primitive.ObjectID, userID string) {
+	if err := app.coupons.Release(ctx, couponID, userID); err != nil {
+		log.Println(err)
+	}
+}
+
+func isCouponError(err error) bool {
+	switch err {
+	case database.ErrCouponNotFound, database.ErrCouponExists, database.ErrCouponInactive, database.ErrCouponNotApplicable,
+		database.ErrCouponMinimum, database.ErrCouponUsedUp, database.ErrCouponUserLimit:
+		return true
+	}
+	return false
+}
+
+func couponError(c *gin.Context, err error) {
+	switch {
+	case err == database.ErrCouponNotFound:
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case isCouponError(err), errors.Is(err, models.ErrCurrencyMismatch):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -0,0 +1,253 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mauroarnedo/ecommerce/database"
+	"github.com/mauroarnedo/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TransitionOrder moves an order to another status. Moves that
+// models.OrderTransitions does not allow are rejected with 409. Cancelling
+// returns the stock and the payment like CancelOrder does; refunded is only
+// reached through RefundOrder, which moves the money.
+func (app *Application) TransitionOrder() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Order_ID string `json:"order_id" binding:"required"`
+			Status   string `json:"status" binding:"required"`
+			Note     string `json:"note"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "order_id and status are required"})
+			return
+		}
+		orderID, err := primitive.ObjectIDFromHex(body.Order_ID)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "order id is not valid"})
+			return
+		}
+		if !models.IsOrderStatus(body.Status) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unknown order status"})
+			return
+		}
+
+		if body.Status == models.OrderRefunded {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "orders are refunded through /admin/orders/refund"})
+			return
+		}
+
+		actor := c.GetString("uid")
+		if body.Status == models.OrderCancelled {
+			app.adminCancelOrder(c, orderID, actor, body.Note)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		order, err := app.orders.Transition(ctx, orderID, body.Status, actor, body.Note)
+		if err == database.ErrOrderNotFound {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, models.ErrIllegalTransition) || err == database.ErrOrderChanged {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "the order cannot be updated"})
+			return
+		}
+		c.IndentedJSON(http.StatusOK, order)
+	}
+}
+
+// adminCancelOrder cancels an order on behalf of an admin, see cancelOrder
+// and settleCancelledPayment.
+func (app *Application) adminCancelOrder(c *gin.Context, orderID primitive.ObjectID, actor string, note string) {
+	ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+	defer cancel()
+
+	order, err := app.orders.FindByID(ctx, orderID)
+	if err == nil {
+		order, err = app.cancelOrder(ctx, order, actor, note)
+	}
+	if err != nil {
+		refundError(c, err)
+		return
+	}
+	settled, err := app.settleCancelledPayment(ctx, order, actor)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"error": "the order was cancelled but its payment could not be returned yet", "order": order})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, settled)
+}
+
+const (
+	defaultOrderPageSize = 20
+	maxOrderPageSize     = 100
+)
+
+// ListOrders returns the acting user's orders, newest first. It accepts
+// page, limit, status, from and to query parameters.
+func (app *Application) ListOrders() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := actingUserID(c)
+		if !ok {
+			return
+		}
+		filter, ok := orderFilterFromQuery(c)
+		if !ok {
+			return
+		}
+		filter.UserID = userID
+		app.searchOrders(c, filter)
+	}
+}
+
+// SearchOrders lets admins search every order. On top of the ListOrders
+// parameters it accepts user_id, product_id, min_total and max_total.
+func (app *Application) SearchOrders() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter, ok := orderFilterFromQuery(c)
+		if !ok {
+			return
+		}
+		filter.UserID = c.Query("user_id")
+		if productQueryID := c.Query("product_id"); productQueryID != "" {
+			productID, err := primitive.ObjectIDFromHex(productQueryID)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "product id is not valid"})
+				return
+			}
+			filter.ProductID = productID
+		}
+		for param, bound := range map[string]**models.Money{"min_total": &filter.MinTotal, "max_total": &filter.MaxTotal} {
+			value := c.Query(param)
+			if value == "" {
+				continue
+			}
+			total, err := models.ParseMoney(value, app.cfg.Store.Currency)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": param + " must be an amount such as 19.99"})
+				return
+			}
+			*bound = &total
+		}
+		app.searchOrders(c, filter)
+	}
+}
+
+func (app *Application) searchOrders(c *gin.Context, filter database.OrderFilter) {
+	ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+	defer cancel()
+
+	orders, total, err := app.orders.Search(ctx, filter)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "orders cannot be listed"})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, models.OrderList{
+		Orders: orders,
+		Total:  total,
+		Page:   filter.Skip/filter.Limit + 1,
+		Limit:  filter.Limit,
+	})
+}
+
+// orderFilterFromQuery reads the pagination, status and date range shared
+// by the order listings. Dates are RFC 3339 timestamps or plain days; a
+// plain day in "to" includes that whole day.
+func orderFilterFromQuery(c *gin.Context) (database.OrderFilter, bool) {
+	var filter database.OrderFilter
+	page, limit := int64(1), int64(defaultOrderPageSize)
+	var err error
+	if value := c.Query("page"); value != "" {
+		if page, err = strconv.ParseInt(value, 10, 64); err != nil || page < 1 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "page must be a positive number"})
+			return filter, false
+		}
+	}
+	if value := c.Query("limit"); value != "" {
+		if limit, err = strconv.ParseInt(value, 10, 64); err != nil || limit < 1 || limit > maxOrderPageSize {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxOrderPageSize)})
+			return filter, false
+		}
+	}
+	filter.Skip, filter.Limit = (page-1)*limit, limit
+
+	filter.Status = c.Query("status")
+	if filter.Status != "" && !models.IsOrderStatus(filter.Status) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unknown order status"})
+		return filter, false
+	}
+	if filter.From, err = parseOrderDate(c.Query("from"), false); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "from must be a date (2006-01-02) or an RFC 3339 time"})
+		return filter, false
+	}
+	if filter.To, err = parseOrderDate(c.Query("to"), true); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "to must be a date (2006-01-02) or an RFC 3339 time"})
+		return filter, false
+	}
+	return filter, true
+}
+
+func parseOrderDate(value string, endOfDay bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	day, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endOfDay {
+		day = day.AddDate(0, 0, 1)
+	}
+	return day, nil
+}
+
+// GetOrder returns one order. Customers only see their own orders; any
+// other id answers 404 so order ids cannot be probed.
+func (app *Application) GetOrder() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		orderID, err := primitive.ObjectIDFromHex(c.Query("id"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "order id is not valid"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		order, err := app.orders.FindByID(ctx, orderID)
+		if err == nil && c.GetString("role") != models.RoleAdmin && order.User_ID != c.GetString("uid") {
+			err = database.ErrOrderNotFound
+		}
+		if err == database.ErrOrderNotFound {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "the order cannot be read"})
+			return
+		}
+		c.IndentedJSON(http.StatusOK, order)
+	}
+}
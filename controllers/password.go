@@ -0,0 +1,139 @@
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mauroarnedo/ecommerce/database"
+	"github.com/mauroarnedo/ecommerce/notify"
+	"github.com/mauroarnedo/ecommerce/repository"
+)
+
+const passwordResetTTL = 30 * time.Minute
+
+func (app *Application) RequestPasswordReset() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		var body struct {
+			Email string `json:"email" validate:"email,required"`
+		}
+		if err := c.BindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := Validate.Struct(body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "a valid email is required"})
+			return
+		}
+
+		// The answer is the same whether the account exists or not, so the
+		// endpoint cannot be used to discover registered emails.
+		accepted := "If the account exists, a reset link was sent to its email"
+
+		user, err := app.users.FindByEmail(ctx, body.Email)
+		if err != nil {
+			if err != repository.ErrUserNotFound {
+				log.Println(err)
+			}
+			c.JSON(http.StatusAccepted, accepted)
+			return
+		}
+
+		token, tokenHash, err := newResetToken()
+		if err != nil {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "the reset cannot be requested"})
+			return
+		}
+		err = app.passwordResets.Create(ctx, user.User_ID, tokenHash, time.Now().Add(passwordResetTTL))
+		if err != nil {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "the reset cannot be requested"})
+			return
+		}
+
+		link := app.cfg.Notify.PasswordResetURL
+		err = app.notifier.Send(ctx, notify.Message{
+			Channel: notify.ChannelEmail,
+			To:      body.Email,
+			Subject: "Reset your password",
+			Body:    "Use this link within 30 minutes to choose a new password: " + link + "?token=" + token,
+		})
+		if err != nil {
+			log.Println(err)
+		}
+		c.JSON(http.StatusAccepted, accepted)
+	}
+}
+
+func (app *Application) ConfirmPasswordReset() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		var body struct {
+			Token    string `json:"token" validate:"required"`
+			Password string `json:"password" validate:"required,min=6"`
+		}
+		if err := c.BindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := Validate.Struct(body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "token and a password of at least 6 characters are required"})
+			return
+		}
+
+		tokenHash := hashResetToken(body.Token)
+		userID, err := app.passwordResets.Consume(ctx, tokenHash)
+		if err == database.ErrResetTokenInvalid {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "the password cannot be reset"})
+			return
+		}
+
+		// The sessions are revoked before the password changes, so a new
+		// password never leaves the sessions of the old one alive.
+		err = app.tokens.LogoutAll(ctx, userID)
+		if err == nil {
+			err = app.users.SetPassword(ctx, userID, HashPassword(body.Password, app.cfg.Auth.BcryptCost))
+		}
+		if err != nil {
+			log.Println(err)
+			// The token was not used up, the user may try it again.
+			if releaseErr := app.passwordResets.Release(context.Background(), tokenHash); releaseErr != nil {
+				log.Println(releaseErr)
+			}
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "the password cannot be reset"})
+			return
+		}
+		c.JSON(http.StatusOK, "The password was changed, please log in again")
+	}
+}
+
+func newResetToken() (token string, tokenHash string, err error) {
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, hashResetToken(token), nil
+}
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,144 @@
+package controllers
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mauroarnedo/ecommerce/database"
+	"github.com/mauroarnedo/ecommerce/models"
+)
+
+// Payment methods a checkout may ask for.
+const (
+	PaymentCOD     = "cod"
+	PaymentDigital = "digital"
+)
+
+// checkoutRequest is the optional body of a checkout. Without one the order
+// is paid cash on delivery. Coupon_Code overrides the coupon applied to the
+// cart.
+type checkoutRequest struct {
+	Payment_Method string `json:"payment_method"`
+	Payment_Token  string `json:"payment_token"`
+	Coupon_Code    string `json:"coupon_code"`
+}
+
+// checkoutPayment reads the body of a checkout and the payment method it
+// asks for.
+func (app *Application) checkoutPayment(c *gin.Context) (models.Payment, checkoutRequest, bool) {
+	var request checkoutRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.BindJSON(&request); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return models.Payment{}, request, false
+		}
+	}
+	switch request.Payment_Method {
+	case "", PaymentCOD:
+		return models.Payment{COD: true}, request, true
+	case PaymentDigital:
+		if app.provider == nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "digital payments are not available, pay cash on delivery"})
+			return models.Payment{}, request, false
+		}
+		if request.Payment_Token == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "payment_token is required for digital payments"})
+			return models.Payment{}, request, false
+		}
+		return models.Payment{Digital: true}, request, true
+	}
+	c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "payment_method must be cod or digital"})
+	return models.Payment{}, request, false
+}
+
+// payOrder authorizes and captures the total of a digitally paid order and
+// marks it paid. When the payment fails the order is cancelled, its stock
+// returned and, for fromCart orders, its lines put back in the cart so the
+// user can try again; the response is written and payOrder reports false.
+// Once the money may have been captured the answer is never a 5xx, so the
+// idempotency middleware keeps it and a retry can not charge twice: a
+// capture that failed, whose outcome the provider did not tell, and an
+// order that could not be marked paid are answered 202 and the payment
+// webhook settles the order.
+func (app *Application) payOrder(ctx context.Context, c *gin.Context, order *models.Order, token string, fromCart bool) (*database.PaymentIntent, bool) {
+	intent := database.NewPaymentIntent(order, app.provider.Name())
+	if err := app.payments.Create(ctx, &intent); err != nil {
+		log.Println(err)
+		app.abandonOrder(ctx, order, "the payment could not be started", fromCart)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	authorization, err := app.provider.Authorize(ctx, intent.ID.Hex(), intent.Amount, token)
+	if err != nil {
+		log.Println(err)
+		app.failPayment(ctx, &intent, err.Error())
+		app.abandonOrder(ctx, order, "payment provider error", fromCart)
+		c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"error": "the payment could not be processed, try again"})
+		return nil, false
+	}
+	if !authorization.Approved {
+		app.failPayment(ctx, &intent, authorization.Decline_Code)
+		app.abandonOrder(ctx, order, "payment declined: "+authorization.Decline_Code, fromCart)
+		c.AbortWithStatusJSON(http.StatusPaymentRequired, gin.H{"error": "the payment was declined", "decline_code": authorization.Decline_Code})
+		return nil, false
+	}
+	intent.Provider_Ref = authorization.Reference
+	app.movePayment(ctx, &intent, database.PaymentAuthorized)
+
+	if err = app.provider.Capture(ctx, intent.Provider_Ref, intent.Amount); err != nil {
+		log.Println(err)
+		intent.Failure = err.Error()
+		app.movePayment(ctx, &intent, database.PaymentCaptureUnknown)
+		c.AbortWithStatusJSON(http.StatusAccepted, gin.H{"message": "the payment is being confirmed, the order will be updated shortly", "order_id": order.Order_ID, "payment": intent})
+		return nil, false
+	}
+	intent.Captured = intent.Amount
+	app.movePayment(ctx, &intent, database.PaymentCaptured)
+
+	if _, err = app.orders.Transition(ctx, order.Order_ID, models.OrderPaid, "payment", "captured "+intent.Provider_Ref); err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusAccepted, gin.H{"message": "the payment was captured, the order will be marked paid shortly", "order_id": order.Order_ID, "payment": intent})
+		return nil, false
+	}
+	return &intent, true
+}
+
+func (app *Application) failPayment(ctx context.Context, intent *database.PaymentIntent, reason string) {
+	intent.Failure = reason
+	app.movePayment(ctx, intent, database.PaymentFailed)
+}
+
+// movePayment saves the intent in its new status. The provider already
+// acted, so a failed save is only logged.
+func (app *Application) movePayment(ctx context.Context, intent *database.PaymentIntent, status string) {
+	from := intent.Status
+	intent.Status = status
+	if err := app.payments.Save(ctx, intent, from); err != nil {
+		log.Println(err)
+	}
+}
+
+// abandonOrder cancels an order whose payment failed and undoes what
+// placing it did.
+func (app *Application) abandonOrder(ctx context.Context, order *models.Order, note string, fromCart bool) {
+	if _, err := app.cancelOrder(ctx, order, "payment", note); err != nil {
+		log.Println(err)
+		return
+	}
+	if !fromCart {
+		return
+	}
+	for _, item := range order.Order_Cart {
+		if err := app.carts.Add(ctx, order.User_ID, item.Product_ID, item.Quantity); err != nil {
+			log.Println(err)
+		}
+	}
+	if order.Coupon != nil {
+		if err := app.users.SetCartCoupon(ctx, order.User_ID, order.Coupon.Code); err != nil {
+			log.Println(err)
+		}
+	}
+}
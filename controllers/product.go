@@ -3,19 +3,19 @@ package controllers
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
-	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/mauroarnedo/ecommerce/database"
 	"github.com/mauroarnedo/ecommerce/models"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-func ProductViewerAdmin() gin.HandlerFunc {
+func (app *Application) ProductViewerAdmin() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		var ctx, cancel = context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
 		var products models.Product
 		defer cancel()
 		if err := c.BindJSON(&products); err != nil {
@@ -23,9 +23,13 @@ func ProductViewerAdmin() gin.HandlerFunc {
 			return
 		}
 
+		if err := app.checkPrice(products.Price); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
+			return
+		}
 		products.Product_ID = primitive.NewObjectID()
 		products.Comments = make([]models.Comment, 0)
-		_, err := ProductCollection.InsertOne(ctx, products)
+		err := app.products.Create(ctx, &products)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"Error": "not inserted"})
 			return
@@ -35,9 +39,9 @@ func ProductViewerAdmin() gin.HandlerFunc {
 	}
 }
 
-func ProductViewerAdminBulk() gin.HandlerFunc {
+func (app *Application) ProductViewerAdminBulk() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
 		var products []models.Product
 		defer cancel()
 
@@ -46,17 +50,18 @@ func ProductViewerAdminBulk() gin.HandlerFunc {
 			return
 		}
 
-		productsInterface := make([]interface{}, len(products))
-
 		for i := range products {
+			if err := app.checkPrice(products[i].Price); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"Error": fmt.Sprintf("product %d: %s", i, err)})
+				return
+			}
 			products[i].Product_ID = primitive.NewObjectID()
 			products[i].Comments = make([]models.Comment, 0)
-			productsInterface[i] = products[i]
 		}
 
-		_, err := ProductCollection.InsertMany(ctx, productsInterface)
+		err := app.products.CreateMany(ctx, products)
 		if err != nil {
-			log.Fatal(err)
+			log.Println(err)
 			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"Error": "products cannot inserted"})
 			return
 		}
@@ -65,42 +70,42 @@ func ProductViewerAdminBulk() gin.HandlerFunc {
 	}
 }
 
-func SearchProduct() gin.HandlerFunc {
-	return func(c *gin.Context) {
+// checkPrice requires a non-negative price in the store currency, which is
+// filled in when the price leaves it out.
+func (app *Application) checkPrice(price *models.Money) error {
+	if price == nil {
+		return errors.New("price is required")
+	}
+	if price.Currency == "" {
+		price.Currency = app.cfg.Store.Currency
+	}
+	if price.Currency != app.cfg.Store.Currency {
+		return fmt.Errorf("price must be in %s", app.cfg.Store.Currency)
+	}
+	if price.Amount < 0 {
+		return errors.New("price cannot be negative")
+	}
+	return nil
+}
 
-		var productList []models.Product
-		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+func (app *Application) SearchProduct() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var ctx, cancel = context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
 		defer cancel()
 
-		cursor, err := ProductCollection.Find(ctx, bson.D{{}})
-		if err != nil {
-			c.IndentedJSON(http.StatusInternalServerError, "something went wrong, please try after some time")
-			return
-		}
-
-		err = cursor.All(ctx, &productList)
+		productList, err := app.products.List(ctx)
 		if err != nil {
 			log.Println(err)
-			c.AbortWithStatus(http.StatusInternalServerError)
-			return
-		}
-		defer cursor.Close(ctx)
-
-		if err := cursor.Err(); err != nil {
-			log.Println(err)
-			c.IndentedJSON(400, "invalid")
+			c.IndentedJSON(http.StatusInternalServerError, "something went wrong, please try after some time")
 			return
 		}
-		defer cancel()
 		c.IndentedJSON(200, productList)
 	}
 }
 
-func SearchProductByQuery() gin.HandlerFunc {
+func (app *Application) SearchProductByQuery() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		query := c.Query("name")
-
-		var searchProducts []models.Product
 		if query == "" {
 			log.Println("Query is empty")
 			c.Header("Content-Type", "application/json")
@@ -108,34 +113,20 @@ func SearchProductByQuery() gin.HandlerFunc {
 			c.Abort()
 			return
 		}
-		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
 		defer cancel()
 
-		cursor, err := ProductCollection.Find(ctx, bson.M{"product_name": bson.M{"$regex": query, "$options": "i"}})
-		if err != nil {
-			c.IndentedJSON(http.StatusInternalServerError, "something went wrong, please try after some time")
-			return
-		}
-
-		err = cursor.All(ctx, &searchProducts)
+		searchProducts, err := app.products.SearchByName(ctx, query)
 		if err != nil {
 			log.Println(err)
-			c.AbortWithStatus(http.StatusInternalServerError)
-			return
-		}
-		defer cursor.Close(ctx)
-
-		if err = cursor.Err(); err != nil {
-			log.Println(err)
-			c.IndentedJSON(400, "invalid")
+			c.IndentedJSON(http.StatusInternalServerError, "something went wrong, please try after some time")
 			return
 		}
-		defer cancel()
 		c.IndentedJSON(200, searchProducts)
 	}
 }
 
-func DeleteProduct() gin.HandlerFunc {
+func (app *Application) DeleteProduct() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		productQueryID := c.Query("id")
 		if productQueryID == "" {
@@ -144,7 +135,7 @@ func DeleteProduct() gin.HandlerFunc {
 			return
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
 		defer cancel()
 
 		productID, err := primitive.ObjectIDFromHex(productQueryID)
@@ -153,21 +144,51 @@ func DeleteProduct() gin.HandlerFunc {
 			return
 		}
 
-		_, err = ProductCollection.DeleteOne(ctx, bson.M{"_id": productID})
-		if err != nil {
+		if err = app.products.Delete(ctx, productID); err != nil {
+			log.Println(err)
 			c.AbortWithStatus(http.StatusInternalServerError)
-			panic(err)
+			return
 		}
-		defer cancel()
-
-		update := bson.M{"$pull": bson.M{"user_favorites": bson.M{"_id": productID}}}
-		_, err = UserCollection.UpdateMany(ctx, bson.M{}, update)
-		if err != nil {
+		if err = app.users.RemoveFavoriteFromAll(ctx, productID); err != nil {
+			log.Println(err)
 			c.AbortWithStatus(http.StatusInternalServerError)
-			panic(err)
+			return
 		}
-		defer cancel()
 
 		c.IndentedJSON(200, "Product was successfully deleted")
 	}
 }
+
+// SetStock sets how many units of a product are left to sell. A null stock
+// stops tracking it, the product then never runs out.
+func (app *Application) SetStock() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request struct {
+			Product_ID primitive.ObjectID `json:"product_id" binding:"required"`
+			Stock      *int               `json:"stock"`
+		}
+		if err := c.BindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if request.Stock != nil && *request.Stock < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "stock cannot be negative"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		err := app.inventory.SetStock(ctx, request.Product_ID, request.Stock)
+		if err == database.ErrCantFindProduct {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "the stock cannot be updated"})
+			return
+		}
+		c.IndentedJSON(200, "the stock was updated")
+	}
+}
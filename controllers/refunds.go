@@ -0,0 +1,319 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mauroarnedo/ecommerce/database"
+	"github.com/mauroarnedo/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	errRefundFailed        = errors.New("the payment provider could not refund the payment")
+	errProviderUnavailable = errors.New("no payment provider is configured")
+)
+
+// cancellableStatuses are the states an order can be cancelled from by its
+// customer: anything before it ships.
+var cancellableStatuses = []string{models.OrderPending, models.OrderPaid, models.OrderFulfilled}
+
+// CancelOrder cancels one of the caller's orders before it ships. The stock
+// goes back on the shelf, an uncaptured digital payment is voided and a paid
+// order is refunded in full.
+func (app *Application) CancelOrder() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		orderID, err := primitive.ObjectIDFromHex(c.Query("id"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "order id is not valid"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		order, err := app.orders.FindByID(ctx, orderID)
+		if err == nil && c.GetString("role") != models.RoleAdmin && order.User_ID != c.GetString("uid") {
+			err = database.ErrOrderNotFound
+		}
+		if err != nil {
+			refundError(c, err)
+			return
+		}
+		cancellable := false
+		for _, status := range cancellableStatuses {
+			cancellable = cancellable || order.Status == status
+		}
+		if !cancellable {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "orders can only be cancelled before they ship", "status": order.Status})
+			return
+		}
+
+		note := "cancelled by the customer"
+		if reason := c.Query("reason"); reason != "" {
+			note += ": " + reason
+		}
+		actor := c.GetString("uid")
+		order, err = app.cancelOrder(ctx, order, actor, note)
+		if err != nil {
+			refundError(c, err)
+			return
+		}
+		settled, err := app.settleCancelledPayment(ctx, order, actor)
+		if err != nil {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"error": "the order was cancelled but its payment could not be returned yet", "order": order})
+			return
+		}
+		c.IndentedJSON(http.StatusOK, gin.H{"message": "the order was cancelled", "order": settled})
+	}
+}
+
+// RefundOrder refunds some or all units of a paid order. Each line names an
+// order line, by line id or product id, and how many of its units to
+// refund; no lines refund everything not refunded yet. The money goes back
+// to the payment unless method is store_credit.
+func (app *Application) RefundOrder() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Order_ID string                  `json:"order_id" binding:"required"`
+			Lines    []database.LineQuantity `json:"lines"`
+			Reason   string                  `json:"reason"`
+			Method   string                  `json:"method"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "order_id is required, lines must be line or product ids and quantities"})
+			return
+		}
+		orderID, err := primitive.ObjectIDFromHex(body.Order_ID)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "order id is not valid"})
+			return
+		}
+		if body.Method == "" {
+			body.Method = models.RefundToPayment
+		}
+		if body.Method != models.RefundToPayment && body.Method != models.RefundToStoreCredit {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "method must be payment or store_credit"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		order, err := app.orders.FindByID(ctx, orderID)
+		if err != nil {
+			refundError(c, err)
+			return
+		}
+		order, refund, err := app.refundOrder(ctx, order, body.Lines, c.GetString("uid"), body.Reason, body.Method)
+		if err != nil {
+			refundError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusOK, gin.H{"refund": refund, "order": order})
+	}
+}
+
+func refundError(c *gin.Context, err error) {
+	switch {
+	case err == database.ErrOrderNotFound:
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case err == database.ErrNotInOrder, err == database.ErrInvalidRefund, err == database.ErrRefundTooLarge:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case err == database.ErrNothingToRefund, err == database.ErrOrderNotRefunded, err == database.ErrOrderChanged,
+		err == database.ErrPaymentChanged, errors.Is(err, models.ErrIllegalTransition), errors.Is(err, models.ErrCurrencyMismatch):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, errRefundFailed):
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+	default:
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// cancelOrder cancels the order, puts its stock back on the shelf and gives
+// back the use of its coupon.
+func (app *Application) cancelOrder(ctx context.Context, order *models.Order, actor string, note string) (*models.Order, error) {
+	cancelled, err := app.orders.Transition(ctx, order.Order_ID, models.OrderCancelled, actor, note)
+	if err != nil {
+		return nil, err
+	}
+	if err = app.inventory.Return(ctx, database.StockLines(order.Order_Cart)); err != nil {
+		log.Println(err)
+	}
+	if order.Coupon != nil {
+		app.releaseCoupon(ctx, order.Coupon.Coupon_ID, order.User_ID)
+	}
+	return cancelled, nil
+}
+
+// settleCancelledPayment gives back what the customer paid for a cancelled
+// order: an authorized digital payment is voided, a captured one or a paid
+// cash order is refunded. A payment whose capture is unknown is left to the
+// webhook, which refunds a capture of a cancelled order.
+func (app *Application) settleCancelledPayment(ctx context.Context, order *models.Order, actor string) (*models.Order, error) {
+	if !order.Payment_Method.Digital {
+		if !order.WasPaid() {
+			return order, nil
+		}
+		refunded, _, err := app.refundOrder(ctx, order, nil, actor, "order cancelled", models.RefundToPayment)
+		return refunded, err
+	}
+	if app.provider == nil {
+		return order, errProviderUnavailable
+	}
+	intent, err := app.payments.FindByOrder(ctx, order.Order_ID)
+	if err == database.ErrPaymentNotFound {
+		return order, nil
+	}
+	if err != nil {
+		return order, err
+	}
+	switch intent.Status {
+	case database.PaymentAuthorized:
+		if err = app.provider.Void(ctx, intent.Provider_Ref); err != nil {
+			return order, err
+		}
+		intent.Failure = "order cancelled"
+		app.movePayment(ctx, intent, database.PaymentVoided)
+	case database.PaymentCaptured:
+		refunded, _, err := app.refundOrder(ctx, order, nil, actor, "order cancelled", models.RefundToPayment)
+		if err == database.ErrNothingToRefund {
+			return order, nil
+		}
+		return refunded, err
+	}
+	return order, nil
+}
+
+// refundOrder refunds the requested units of the order, see
+// database.RefundLines. The refund is recorded as pending on the order
+// before any money moves, then marked succeeded or failed. Store credit is
+// added to the customer's balance. Otherwise a digital payment is refunded
+// at the provider and a cash on delivery refund is only recorded. An order
+// with every unit refunded moves to refunded when its status allows it.
+func (app *Application) refundOrder(ctx context.Context, order *models.Order, requested []database.LineQuantity, actor string, reason string, method string) (*models.Order, *models.Refund, error) {
+	lines, amount, err := database.RefundLines(order, requested)
+	if err != nil {
+		return order, nil, err
+	}
+
+	var intent *database.PaymentIntent
+	if method == models.RefundToStoreCredit {
+		if !order.WasPaid() {
+			return order, nil, database.ErrOrderNotRefunded
+		}
+	} else if order.Payment_Method.Digital {
+		if app.provider == nil {
+			return order, nil, errProviderUnavailable
+		}
+		if intent, err = app.payments.FindByOrder(ctx, order.Order_ID); err == database.ErrPaymentNotFound {
+			return order, nil, database.ErrOrderNotRefunded
+		}
+		if err != nil {
+			return order, nil, err
+		}
+		if intent.Status != database.PaymentCaptured {
+			return order, nil, database.ErrOrderNotRefunded
+		}
+	} else if !order.WasPaid() {
+		return order, nil, database.ErrOrderNotRefunded
+	}
+
+	refund := models.Refund{
+		ID:         primitive.NewObjectID(),
+		Lines:      lines,
+		Amount:     amount,
+		Reason:     reason,
+		Actor:      actor,
+		Status:     models.RefundPending,
+		Method:     method,
+		Created_At: time.Now(),
+	}
+	if order, err = app.orders.AddRefund(ctx, order.Order_ID, refund, order.Updated_At); err != nil {
+		return nil, nil, err
+	}
+
+	if method == models.RefundToStoreCredit {
+		if err = app.users.AddStoreCredit(ctx, order.User_ID, amount); err != nil {
+			order, failed := app.failRefund(ctx, order, refund, err)
+			return order, failed, err
+		}
+	} else if intent != nil {
+		refund.Provider_Ref, err = app.provider.Refund(ctx, intent.Provider_Ref, amount)
+		if err != nil {
+			order, failed := app.failRefund(ctx, order, refund, err)
+			return order, failed, fmt.Errorf("%w: %v", errRefundFailed, err)
+		}
+		if err = app.recordIntentRefund(ctx, intent, amount, refund.Provider_Ref); err != nil {
+			log.Println(err)
+		}
+	}
+
+	refund.Status = models.RefundSucceeded
+	updated, err := app.orders.UpdateRefund(ctx, order.Order_ID, refund)
+	if err != nil {
+		// The money already moved, so the refund is reported as done.
+		log.Println(err)
+		return order, &refund, nil
+	}
+	order = updated
+	if database.FullyRefunded(order) && models.CanTransition(order.Status, models.OrderRefunded) {
+		if updated, err = app.orders.Transition(ctx, order.Order_ID, models.OrderRefunded, actor, reason); err != nil {
+			log.Println(err)
+		} else {
+			order = updated
+		}
+	}
+	return order, &refund, nil
+}
+
+// failRefund marks the pending refund failed, so its units can be refunded
+// again.
+func (app *Application) failRefund(ctx context.Context, order *models.Order, refund models.Refund, err error) (*models.Order, *models.Refund) {
+	refund.Status = models.RefundFailed
+	refund.Failure = err.Error()
+	if updated, updateErr := app.orders.UpdateRefund(ctx, order.Order_ID, refund); updateErr != nil {
+		log.Println(updateErr)
+	} else {
+		order = updated
+	}
+	return order, &refund
+}
+
+// recordIntentRefund adds a refund made at the provider to the intent,
+// which becomes refunded once nothing captured is left.
+func (app *Application) recordIntentRefund(ctx context.Context, intent *database.PaymentIntent, amount models.Money, refundID string) error {
+	refunded, err := intent.Refunded.Add(amount)
+	if err != nil {
+		return err
+	}
+	if refunded.Amount > intent.Captured.Amount {
+		refunded = intent.Captured
+	}
+	intent.Refunded = refunded
+	if refundID != "" {
+		intent.Refund_IDs = append(intent.Refund_IDs, refundID)
+	}
+	if refunded.Amount == intent.Captured.Amount {
+		intent.Status = database.PaymentRefunded
+	}
+	return app.payments.Save(ctx, intent, database.PaymentCaptured)
+}
+
+// hasRefund reports whether the provider refund is already recorded.
+func hasRefund(refundIDs []string, refundID string) bool {
+	for _, id := range refundIDs {
+		if id == refundID {
+			return true
+		}
+	}
+	return false
+}
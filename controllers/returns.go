@@ -0,0 +1,384 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mauroarnedo/ecommerce/database"
+	"github.com/mauroarnedo/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var errNothingReceived = errors.New("no units of the return were received")
+
+// RequestReturn asks to return units of one of the caller's delivered
+// orders within the return window. Each line names an order line, by line
+// id or product id, and how many of its units go back.
+func (app *Application) RequestReturn() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Order_ID string                  `json:"order_id" binding:"required"`
+			Lines    []database.LineQuantity `json:"lines" binding:"required"`
+			Reason   string                  `json:"reason" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "order_id, lines and reason are required"})
+			return
+		}
+		orderID, err := primitive.ObjectIDFromHex(body.Order_ID)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "order id is not valid"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		order, err := app.orders.FindByID(ctx, orderID)
+		if err == nil && c.GetString("role") != models.RoleAdmin && order.User_ID != c.GetString("uid") {
+			err = database.ErrOrderNotFound
+		}
+		if err != nil {
+			returnError(c, err)
+			return
+		}
+		deliveredAt := order.DeliveredAt()
+		if order.Status != models.OrderDelivered || deliveredAt.IsZero() {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "only delivered orders can be returned", "status": order.Status})
+			return
+		}
+		if time.Since(deliveredAt) > app.cfg.Returns.Window {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "the return window of the order has closed"})
+			return
+		}
+
+		returns, err := app.returns.List(ctx, database.ReturnFilter{OrderID: order.Order_ID})
+		if err != nil {
+			returnError(c, err)
+			return
+		}
+		lines, err := database.ReturnLines(order, returns, body.Lines)
+		if err != nil {
+			returnError(c, err)
+			return
+		}
+		now := time.Now()
+		request := models.ReturnRequest{
+			ID:         primitive.NewObjectID(),
+			Order_ID:   order.Order_ID,
+			User_ID:    order.User_ID,
+			Lines:      lines,
+			Reason:     body.Reason,
+			Status:     models.ReturnRequested,
+			History:    []models.StatusChange{{To: models.ReturnRequested, Actor: c.GetString("uid"), Note: body.Reason, At: now}},
+			Created_At: now,
+			Updated_At: now,
+		}
+		if err = app.returns.Create(ctx, &request); err != nil {
+			returnError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusCreated, request)
+	}
+}
+
+// ListReturns lists the caller's returns, newest first.
+func (app *Application) ListReturns() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		app.listReturns(c, database.ReturnFilter{UserID: c.GetString("uid"), Status: c.Query("status")})
+	}
+}
+
+// SearchReturns lists every return, optionally of one user or order or in
+// one status.
+func (app *Application) SearchReturns() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter := database.ReturnFilter{UserID: c.Query("user_id"), Status: c.Query("status")}
+		if orderQueryID := c.Query("order_id"); orderQueryID != "" {
+			orderID, err := primitive.ObjectIDFromHex(orderQueryID)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "order id is not valid"})
+				return
+			}
+			filter.OrderID = orderID
+		}
+		app.listReturns(c, filter)
+	}
+}
+
+func (app *Application) listReturns(c *gin.Context, filter database.ReturnFilter) {
+	if _, ok := models.ReturnTransitions[filter.Status]; filter.Status != "" && !ok {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unknown return status"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+	defer cancel()
+
+	returns, err := app.returns.List(ctx, filter)
+	if err != nil {
+		returnError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"returns": returns})
+}
+
+// ApproveReturn accepts a requested return; the customer may send the goods.
+func (app *Application) ApproveReturn() gin.HandlerFunc {
+	return app.reviewReturn(models.ReturnApproved)
+}
+
+// RejectReturn refuses a return that was not received yet. Its units may be
+// asked for again.
+func (app *Application) RejectReturn() gin.HandlerFunc {
+	return app.reviewReturn(models.ReturnRejected)
+}
+
+func (app *Application) reviewReturn(status string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Return_ID string `json:"return_id" binding:"required"`
+			Note      string `json:"note"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "return_id is required"})
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		request, ok := app.findReturn(ctx, c, body.Return_ID)
+		if !ok {
+			return
+		}
+		if err := app.moveReturn(ctx, request, status, c.GetString("uid"), body.Note); err != nil {
+			returnError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusOK, request)
+	}
+}
+
+// ReceiveReturn records the goods of an approved return that arrived back.
+// Each line gives the units received of an order line of the return and
+// whether they go back on the shelf; no lines means everything arrived and
+// restock applies to all of it. Units that cannot be put back are listed in
+// a 500 answer, the return stays received.
+func (app *Application) ReceiveReturn() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Return_ID string `json:"return_id" binding:"required"`
+			Lines     []struct {
+				Line_ID  primitive.ObjectID `json:"line_id"`
+				Received int                `json:"received"`
+				Restock  bool               `json:"restock"`
+			} `json:"lines"`
+			Restock bool   `json:"restock"`
+			Note    string `json:"note"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "return_id is required, lines must be line ids and received quantities"})
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		request, ok := app.findReturn(ctx, c, body.Return_ID)
+		if !ok {
+			return
+		}
+		lines := append([]models.ReturnLine(nil), request.Lines...)
+		if len(body.Lines) == 0 {
+			for i := range lines {
+				lines[i].Received = lines[i].Quantity
+				lines[i].Restocked = body.Restock
+			}
+		}
+		for _, received := range body.Lines {
+			i := returnLineIndex(lines, received.Line_ID)
+			if i < 0 {
+				returnError(c, database.ErrNotInOrder)
+				return
+			}
+			if received.Received < 0 || received.Received > lines[i].Quantity {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "received must be between zero and the units of the line", "line_id": received.Line_ID})
+				return
+			}
+			lines[i].Received = received.Received
+			lines[i].Restocked = received.Restock
+		}
+
+		request.Lines = lines
+		if err := app.moveReturn(ctx, request, models.ReturnReceived, c.GetString("uid"), body.Note); err != nil {
+			returnError(c, err)
+			return
+		}
+		var restock []database.StockLine
+		for _, line := range request.Lines {
+			if line.Restocked && line.Received > 0 {
+				restock = append(restock, database.StockLine{Product_ID: line.Product_ID, Quantity: line.Received})
+			}
+		}
+		if failed := app.restockReturn(ctx, restock); len(failed) > 0 {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "the return was received but some units could not be restocked", "return": request, "not_restocked": failed})
+			return
+		}
+		c.IndentedJSON(http.StatusOK, request)
+	}
+}
+
+// ResolveReturn gives back the price of the received units of a return,
+// as a refund to the order's payment or as store credit. A return that
+// cannot be marked resolved after the refund is answered 500 with the
+// refund id.
+func (app *Application) ResolveReturn() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Return_ID string `json:"return_id" binding:"required"`
+			Method    string `json:"method" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "return_id and method are required"})
+			return
+		}
+		status := models.ReturnRefunded
+		switch body.Method {
+		case models.RefundToPayment:
+		case models.RefundToStoreCredit:
+			status = models.ReturnCredited
+		default:
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "method must be payment or store_credit"})
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		request, ok := app.findReturn(ctx, c, body.Return_ID)
+		if !ok {
+			return
+		}
+		if !models.CanReturnTransition(request.Status, status) {
+			returnError(c, fmt.Errorf("%w from %s to %s", models.ErrIllegalReturnTransition, request.Status, status))
+			return
+		}
+		var requested []database.LineQuantity
+		for _, line := range request.Lines {
+			if line.Received > 0 {
+				requested = append(requested, database.LineQuantity{Line_ID: line.Line_ID, Quantity: line.Received})
+			}
+		}
+		if len(requested) == 0 {
+			returnError(c, errNothingReceived)
+			return
+		}
+
+		order, err := app.orders.FindByID(ctx, request.Order_ID)
+		if err != nil {
+			returnError(c, err)
+			return
+		}
+		actor := c.GetString("uid")
+		order, refund, err := app.refundOrder(ctx, order, requested, actor, "return "+request.ID.Hex(), body.Method)
+		if err != nil {
+			returnError(c, err)
+			return
+		}
+		request.Refund_ID = refund.ID
+		from := request.Status
+		if err = app.moveReturn(ctx, request, status, actor, ""); err != nil {
+			log.Println(err)
+			err = app.retryDetached(func(ctx context.Context) error {
+				return app.returns.Save(ctx, request, from)
+			})
+		}
+		if err != nil {
+			// The money already moved: name the refund so it is not given
+			// again while the return is fixed by hand.
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "the refund was made but the return could not be marked resolved", "refund_id": refund.ID, "return": request, "order": order})
+			return
+		}
+		c.IndentedJSON(http.StatusOK, gin.H{"return": request, "refund": refund, "order": order})
+	}
+}
+
+func returnError(c *gin.Context, err error) {
+	switch {
+	case err == database.ErrReturnNotFound:
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case err == database.ErrInvalidReturn, err == database.ErrReturnTooLarge:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case err == database.ErrReturnChanged, err == errNothingReceived, errors.Is(err, models.ErrIllegalReturnTransition):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		refundError(c, err)
+	}
+}
+
+func (app *Application) findReturn(ctx context.Context, c *gin.Context, id string) (*models.ReturnRequest, bool) {
+	returnID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "return id is not valid"})
+		return nil, false
+	}
+	request, err := app.returns.FindByID(ctx, returnID)
+	if err != nil {
+		returnError(c, err)
+		return nil, false
+	}
+	return request, true
+}
+
+// restockReturn puts received units back on the shelf one line at a time,
+// so a failed line can be retried without counting the others twice, and
+// reports the lines that could still not be restocked.
+func (app *Application) restockReturn(ctx context.Context, lines []database.StockLine) []database.StockLine {
+	var failed []database.StockLine
+	for _, line := range lines {
+		err := app.inventory.Return(ctx, []database.StockLine{line})
+		if err != nil {
+			log.Println(err)
+			err = app.retryDetached(func(ctx context.Context) error {
+				return app.inventory.Return(ctx, []database.StockLine{line})
+			})
+		}
+		if err != nil {
+			log.Println(err)
+			failed = append(failed, line)
+		}
+	}
+	return failed
+}
+
+// retryDetached runs fn once more on a context of its own, for a write
+// that has to follow an action already done when the request ran out of
+// time.
+func (app *Application) retryDetached(fn func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+	defer cancel()
+	return fn(ctx)
+}
+
+// moveReturn saves the return in its new status with a history entry.
+func (app *Application) moveReturn(ctx context.Context, request *models.ReturnRequest, status string, actor string, note string) error {
+	from := request.Status
+	if !models.CanReturnTransition(from, status) {
+		return fmt.Errorf("%w from %s to %s", models.ErrIllegalReturnTransition, from, status)
+	}
+	request.History = append(request.History, models.StatusChange{From: from, To: status, Actor: actor, Note: note, At: time.Now()})
+	request.Status = status
+	return app.returns.Save(ctx, request, from)
+}
+
+func returnLineIndex(lines []models.ReturnLine, lineID primitive.ObjectID) int {
+	for i, line := range lines {
+		if line.Line_ID == lineID {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,229 @@
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mauroarnedo/ecommerce/models"
+	"github.com/mauroarnedo/ecommerce/totp"
+)
+
+const recoveryCodeCount = 10
+
+func (app *Application) EnrollTOTP() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		user, err := app.users.FindByID(ctx, c.GetString("uid"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			return
+		}
+		if user.TOTP_Enabled {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "two-factor authentication is already enabled"})
+			return
+		}
+
+		secret, err := totp.GenerateSecret()
+		if err != nil {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "enrollment failed"})
+			return
+		}
+		if err = app.users.SetPendingTOTP(ctx, user.User_ID, secret); err != nil {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "enrollment failed"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"secret": secret, "otpauth_uri": totp.URI(app.cfg.Auth.TOTPIssuer, *user.Email, secret)})
+	}
+}
+
+// ConfirmTOTP enables two-factor authentication once the user proves the
+// authenticator produces codes for the pending secret. The recovery codes
+// are only ever returned here.
+func (app *Application) ConfirmTOTP() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		var body struct {
+			Code string `json:"code" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "code is required"})
+			return
+		}
+
+		user, err := app.users.FindByID(ctx, c.GetString("uid"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			return
+		}
+		if user.TOTP_Pending == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "start the enrollment first"})
+			return
+		}
+		step, ok := totp.Validate(user.TOTP_Pending, body.Code, time.Now(), 1)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "the code is not valid"})
+			return
+		}
+
+		codes, hashes, err := newRecoveryCodes()
+		if err != nil {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "enrollment failed"})
+			return
+		}
+		enabled, err := app.users.EnableTOTP(ctx, user.User_ID, user.TOTP_Pending, step, hashes)
+		if err != nil || !enabled {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "enrollment changed, start again"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+	}
+}
+
+// DisableTOTP turns two-factor authentication off after one more valid
+// code. Its guesses count against the same throttle as logins, so a stolen
+// session cannot brute-force the code.
+func (app *Application) DisableTOTP() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		var body struct {
+			Code          string `json:"code"`
+			Recovery_Code string `json:"recovery_code"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		user, err := app.users.FindByID(ctx, c.GetString("uid"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			return
+		}
+		if !user.TOTP_Enabled {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "two-factor authentication is not enabled"})
+			return
+		}
+		if !app.loginAllowed(ctx, c, *user.Email) {
+			return
+		}
+		if !app.checkSecondFactor(ctx, user, body.Code, body.Recovery_Code) {
+			app.loginGuard.Fail(ctx, *user.Email, c.ClientIP())
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "the code is not valid"})
+			return
+		}
+		app.loginGuard.Succeed(ctx, *user.Email, c.ClientIP())
+
+		if err = app.users.DisableTOTP(ctx, user.User_ID); err != nil {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "two-factor authentication cannot be disabled"})
+			return
+		}
+		c.JSON(http.StatusOK, "Two-factor authentication was disabled")
+	}
+}
+
+// LoginTOTP is the second login step: it exchanges the challenge token from
+// Login and a TOTP or recovery code for the session tokens.
+func (app *Application) LoginTOTP() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		var body struct {
+			Challenge_Token string `json:"challenge_token" binding:"required"`
+			Code            string `json:"code"`
+			Recovery_Code   string `json:"recovery_code"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "challenge_token is required"})
+			return
+		}
+
+		claims, msg := app.tokens.ValidateChallengeToken(body.Challenge_Token)
+		if msg != "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": msg})
+			return
+		}
+		revoked, err := app.tokens.IsRevoked(ctx, claims.ID, "", claims.Uid, claims.Generation)
+		if err != nil || revoked {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "the challenge token is no longer valid"})
+			return
+		}
+
+		user, err := app.users.FindByID(ctx, claims.Uid)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "the challenge token is no longer valid"})
+			return
+		}
+		if !app.loginAllowed(ctx, c, *user.Email) {
+			return
+		}
+		if !user.TOTP_Enabled || !app.checkSecondFactor(ctx, user, body.Code, body.Recovery_Code) {
+			app.loginGuard.Fail(ctx, *user.Email, c.ClientIP())
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "the code is not valid"})
+			return
+		}
+		if err = app.tokens.Revocations.Revoke(ctx, claims.ID, claims.ExpiresAt.Time); err != nil {
+			log.Println(err)
+		}
+		app.issueTokens(c, user)
+	}
+}
+
+// checkSecondFactor accepts either a TOTP code newer than the last one used
+// or an unused recovery code, consuming whichever matched.
+func (app *Application) checkSecondFactor(ctx context.Context, user *models.User, code string, recoveryCode string) bool {
+	if code != "" {
+		step, ok := totp.Validate(user.TOTP_Secret, code, time.Now(), 1)
+		if !ok || step <= user.TOTP_Last_Step {
+			return false
+		}
+		advanced, err := app.users.AdvanceTOTPStep(ctx, user.User_ID, step)
+		return err == nil && advanced
+	}
+	if recoveryCode != "" {
+		consumed, err := app.users.ConsumeRecoveryCode(ctx, user.User_ID, hashRecoveryCode(recoveryCode))
+		return err == nil && consumed
+	}
+	return false
+}
+
+func newRecoveryCodes() (codes []string, hashes []string, err error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err = rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(encoding.EncodeToString(b))
+		code = code[:4] + "-" + code[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
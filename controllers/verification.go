@@ -0,0 +1,183 @@
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mauroarnedo/ecommerce/config"
+	"github.com/mauroarnedo/ecommerce/database"
+	"github.com/mauroarnedo/ecommerce/models"
+	"github.com/mauroarnedo/ecommerce/notify"
+)
+
+const verificationCodeTTL = 15 * time.Minute
+
+var verificationResend = database.ResendPolicy{
+	MinInterval:  time.Minute,
+	Window:       time.Hour,
+	MaxPerWindow: 5,
+}
+
+func (app *Application) VerifyEmailAddress() gin.HandlerFunc {
+	return app.verifyChannel(notify.ChannelEmail)
+}
+
+func (app *Application) VerifyPhoneNumber() gin.HandlerFunc {
+	return app.verifyChannel(notify.ChannelSMS)
+}
+
+func (app *Application) verifyChannel(channel string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		var body struct {
+			Email string `json:"email" form:"email"`
+			Phone string `json:"phone" form:"phone"`
+			Code  string `json:"code" form:"code" binding:"required"`
+		}
+		if err := c.ShouldBind(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "code is required"})
+			return
+		}
+		target, markVerified := body.Email, app.users.SetEmailVerified
+		if channel == notify.ChannelSMS {
+			target, markVerified = body.Phone, app.users.SetPhoneVerified
+		}
+		if target == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "email or phone is required"})
+			return
+		}
+
+		userID, err := app.verifications.Check(ctx, channel, target, func(userID string) string {
+			return hashVerificationCode(userID, body.Code)
+		})
+		if err == database.ErrVerificationInvalid || err == database.ErrVerificationLocked {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "the code cannot be verified"})
+			return
+		}
+
+		if err = markVerified(ctx, userID); err != nil {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "the code cannot be verified"})
+			return
+		}
+		c.JSON(http.StatusOK, "Successfully verified")
+	}
+}
+
+func (app *Application) ResendVerification() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		channel := c.Query("channel")
+		if channel != notify.ChannelEmail && channel != notify.ChannelSMS {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "channel must be email or sms"})
+			return
+		}
+		userID, ok := actingUserObjectID(c)
+		if !ok {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		user, err := app.users.FindByID(ctx, userID.Hex())
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			return
+		}
+		if (channel == notify.ChannelEmail && user.Email_Verified) || (channel == notify.ChannelSMS && user.Phone_Verified) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "already verified"})
+			return
+		}
+
+		err = app.sendVerification(ctx, user, channel)
+		if err == database.ErrResendTooSoon {
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "the code cannot be sent"})
+			return
+		}
+		c.JSON(http.StatusOK, "A new code was sent")
+	}
+}
+
+func (app *Application) sendVerification(ctx context.Context, user *models.User, channel string) error {
+	code, err := newVerificationCode()
+	if err != nil {
+		return err
+	}
+	target := *user.Email
+	if channel == notify.ChannelSMS {
+		target = *user.Phone
+	}
+
+	err = app.verifications.Save(ctx, user.User_ID, channel, target, hashVerificationCode(user.User_ID, code), time.Now().Add(verificationCodeTTL), verificationResend)
+	if err != nil {
+		return err
+	}
+
+	msg := notify.Message{Channel: channel, To: target}
+	if channel == notify.ChannelEmail {
+		link := app.cfg.Notify.VerifyEmailURL
+		query := url.Values{"email": {target}, "code": {code}}
+		msg.Subject = "Verify your email"
+		msg.Body = fmt.Sprintf("Your verification code is %s, or open %s?%s", code, link, query.Encode())
+	} else {
+		msg.Body = fmt.Sprintf("Your verification code is %s", code)
+	}
+	return app.notifier.Send(ctx, msg)
+}
+
+// checkoutAllowed enforces the checkout verification policy for the user
+// placing an order and writes the rejection when the account is not
+// verified enough.
+func (app *Application) checkoutAllowed(ctx context.Context, c *gin.Context, userID string) bool {
+	policy := app.cfg.Auth.CheckoutRequiresVerified
+	if policy == config.VerifyNone {
+		return true
+	}
+	user, err := app.users.FindByID(ctx, userID)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "user cannot be checked"})
+		return false
+	}
+	needEmail := policy == config.VerifyEmail || policy == config.VerifyBoth
+	needPhone := policy == config.VerifyPhone || policy == config.VerifyBoth
+	if (needEmail && !user.Email_Verified) || (needPhone && !user.Phone_Verified) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "verify your account before placing orders", "policy": policy})
+		return false
+	}
+	return true
+}
+
+func newVerificationCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+func hashVerificationCode(userID string, code string) string {
+	sum := sha256.Sum256([]byte(userID + ":" + code))
+	return hex.EncodeToString(sum[:])
+}
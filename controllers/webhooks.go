@@ -0,0 +1,298 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mauroarnedo/ecommerce/database"
+	"github.com/mauroarnedo/ecommerce/models"
+	"github.com/mauroarnedo/ecommerce/payment"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const maxWebhookBody = 1 << 20
+
+// PaymentWebhook receives the provider's payment events. The signature is
+// checked before anything is stored, then every delivery of an event id is
+// recorded once: a processed event is acknowledged without applying it
+// again, a failed one is retried. A 5xx answer asks the provider to retry.
+func (app *Application) PaymentWebhook() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if app.provider == nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "no payment provider is configured"})
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxWebhookBody))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		header := c.GetHeader(payment.SignatureHeader)
+		err = payment.VerifySignature(app.cfg.Payments.WebhookSecret, header, body, time.Now(), app.cfg.Payments.WebhookTolerance)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		var event payment.Event
+		if err = json.Unmarshal(body, &event); err != nil || event.ID == "" || event.Type == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "the event must have an id and a type"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		record := database.PaymentEvent{
+			ID:           event.ID,
+			Type:         event.Type,
+			Provider_Ref: event.Provider_Ref,
+			Payload:      string(body),
+			Signature:    header,
+		}
+		stored, claimed, err := app.paymentEvents.Claim(ctx, record, app.cfg.Payments.EventLease, database.EventFailed)
+		if err != nil {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !claimed {
+			if stored.Status == database.EventProcessing {
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "the event is being processed"})
+				return
+			}
+			c.IndentedJSON(200, gin.H{"event_id": stored.ID, "status": stored.Status, "duplicate": true})
+			return
+		}
+		app.processPaymentEvent(ctx, c, event)
+	}
+}
+
+// ReplayPaymentEvent applies a recorded event again from its stored
+// payload, for example after a bug in applying it was fixed. Applying an
+// event is idempotent, so replaying a processed one changes nothing.
+func (app *Application) ReplayPaymentEvent() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		eventID := c.Query("id")
+		if eventID == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "event id is empty"})
+			return
+		}
+		if app.provider == nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "no payment provider is configured"})
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+		defer cancel()
+
+		var claimed bool
+		stored, err := app.paymentEvents.Find(ctx, eventID)
+		if err == database.ErrPaymentEventNotFound {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err == nil {
+			stored, claimed, err = app.paymentEvents.Claim(ctx, *stored, app.cfg.Payments.EventLease, database.EventProcessed, database.EventFailed)
+		}
+		if err != nil {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !claimed {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "the event is being processed"})
+			return
+		}
+		var event payment.Event
+		if err = json.Unmarshal([]byte(stored.Payload), &event); err != nil {
+			app.finishPaymentEvent(eventID, database.EventFailed, "", err.Error())
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+		app.processPaymentEvent(ctx, c, event)
+	}
+}
+
+func (app *Application) processPaymentEvent(ctx context.Context, c *gin.Context, event payment.Event) {
+	result, err := app.applyPaymentEvent(ctx, event)
+	if err != nil {
+		log.Println(err)
+		app.finishPaymentEvent(event.ID, database.EventFailed, "", err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"event_id": event.ID, "error": err.Error()})
+		return
+	}
+	app.finishPaymentEvent(event.ID, database.EventProcessed, result, "")
+	c.IndentedJSON(200, gin.H{"event_id": event.ID, "status": database.EventProcessed, "result": result})
+}
+
+// finishPaymentEvent records the outcome on a context of its own, so an
+// event is not left processing when the request ran out of time applying it.
+func (app *Application) finishPaymentEvent(eventID string, status string, result string, failure string) {
+	ctx, cancel := context.WithTimeout(context.Background(), app.cfg.Server.RequestTimeout)
+	defer cancel()
+	if err := app.paymentEvents.Finish(ctx, eventID, status, result, failure); err != nil {
+		log.Println(err)
+	}
+}
+
+// applyPaymentEvent moves the payment intent and its order to follow the
+// event and describes what it did. Events that are already reflected, or
+// that the store does not know, change nothing and are not errors.
+func (app *Application) applyPaymentEvent(ctx context.Context, event payment.Event) (string, error) {
+	intent, err := app.payments.FindByProviderRef(ctx, app.provider.Name(), event.Provider_Ref)
+	if err == database.ErrPaymentNotFound {
+		return "ignored: unknown payment", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	order, err := app.orders.FindByID(ctx, intent.Order_ID)
+	if err != nil {
+		return "", err
+	}
+
+	switch event.Type {
+	case payment.EventCaptured:
+		return app.paymentCaptured(ctx, intent, order, event)
+	case payment.EventFailed, payment.EventVoided:
+		return app.paymentFailed(ctx, intent, order, event)
+	case payment.EventRefunded:
+		return app.paymentRefunded(ctx, intent, order, event)
+	}
+	return "ignored: unknown event type", nil
+}
+
+// paymentCaptured marks the order paid. A capture of a payment the store
+// already gave up on, voided or failed, is recorded as captured too, and
+// when its order was cancelled meanwhile the money is refunded at once.
+func (app *Application) paymentCaptured(ctx context.Context, intent *database.PaymentIntent, order *models.Order, event payment.Event) (string, error) {
+	switch intent.Status {
+	case database.PaymentRequiresAuthorization, database.PaymentAuthorized, database.PaymentCaptureUnknown, database.PaymentVoided, database.PaymentFailed:
+		from := intent.Status
+		intent.Status = database.PaymentCaptured
+		intent.Captured = eventAmount(event, intent.Amount)
+		if from == database.PaymentVoided || from == database.PaymentFailed {
+			log.Printf("payment %s of order %s was captured after it was %s", intent.Provider_Ref, order.Order_ID.Hex(), from)
+			intent.Failure = "captured after it was " + from
+		}
+		if err := app.payments.Save(ctx, intent, from); err != nil {
+			return "", err
+		}
+	case database.PaymentCaptured, database.PaymentRefunded:
+	default:
+		return "ignored: payment is " + intent.Status, nil
+	}
+	if order.Status == models.OrderCancelled && intent.Status == database.PaymentCaptured {
+		return app.refundCancelledCapture(ctx, order, event)
+	}
+	if order.Status != models.OrderPending {
+		return "captured, order is " + order.Status, nil
+	}
+	if _, err := app.orders.Transition(ctx, order.Order_ID, models.OrderPaid, "webhook", event.ID); err != nil {
+		return "", err
+	}
+	return "order paid", nil
+}
+
+// refundCancelledCapture gives back a capture that arrived for a cancelled
+// order. A failed refund fails the event, so the next delivery tries again.
+func (app *Application) refundCancelledCapture(ctx context.Context, order *models.Order, event payment.Event) (string, error) {
+	_, refund, err := app.refundOrder(ctx, order, nil, "webhook", "captured after the order was cancelled, "+event.ID, models.RefundToPayment)
+	if err == database.ErrNothingToRefund {
+		return "captured, order is cancelled and refunded", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return "order is cancelled, capture refunded " + refund.Provider_Ref, nil
+}
+
+func (app *Application) paymentFailed(ctx context.Context, intent *database.PaymentIntent, order *models.Order, event payment.Event) (string, error) {
+	switch intent.Status {
+	case database.PaymentRequiresAuthorization, database.PaymentAuthorized, database.PaymentCaptureUnknown:
+	default:
+		return "ignored: payment is " + intent.Status, nil
+	}
+	from := intent.Status
+	intent.Status = database.PaymentFailed
+	if event.Type == payment.EventVoided {
+		intent.Status = database.PaymentVoided
+	}
+	intent.Failure = event.Type
+	if err := app.payments.Save(ctx, intent, from); err != nil {
+		return "", err
+	}
+	if order.Status != models.OrderPending {
+		return intent.Status + ", order is " + order.Status, nil
+	}
+	app.abandonOrder(ctx, order, event.Type+" "+event.ID, false)
+	return "order cancelled", nil
+}
+
+// paymentRefunded records a refund made at the provider. Refunds the store
+// started itself are already on the intent and are skipped by refund id.
+func (app *Application) paymentRefunded(ctx context.Context, intent *database.PaymentIntent, order *models.Order, event payment.Event) (string, error) {
+	if intent.Status != database.PaymentCaptured {
+		return "ignored: payment is " + intent.Status, nil
+	}
+	if event.Refund_ID != "" && hasRefund(intent.Refund_IDs, event.Refund_ID) {
+		return "ignored: refund already recorded", nil
+	}
+	remaining, err := intent.Captured.Sub(intent.Refunded)
+	if err != nil {
+		return "", err
+	}
+	amount := eventAmount(event, remaining)
+	if amount.Currency != remaining.Currency {
+		return "ignored: " + models.ErrCurrencyMismatch.Error(), nil
+	}
+
+	if event.Refund_ID == "" || !orderHasRefund(order, event.Refund_ID) {
+		refund := models.Refund{
+			ID:           primitive.NewObjectID(),
+			Amount:       amount,
+			Reason:       event.ID,
+			Actor:        "webhook",
+			Status:       models.RefundSucceeded,
+			Provider_Ref: event.Refund_ID,
+			Created_At:   time.Now(),
+		}
+		if order, err = app.orders.AddRefund(ctx, order.Order_ID, refund, order.Updated_At); err != nil {
+			return "", err
+		}
+	}
+	if err = app.recordIntentRefund(ctx, intent, amount, event.Refund_ID); err != nil {
+		return "", err
+	}
+	if intent.Status != database.PaymentRefunded {
+		return "partially refunded", nil
+	}
+	if !models.CanTransition(order.Status, models.OrderRefunded) {
+		return "refunded, order is " + order.Status, nil
+	}
+	if _, err = app.orders.Transition(ctx, order.Order_ID, models.OrderRefunded, "webhook", event.ID); err != nil {
+		return "", err
+	}
+	return "order refunded", nil
+}
+
+func orderHasRefund(order *models.Order, refundID string) bool {
+	for _, refund := range order.Refunds {
+		if refund.Provider_Ref == refundID {
+			return true
+		}
+	}
+	return false
+}
+
+// eventAmount is the amount of the event, or whole when it has none.
+func eventAmount(event payment.Event, whole models.Money) models.Money {
+	if event.Amount == nil {
+		return whole
+	}
+	return *event.Amount
+}
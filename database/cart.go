@@ -14,41 +14,312 @@ import (
 )
 
 var (
-	ErrCantFindProduct    = errors.New("can't find product")
-	ErrCantDecodeProducts = errors.New("can't find product")
-	ErrUserIDIsNotValid   = errors.New("user is not valid")
-	ErrCantUpdateUser     = errors.New("cannot add product to cart")
-	ErrCantRemoveItem     = errors.New("cannot remove item from cart")
-	ErrCantGetItem        = errors.New("cannot get item from cart ")
-	ErrCantBuyCartItem    = errors.New("cannot update the purchase")
+	ErrCantFindProduct      = errors.New("can't find product")
+	ErrCantDecodeProducts   = errors.New("can't find product")
+	ErrUserIDIsNotValid     = errors.New("user is not valid")
+	ErrCantUpdateUser       = errors.New("cannot add product to cart")
+	ErrCantRemoveItem       = errors.New("cannot remove item from cart")
+	ErrCantGetItem          = errors.New("cannot get item from cart ")
+	ErrCantBuyCartItem      = errors.New("cannot update the purchase")
+	ErrCartEmpty            = errors.New("the cart is empty")
+	ErrUserNotFound         = errors.New("user not found")
+	ErrNotInCart            = errors.New("the product is not in the cart")
+	ErrCartQuantityTooLarge = errors.New("the cart cannot hold more units of this product")
+	ErrCartChanged          = errors.New("products in the cart changed since they were added, review the cart before checking out")
 )
 
-func AddProductToCart(ctx context.Context, productCollection, userCollection *mongo.Collection, productID primitive.ObjectID, userID string) error {
-	seachProductFromDb, err := productCollection.Find(ctx, bson.M{"_id": productID})
+// Reasons of a CartChange.
+const (
+	CartPriceChanged    = "price_changed"
+	CartItemUnavailable = "unavailable"
+)
+
+// CartChange describes a cart line that no longer matches the catalog.
+type CartChange struct {
+	Product_ID   primitive.ObjectID `json:"product_id"`
+	Product_Name *string            `json:"product_name"`
+	Reason       string             `json:"reason"`
+	Old_Price    *models.Money      `json:"old_price,omitempty"`
+	New_Price    *models.Money      `json:"new_price,omitempty"`
+}
+
+func samePrice(a, b *models.Money) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// CompareCart checks every line against the current product, given by
+// lookup as nil when it was deleted. It returns the changes and the lines
+// refreshed from the catalog; unavailable lines are kept as they are.
+func CompareCart(items []models.ProductUser, lookup func(productID primitive.ObjectID) *models.Product) ([]CartChange, []models.ProductUser) {
+	changes := make([]CartChange, 0)
+	refreshed := make([]models.ProductUser, 0, len(items))
+	for _, item := range items {
+		product := lookup(item.Product_ID)
+		if product == nil {
+			changes = append(changes, CartChange{Product_ID: item.Product_ID, Product_Name: item.Product_Name, Reason: CartItemUnavailable})
+			refreshed = append(refreshed, item)
+			continue
+		}
+		if !samePrice(item.Price, product.Price) {
+			changes = append(changes, CartChange{
+				Product_ID:   item.Product_ID,
+				Product_Name: product.Product_Name,
+				Reason:       CartPriceChanged,
+				Old_Price:    item.Price,
+				New_Price:    product.Price,
+			})
+		}
+		refreshed = append(refreshed, CartLine(product, item.Quantity))
+	}
+	return changes, refreshed
+}
+
+// currentProducts loads the products of the cart lines that still exist.
+func currentProducts(ctx context.Context, productCollection *mongo.Collection, items []models.ProductUser) (map[primitive.ObjectID]*models.Product, error) {
+	ids := make([]primitive.ObjectID, 0, len(items))
+	for _, item := range items {
+		ids = append(ids, item.Product_ID)
+	}
+	cursor, err := productCollection.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	var products []models.Product
+	if err = cursor.All(ctx, &products); err != nil {
+		return nil, err
+	}
+	found := make(map[primitive.ObjectID]*models.Product, len(products))
+	for i := range products {
+		found[products[i].Product_ID] = &products[i]
+	}
+	return found, nil
+}
+
+// checkCartLines fails with ErrCartChanged when a line was deleted from the
+// catalog or its price changed since it was added.
+func checkCartLines(ctx context.Context, productCollection *mongo.Collection, items []models.ProductUser) error {
+	products, err := currentProducts(ctx, productCollection, items)
+	if err != nil {
+		return err
+	}
+	changes, _ := CompareCart(items, func(productID primitive.ObjectID) *models.Product { return products[productID] })
+	if len(changes) > 0 {
+		return ErrCartChanged
+	}
+	return nil
+}
+
+// RevalidateCart refreshes the snapshot of every cart line from the current
+// product and reports what changed. Lines of deleted products stay in the
+// cart, reported as unavailable, until the user removes them.
+func RevalidateCart(ctx context.Context, productCollection, userCollection *mongo.Collection, userID string) ([]CartChange, error) {
+	id, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
 		log.Println(err)
-		return ErrCantFindProduct
+		return nil, ErrUserIDIsNotValid
+	}
+	var user models.User
+	err = userCollection.FindOne(ctx, bson.M{"_id": id}, options.FindOne().SetProjection(bson.M{"user_cart": 1})).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
 	}
-	var productCart []models.ProductUser
-	err = seachProductFromDb.All(ctx, &productCart)
+	products, err := currentProducts(ctx, productCollection, user.User_Cart)
+	if err != nil {
+		return nil, err
+	}
+	changes, refreshed := CompareCart(user.User_Cart, func(productID primitive.ObjectID) *models.Product { return products[productID] })
+	for _, line := range refreshed {
+		if products[line.Product_ID] == nil {
+			continue
+		}
+		// The quantity is left out so concurrent quantity changes are kept.
+		update := bson.M{"$set": bson.M{
+			"user_cart.$.product_name": line.Product_Name,
+			"user_cart.$.price":        line.Price,
+			"user_cart.$.rating":       line.Rating,
+			"user_cart.$.description":  line.Description,
+			"user_cart.$.image":        line.Image,
+		}}
+		if _, err = userCollection.UpdateOne(ctx, bson.M{"_id": id, "user_cart._id": line.Product_ID}, update); err != nil {
+			return nil, err
+		}
+	}
+	return changes, nil
+}
+
+// MaxCartQuantity caps the quantity of a single cart line.
+const MaxCartQuantity = 99
+
+// CartTotal is the price of every line times its quantity. Lines without
+// a price count as free; lines in another currency fail the sum.
+func CartTotal(items []models.ProductUser) (models.Money, error) {
+	var total models.Money
+	for _, item := range items {
+		if item.Price == nil {
+			continue
+		}
+		var err error
+		if total, err = total.Add(item.Price.Mul(item.Quantity)); err != nil {
+			return models.Money{}, err
+		}
+	}
+	return total, nil
+}
+
+// AddProductToCart adds quantity units of the product to the cart. A
+// product that is already in the cart has its line incremented instead of
+// getting a second one.
+func AddProductToCart(ctx context.Context, productCollection, userCollection *mongo.Collection, productID primitive.ObjectID, userID string, quantity int) error {
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		log.Println(err)
+		return ErrUserIDIsNotValid
+	}
+	product, err := findProduct(ctx, productCollection, productID)
+	if err != nil {
+		return err
+	}
+	limit, limitErr := CartLimit(product)
+	line := CartLine(product, quantity)
+
+	// Two passes: increment an existing line, otherwise push a new one
+	// unless a concurrent request pushed it first, in which case the
+	// increment is tried again.
+	for attempt := 0; attempt < 2; attempt++ {
+		merged, err := incrementCartLine(ctx, userCollection, id, productID, quantity, limit, limitErr)
+		if err != nil {
+			return err
+		}
+		if merged {
+			return nil
+		}
+		if quantity > limit {
+			return limitErr
+		}
+		filter := bson.M{"_id": id, "user_cart._id": bson.M{"$ne": productID}}
+		result, err := userCollection.UpdateOne(ctx, filter, bson.M{"$push": bson.M{"user_cart": line}})
+		if err != nil {
+			log.Println(err)
+			return ErrCantUpdateUser
+		}
+		if result.MatchedCount == 1 {
+			return nil
+		}
+		count, err := userCollection.CountDocuments(ctx, bson.M{"_id": id})
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return ErrUserNotFound
+		}
+	}
+	return ErrCantUpdateUser
+}
+
+// incrementCartLine adds delta to an existing cart line as long as the line
+// stays within limit, otherwise it returns limitErr. It reports false when
+// the product is not in the cart.
+func incrementCartLine(ctx context.Context, userCollection *mongo.Collection, id primitive.ObjectID, productID primitive.ObjectID, delta int, limit int, limitErr error) (bool, error) {
+	filter := bson.M{"_id": id, "user_cart": bson.M{"$elemMatch": bson.M{"_id": productID, "quantity": bson.M{"$lte": limit - delta}}}}
+	result, err := userCollection.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"user_cart.$.quantity": delta}})
 	if err != nil {
 		log.Println(err)
-		return ErrCantDecodeProducts
+		return false, ErrCantUpdateUser
+	}
+	if result.MatchedCount == 1 {
+		return true, nil
 	}
+	count, err := userCollection.CountDocuments(ctx, bson.M{"_id": id, "user_cart._id": productID})
+	if err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return false, limitErr
+	}
+	return false, nil
+}
+
+// SetCartQuantity sets the quantity of a cart line. Zero removes the line.
+func SetCartQuantity(ctx context.Context, productCollection, userCollection *mongo.Collection, productID primitive.ObjectID, userID string, quantity int) error {
 	id, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
 		log.Println(err)
 		return ErrUserIDIsNotValid
 	}
+	if quantity == 0 {
+		return pullCartLine(ctx, userCollection, bson.M{"_id": id, "user_cart._id": productID}, productID)
+	}
+	product, err := findProduct(ctx, productCollection, productID)
+	if err != nil {
+		return err
+	}
+	if limit, limitErr := CartLimit(product); quantity > limit {
+		return limitErr
+	}
+	filter := bson.M{"_id": id, "user_cart._id": productID}
+	result, err := userCollection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"user_cart.$.quantity": quantity}})
+	if err != nil {
+		log.Println(err)
+		return ErrCantUpdateUser
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotInCart
+	}
+	return nil
+}
 
-	filter := bson.D{primitive.E{Key: "_id", Value: id}}
-	update := bson.D{{Key: "$push", Value: bson.D{primitive.E{Key: "user_cart", Value: bson.D{primitive.E{Key: "$each", Value: productCart}}}}}}
+// ChangeCartQuantity adds delta, which may be negative, to the quantity of
+// a cart line. A line that would drop to zero or below is removed.
+func ChangeCartQuantity(ctx context.Context, productCollection, userCollection *mongo.Collection, productID primitive.ObjectID, userID string, delta int) error {
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		log.Println(err)
+		return ErrUserIDIsNotValid
+	}
+	if delta > 0 {
+		product, err := findProduct(ctx, productCollection, productID)
+		if err != nil {
+			return err
+		}
+		limit, limitErr := CartLimit(product)
+		merged, err := incrementCartLine(ctx, userCollection, id, productID, delta, limit, limitErr)
+		if err != nil {
+			return err
+		}
+		if !merged {
+			return ErrNotInCart
+		}
+		return nil
+	}
 
-	_, err = userCollection.UpdateOne(ctx, filter, update)
+	filter := bson.M{"_id": id, "user_cart": bson.M{"$elemMatch": bson.M{"_id": productID, "quantity": bson.M{"$gt": -delta}}}}
+	result, err := userCollection.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"user_cart.$.quantity": delta}})
 	if err != nil {
 		log.Println(err)
 		return ErrCantUpdateUser
 	}
+	if result.MatchedCount == 1 {
+		return nil
+	}
+	filter = bson.M{"_id": id, "user_cart": bson.M{"$elemMatch": bson.M{"_id": productID, "quantity": bson.M{"$lte": -delta}}}}
+	return pullCartLine(ctx, userCollection, filter, productID)
+}
+
+func pullCartLine(ctx context.Context, userCollection *mongo.Collection, filter bson.M, productID primitive.ObjectID) error {
+	result, err := userCollection.UpdateOne(ctx, filter, bson.M{"$pull": bson.M{"user_cart": bson.M{"_id": productID}}})
+	if err != nil {
+		log.Println(err)
+		return ErrCantRemoveItem
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotInCart
+	}
 	return nil
 }
 
@@ -68,116 +339,273 @@ func RemoveCartItem(ctx context.Context, productCollection, userCollection *mong
 	return nil
 }
 
-func BuyItemFromCart(ctx context.Context, userCollection *mongo.Collection, userID string) error {
+// Checkout strategies of BuyItemFromCart. CheckoutAuto uses a transaction
+// and falls back to CheckoutAtomic when the server is a standalone mongod,
+// which cannot run transactions.
+const (
+	CheckoutAuto        = "auto"
+	CheckoutTransaction = "transaction"
+	CheckoutAtomic      = "atomic"
+)
+
+// BuyItemFromCart turns the cart into a pending order and empties the cart
+// as one unit: either both happen or neither does, see checkout.atomic for
+// the limits without transactions. A cart can only be ordered once, a
+// concurrent checkout of the same cart gets ErrCartEmpty.
+// Lines whose product was deleted or repriced fail the checkout with
+// ErrCartChanged, see RevalidateCart.
+// The stock of the ordered lines is taken from the user's reservation where
+// it covers them and from the shelf otherwise; when it is not available the
+// error wraps ErrOutOfStock and nothing changes.
+func BuyItemFromCart(ctx context.Context, productCollection, userCollection, orderCollection, reservationCollection *mongo.Collection, userID string, payment models.Payment, coupon *models.Coupon, strategy string) (*models.Order, error) {
 	id, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
 		log.Println(err)
-		return ErrUserIDIsNotValid
+		return nil, ErrUserIDIsNotValid
 	}
-	var getCartItems models.User
-	var orderCart models.Order
-	orderCart.Order_ID = primitive.NewObjectID()
-	orderCart.Ordered_At = time.Now()
-	orderCart.Order_Cart = make([]models.ProductUser, 0)
-	orderCart.Payment_Method.COD = true
+	c := checkout{products: productCollection, users: userCollection, orders: orderCollection, reservations: reservationCollection, id: id, payment: payment, coupon: coupon}
+	switch strategy {
+	case CheckoutAtomic:
+		return c.atomic(ctx)
+	case CheckoutTransaction:
+		return c.transaction(ctx)
+	}
+	order, err := c.transaction(ctx)
+	if transactionsUnsupported(err) {
+		return c.atomic(ctx)
+	}
+	return order, err
+}
 
-	match_filter := bson.D{{Key: "$match", Value: bson.D{primitive.E{Key: "_id", Value: id}}}}
-	unwind := bson.D{{Key: "$unwind", Value: bson.D{primitive.E{Key: "path", Value: "$user_cart"}}}}
-	group := bson.D{{Key: "$group", Value: bson.D{primitive.E{Key: "_id", Value: "$_id"}, {Key: "total", Value: bson.D{primitive.E{Key: "$sum", Value: "$user_cart.price"}}}}}}
-	cursor, err := userCollection.Aggregate(ctx, mongo.Pipeline{match_filter, unwind, group})
-	ctx.Done()
-	if err != nil {
-		panic(err)
+type checkout struct {
+	products     *mongo.Collection
+	users        *mongo.Collection
+	orders       *mongo.Collection
+	reservations *mongo.Collection
+	id           primitive.ObjectID
+	payment      models.Payment
+	coupon       *models.Coupon
+	// fault, when set, is asked at every step of the checkout and fails it
+	// with the error it returns. Tests use it to interrupt a checkout.
+	fault func(step string) error
+}
+
+// Steps of a checkout that fault is asked about.
+const (
+	stepReservationClaimed = "reservation claimed"
+	stepStockSettled       = "stock settled"
+	stepInsertOrder        = "insert order"
+)
+
+func (c checkout) failAt(step string) error {
+	if c.fault == nil {
+		return nil
 	}
-	var getUserCart []bson.M
-	if err = cursor.All(ctx, &getUserCart); err != nil {
-		panic(err)
+	return c.fault(step)
+}
+
+func (c checkout) transaction(ctx context.Context) (*models.Order, error) {
+	session, err := c.users.Database().Client().StartSession()
+	if err != nil {
+		return nil, err
 	}
+	defer session.EndSession(ctx)
 
-	var total_price int64
-	for _, user_item := range getUserCart {
-		price := (user_item["total"])
-		total_price = price.(int64)
+	var order models.Order
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		var user models.User
+		err := c.users.FindOne(sc, bson.M{"_id": c.id}).Decode(&user)
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrUserNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(user.User_Cart) == 0 {
+			return nil, ErrCartEmpty
+		}
+		if err = checkCartLines(sc, c.products, user.User_Cart); err != nil {
+			return nil, err
+		}
+		if order, err = NewOrder(c.id.Hex(), user.User_Cart, c.payment, c.coupon); err != nil {
+			return nil, err
+		}
+
+		reservation, err := ClaimReservation(sc, c.reservations, c.id.Hex())
+		if err != nil {
+			return nil, err
+		}
+		if err = c.failAt(stepReservationClaimed); err != nil {
+			return nil, err
+		}
+		if err = SettleStock(sc, c.products, reservation.ReservedLines(), StockLines(user.User_Cart)); err != nil {
+			return nil, err
+		}
+		if err = c.failAt(stepStockSettled); err != nil {
+			return nil, err
+		}
+		if err = c.failAt(stepInsertOrder); err != nil {
+			return nil, err
+		}
+		if _, err = c.orders.InsertOne(sc, order); err != nil {
+			return nil, err
+		}
+		update := bson.M{"$set": bson.M{"user_cart": make([]models.ProductUser, 0)}}
+		if _, err = c.users.UpdateOne(sc, bson.M{"_id": c.id}, update); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	orderCart.Price = int(total_price)
+	return &order, nil
+}
 
-	filter := bson.D{primitive.E{Key: "_id", Value: id}}
-	update := bson.D{{Key: "$push", Value: bson.D{primitive.E{Key: "orders", Value: orderCart}}}}
-	_, err = userCollection.UpdateMany(ctx, filter, update)
+// checkoutUndoTimeout bounds the writes that undo a failed atomic checkout.
+const checkoutUndoTimeout = 10 * time.Second
+
+// atomic places the order without a transaction. It takes the stock and
+// inserts the order first, then empties the cart only if it still holds
+// exactly the lines that were ordered, so no two checkouts can order the
+// same cart: the one that finds the cart changed deletes its order again.
+// Failures are undone on a context of their own, which a cancelled request
+// does not interrupt. What remains is a crash of the process in between:
+// after the stock was taken and before the order was inserted the stock
+// stays taken without an order, and after the order was inserted the lines
+// also stay in the cart.
+func (c checkout) atomic(ctx context.Context) (*models.Order, error) {
+	var raw bson.Raw
+	opts := options.FindOne().SetProjection(bson.M{"user_cart": 1})
+	err := c.users.FindOne(ctx, bson.M{"_id": c.id}, opts).Decode(&raw)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrUserNotFound
+	}
 	if err != nil {
 		log.Println(err)
-		return err
+		return nil, ErrCantBuyCartItem
+	}
+	var user models.User
+	if err = bson.Unmarshal(raw, &user); err != nil {
+		log.Println(err)
+		return nil, ErrCantBuyCartItem
+	}
+	if len(user.User_Cart) == 0 {
+		return nil, ErrCartEmpty
+	}
+	if err = checkCartLines(ctx, c.products, user.User_Cart); err != nil {
+		return nil, err
+	}
+	order, err := NewOrder(c.id.Hex(), user.User_Cart, c.payment, c.coupon)
+	if err != nil {
+		return nil, err
 	}
 
-	err = userCollection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: id}}).Decode(&getCartItems)
+	reservation, err := ClaimReservation(ctx, c.reservations, c.id.Hex())
 	if err != nil {
 		log.Println(err)
-		return err
+		return nil, ErrCantBuyCartItem
 	}
-
-	filter2 := bson.D{primitive.E{Key: "_id", Value: id}}
-	update2 := bson.M{"$push": bson.M{"orders.$[order].order_list": bson.M{"$each": getCartItems.User_Cart}}}
-	updateOptions2 := options.UpdateOptions{
-		ArrayFilters: &options.ArrayFilters{
-			Filters: []interface{}{bson.M{"order._id": orderCart.Order_ID}},
-		},
+	if err = c.failAt(stepReservationClaimed); err != nil {
+		c.undo(nil, reservation, nil)
+		return nil, err
+	}
+	wanted := StockLines(user.User_Cart)
+	if err = SettleStock(ctx, c.products, reservation.ReservedLines(), wanted); err != nil {
+		c.undo(nil, reservation, nil)
+		return nil, err
+	}
+	if err = c.failAt(stepStockSettled); err != nil {
+		c.undo(nil, reservation, wanted)
+		return nil, err
+	}
+	if err = c.failAt(stepInsertOrder); err == nil {
+		_, err = c.orders.InsertOne(ctx, order)
 	}
-	_, err = userCollection.UpdateOne(ctx, filter2, update2, &updateOptions2)
 	if err != nil {
 		log.Println(err)
-		return err
+		c.undo(nil, reservation, wanted)
+		return nil, ErrCantBuyCartItem
 	}
 
-	userCart_empty := make([]models.ProductUser, 0)
-	filter3 := bson.D{primitive.E{Key: "_id", Value: id}}
-	update3 := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: "user_cart", Value: userCart_empty}}}}
-	_, err = userCollection.UpdateOne(ctx, filter3, update3)
+	filter := bson.M{"_id": c.id, "user_cart": raw.Lookup("user_cart")}
+	update := bson.M{"$set": bson.M{"user_cart": make([]models.ProductUser, 0)}}
+	result, err := c.users.UpdateOne(ctx, filter, update)
 	if err != nil {
-		return ErrCantBuyCartItem
+		log.Println(err)
+		c.undo(&order.Order_ID, reservation, wanted)
+		return nil, ErrCantBuyCartItem
+	}
+	if result.MatchedCount == 0 {
+		c.undo(&order.Order_ID, reservation, wanted)
+		return nil, ErrCartEmpty
 	}
+	return &order, nil
+}
 
-	return nil
+// undo puts back what a failed atomic checkout took: it deletes the order
+// when one was inserted, returns the taken stock and holds the claimed
+// reservation again.
+func (c checkout) undo(orderID *primitive.ObjectID, reservation *Reservation, taken []StockLine) {
+	ctx, cancel := context.WithTimeout(context.Background(), checkoutUndoTimeout)
+	defer cancel()
+
+	if orderID != nil {
+		if _, err := c.orders.DeleteOne(ctx, bson.M{"_id": *orderID}); err != nil {
+			log.Println(err)
+		}
+	}
+	if taken != nil {
+		if err := SettleStock(ctx, c.products, taken, reservation.ReservedLines()); err != nil {
+			log.Println(err)
+		}
+	}
+	if err := UnclaimReservation(ctx, c.reservations, reservation); err != nil {
+		log.Println(err)
+	}
+}
+
+// transactionsUnsupported reports the error a standalone mongod returns for
+// commands that carry a transaction number.
+func transactionsUnsupported(err error) bool {
+	var serverErr mongo.ServerError
+	return errors.As(err, &serverErr) && serverErr.HasErrorCode(20)
 }
 
-func InstantBuy(ctx context.Context, productCollection, userCollection *mongo.Collection, productID primitive.ObjectID, userID string) error {
+// InstantBuy orders one unit of the product, taking it from stock.
+func InstantBuy(ctx context.Context, productCollection, userCollection, orderCollection *mongo.Collection, productID primitive.ObjectID, userID string, payment models.Payment, coupon *models.Coupon) (*models.Order, error) {
 	id, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
 		log.Println(err)
-		return ErrUserIDIsNotValid
+		return nil, ErrUserIDIsNotValid
 	}
-	var product models.Product
-	var orderCart models.Order
-	orderCart.Order_ID = primitive.NewObjectID()
-	orderCart.Ordered_At = time.Now()
-	orderCart.Order_Cart = make([]models.ProductUser, 0)
-	orderCart.Payment_Method.COD = true
-	err = productCollection.FindOne(ctx, bson.M{"_id": productID}).Decode(&product)
+	product, err := findProduct(ctx, productCollection, productID)
 	if err != nil {
-		log.Println(err)
-		return err
+		return nil, err
 	}
-	orderCart.Price = int(*product.Price)
-
-	filter := bson.D{primitive.E{Key: "_id", Value: id}}
-	update := bson.D{{Key: "$push", Value: bson.D{primitive.E{Key: "orders", Value: orderCart}}}}
-	_, err = userCollection.UpdateOne(ctx, filter, update)
+	count, err := userCollection.CountDocuments(ctx, bson.M{"_id": id})
 	if err != nil {
-		log.Println(err)
-		return err
+		return nil, err
 	}
-
-	filter2 := bson.D{primitive.E{Key: "_id", Value: id}}
-	update2 := bson.M{"$push": bson.M{"orders.$[order].order_list": product}}
-	updateOptions2 := options.UpdateOptions{
-		ArrayFilters: &options.ArrayFilters{
-			Filters: []interface{}{bson.M{"order._id": orderCart.Order_ID}},
-		},
+	if count == 0 {
+		return nil, ErrUserNotFound
 	}
-	_, err = userCollection.UpdateOne(ctx, filter2, update2, &updateOptions2)
+
+	line := CartLine(product, 1)
+	order, err := NewOrder(id.Hex(), []models.ProductUser{line}, payment, coupon)
 	if err != nil {
+		return nil, err
+	}
+	stock := StockLines([]models.ProductUser{line})
+	if err = TakeStock(ctx, productCollection, stock); err != nil {
+		return nil, err
+	}
+	if _, err = orderCollection.InsertOne(ctx, order); err != nil {
 		log.Println(err)
-		return err
+		if returnErr := ReturnStock(ctx, productCollection, stock); returnErr != nil {
+			log.Println(returnErr)
+		}
+		return nil, err
 	}
-
-	return nil
+	return &order, nil
 }
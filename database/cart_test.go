@@ -0,0 +1,196 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mauroarnedo/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// testDatabase connects to the server in MONGO_TEST_URI and returns a fresh
+// database that is dropped when the test ends. Tests are skipped without it.
+func testDatabase(t *testing.T) *mongo.Database {
+	t.Helper()
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGO_TEST_URI is not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.Ping(ctx, nil); err != nil {
+		t.Skipf("mongodb is not reachable: %v", err)
+	}
+	db := client.Database("ecommerce_test_" + primitive.NewObjectID().Hex())
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := db.Drop(ctx); err != nil {
+			t.Log(err)
+		}
+		if err := client.Disconnect(ctx); err != nil {
+			t.Log(err)
+		}
+	})
+	return db
+}
+
+type checkoutFixture struct {
+	checkout checkout
+	product  primitive.ObjectID
+	cart     []models.ProductUser
+}
+
+// newCheckoutFixture stores a product with 10 units, a user with 3 of them
+// in the cart and a reservation holding 2 of those.
+func newCheckoutFixture(t *testing.T, db *mongo.Database) checkoutFixture {
+	t.Helper()
+	ctx := context.Background()
+	c := checkout{
+		products:     ProductData(db, "products"),
+		users:        UserData(db, "users"),
+		orders:       OrderData(db, "orders"),
+		reservations: ReservationData(db, "reservations"),
+		id:           primitive.NewObjectID(),
+		payment:      models.Payment{COD: true},
+	}
+
+	name := "mug"
+	price := models.NewMoney(1200, "USD")
+	stock := 10
+	product := models.Product{Product_ID: primitive.NewObjectID(), Product_Name: &name, Price: &price, Stock: &stock}
+	if _, err := c.products.InsertOne(ctx, product); err != nil {
+		t.Fatal(err)
+	}
+	cart := []models.ProductUser{{Product_ID: product.Product_ID, Product_Name: &name, Price: &price, Quantity: 3}}
+	if _, err := c.users.InsertOne(ctx, models.User{ID: c.id, User_ID: c.id.Hex(), User_Cart: cart}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := HoldStock(ctx, c.products, c.reservations, c.id.Hex(), []StockLine{{Product_ID: product.Product_ID, Quantity: 2}}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return checkoutFixture{checkout: c, product: product.Product_ID, cart: cart}
+}
+
+// assertUntouched checks that a failed checkout left no trace: no order,
+// the cart as it was, 8 units on the shelf and the reservation still held.
+func (f checkoutFixture) assertUntouched(t *testing.T) {
+	t.Helper()
+	ctx := context.Background()
+	c := f.checkout
+
+	orders, err := c.orders.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orders != 0 {
+		t.Errorf("orders = %d, want 0", orders)
+	}
+
+	var user models.User
+	if err = c.users.FindOne(ctx, bson.M{"_id": c.id}).Decode(&user); err != nil {
+		t.Fatal(err)
+	}
+	if len(user.User_Cart) != 1 || user.User_Cart[0].Product_ID != f.product || user.User_Cart[0].Quantity != 3 {
+		t.Errorf("cart = %+v, want 3 units of %s", user.User_Cart, f.product.Hex())
+	}
+
+	var product models.Product
+	if err = c.products.FindOne(ctx, bson.M{"_id": f.product}).Decode(&product); err != nil {
+		t.Fatal(err)
+	}
+	if product.Stock == nil || *product.Stock != 8 {
+		t.Errorf("stock = %v, want 8", product.Stock)
+	}
+
+	var reservation Reservation
+	if err = c.reservations.FindOne(ctx, bson.M{"user_id": c.id.Hex()}).Decode(&reservation); err != nil {
+		t.Fatal(err)
+	}
+	if reservation.Status != ReservationHeld {
+		t.Errorf("reservation status = %q, want %q", reservation.Status, ReservationHeld)
+	}
+}
+
+func TestCheckoutUndoesFailedSteps(t *testing.T) {
+	strategies := []struct {
+		name string
+		run  func(checkout, context.Context) (*models.Order, error)
+	}{
+		{CheckoutTransaction, checkout.transaction},
+		{CheckoutAtomic, checkout.atomic},
+	}
+	steps := []string{stepReservationClaimed, stepStockSettled, stepInsertOrder}
+	injected := errors.New("injected failure")
+
+	db := testDatabase(t)
+	for _, strategy := range strategies {
+		for _, step := range steps {
+			strategy, step := strategy, step
+			t.Run(strategy.name+"/"+step, func(t *testing.T) {
+				f := newCheckoutFixture(t, db)
+				t.Cleanup(func() {
+					for _, collection := range []*mongo.Collection{f.checkout.products, f.checkout.users, f.checkout.orders, f.checkout.reservations} {
+						if _, err := collection.DeleteMany(context.Background(), bson.M{}); err != nil {
+							t.Log(err)
+						}
+					}
+				})
+				c := f.checkout
+				c.fault = func(at string) error {
+					if at == step {
+						return injected
+					}
+					return nil
+				}
+
+				order, err := strategy.run(c, context.Background())
+				if strategy.name == CheckoutTransaction && transactionsUnsupported(err) {
+					t.Skip("the server cannot run transactions")
+				}
+				if !errors.Is(err, injected) && !errors.Is(err, ErrCantBuyCartItem) {
+					t.Fatalf("checkout error = %v, want the injected failure", err)
+				}
+				if order != nil {
+					t.Errorf("checkout returned order %s", order.Order_ID.Hex())
+				}
+				f.assertUntouched(t)
+			})
+		}
+	}
+}
+
+func TestCheckoutPlacesOrder(t *testing.T) {
+	db := testDatabase(t)
+	f := newCheckoutFixture(t, db)
+	ctx := context.Background()
+
+	order, err := f.checkout.atomic(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(order.Order_Cart) != 1 || order.Order_Cart[0].Quantity != 3 {
+		t.Errorf("order lines = %+v, want 3 units", order.Order_Cart)
+	}
+	var product models.Product
+	if err = f.checkout.products.FindOne(ctx, bson.M{"_id": f.product}).Decode(&product); err != nil {
+		t.Fatal(err)
+	}
+	if product.Stock == nil || *product.Stock != 7 {
+		t.Errorf("stock = %v, want 7", product.Stock)
+	}
+	if _, err = f.checkout.atomic(ctx); err != ErrCartEmpty {
+		t.Errorf("second checkout error = %v, want %v", err, ErrCartEmpty)
+	}
+}
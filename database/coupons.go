@@ -0,0 +1,251 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/mauroarnedo/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrCouponNotFound      = errors.New("coupon not found")
+	ErrCouponExists        = errors.New("a coupon with this code already exists")
+	ErrCouponInactive      = errors.New("the coupon is not valid at this time")
+	ErrCouponNotApplicable = errors.New("the coupon does not apply to any product in the cart")
+	ErrCouponMinimum       = errors.New("the cart is below the minimum value of the coupon")
+	ErrCouponUsedUp        = errors.New("the coupon has reached its usage limit")
+	ErrCouponUserLimit     = errors.New("the coupon was already used the maximum number of times by this user")
+)
+
+// CouponRedemption counts how often one user placed orders with a coupon.
+type CouponRedemption struct {
+	Coupon_ID  primitive.ObjectID `json:"coupon_id" bson:"coupon_id"`
+	User_ID    string             `json:"user_id" bson:"user_id"`
+	Count      int                `json:"count" bson:"count"`
+	Updated_At time.Time          `json:"updated_at" bson:"updated_at"`
+}
+
+func CouponData(db *mongo.Database, collectionName string) *mongo.Collection {
+	var couponCollection *mongo.Collection = db.Collection(collectionName)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := couponCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "code", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	return couponCollection
+}
+
+func CouponRedemptionData(db *mongo.Database, collectionName string) *mongo.Collection {
+	var redemptionCollection *mongo.Collection = db.Collection(collectionName)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := redemptionCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "coupon_id", Value: 1}, {Key: "user_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	return redemptionCollection
+}
+
+// CouponDiscount prices the coupon against the cart lines. It returns the
+// discount and the share of it taken off each line, in the order of items.
+// A percentage coupon takes its share of the covered lines; a fixed one
+// takes its amount, at most the value of the covered lines, spread over
+// them by value.
+func CouponDiscount(coupon *models.Coupon, items []models.ProductUser, now time.Time) (models.Money, []models.Money, error) {
+	if !coupon.ValidAt(now) {
+		return models.Money{}, nil, ErrCouponInactive
+	}
+	total, err := CartTotal(items)
+	if err != nil {
+		return models.Money{}, nil, err
+	}
+	if coupon.Min_Total != nil {
+		if total.Currency != "" && total.Currency != coupon.Min_Total.Currency {
+			return models.Money{}, nil, models.ErrCurrencyMismatch
+		}
+		if total.Amount < coupon.Min_Total.Amount {
+			return models.Money{}, nil, ErrCouponMinimum
+		}
+	}
+
+	var covered []models.ProductUser
+	for _, item := range items {
+		if coupon.Covers(item) {
+			covered = append(covered, item)
+		}
+	}
+	if len(covered) == 0 {
+		return models.Money{}, nil, ErrCouponNotApplicable
+	}
+	base, err := CartTotal(covered)
+	if err != nil {
+		return models.Money{}, nil, err
+	}
+
+	discount := models.NewMoney(0, total.Currency)
+	switch coupon.Type {
+	case models.CouponPercentage:
+		discount = base.Percent(coupon.Basis_Points)
+	case models.CouponFixed:
+		if coupon.Amount == nil {
+			break
+		}
+		if base.Currency != "" && coupon.Amount.Currency != base.Currency {
+			return models.Money{}, nil, models.ErrCurrencyMismatch
+		}
+		discount = *coupon.Amount
+		if discount.Amount > base.Amount {
+			discount.Amount = base.Amount
+		}
+	}
+	return discount, spreadDiscount(coupon, items, discount, base), nil
+}
+
+// spreadDiscount splits the discount over the covered lines by their value.
+// The rounding remainder goes to the last covered line.
+func spreadDiscount(coupon *models.Coupon, items []models.ProductUser, discount models.Money, base models.Money) []models.Money {
+	shares := make([]models.Money, len(items))
+	last, given := -1, int64(0)
+	for i, item := range items {
+		shares[i] = models.NewMoney(0, discount.Currency)
+		if !coupon.Covers(item) || item.Price == nil || base.Amount == 0 {
+			continue
+		}
+		shares[i].Amount = discount.Amount * item.Price.Mul(item.Quantity).Amount / base.Amount
+		given += shares[i].Amount
+		last = i
+	}
+	if last >= 0 {
+		shares[last].Amount += discount.Amount - given
+	}
+	return shares
+}
+
+func CreateCoupon(ctx context.Context, couponCollection *mongo.Collection, coupon *models.Coupon) error {
+	_, err := couponCollection.InsertOne(ctx, coupon)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrCouponExists
+	}
+	return err
+}
+
+func FindCoupon(ctx context.Context, couponCollection *mongo.Collection, code string) (*models.Coupon, error) {
+	var coupon models.Coupon
+	err := couponCollection.FindOne(ctx, bson.M{"code": models.NormalizeCouponCode(code)}).Decode(&coupon)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrCouponNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &coupon, nil
+}
+
+// ListCoupons returns every coupon, newest first.
+func ListCoupons(ctx context.Context, couponCollection *mongo.Collection) ([]models.Coupon, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cursor, err := couponCollection.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	coupons := make([]models.Coupon, 0)
+	if err = cursor.All(ctx, &coupons); err != nil {
+		return nil, err
+	}
+	return coupons, nil
+}
+
+func SetCouponActive(ctx context.Context, couponCollection *mongo.Collection, code string, active bool) error {
+	filter := bson.M{"code": models.NormalizeCouponCode(code)}
+	update := bson.M{"$set": bson.M{"active": active, "updated_at": time.Now()}}
+	result, err := couponCollection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrCouponNotFound
+	}
+	return nil
+}
+
+// CountRedemptions returns how many orders the user placed with the coupon.
+func CountRedemptions(ctx context.Context, redemptionCollection *mongo.Collection, couponID primitive.ObjectID, userID string) (int, error) {
+	var redemption CouponRedemption
+	err := redemptionCollection.FindOne(ctx, bson.M{"coupon_id": couponID, "user_id": userID}).Decode(&redemption)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return redemption.Count, nil
+}
+
+// RedeemCoupon counts one use of the coupon by the user before an order is
+// placed with it. The user's count is taken first: once it reached the
+// limit the upsert collides with the existing redemption. The global count
+// is then taken only while the coupon is active and below its limit.
+func RedeemCoupon(ctx context.Context, couponCollection, redemptionCollection *mongo.Collection, coupon *models.Coupon, userID string) error {
+	filter := bson.M{"coupon_id": coupon.ID, "user_id": userID}
+	if coupon.Max_Uses_Per_User > 0 {
+		filter["count"] = bson.M{"$lt": coupon.Max_Uses_Per_User}
+	}
+	update := bson.M{"$inc": bson.M{"count": 1}, "$set": bson.M{"updated_at": time.Now()}}
+	_, err := redemptionCollection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrCouponUserLimit
+	}
+	if err != nil {
+		return err
+	}
+
+	couponFilter := bson.M{"_id": coupon.ID, "active": true}
+	if coupon.Max_Uses > 0 {
+		couponFilter["uses"] = bson.M{"$lt": coupon.Max_Uses}
+	}
+	result, err := couponCollection.UpdateOne(ctx, couponFilter, bson.M{"$inc": bson.M{"uses": 1}})
+	if err == nil && result.MatchedCount == 0 {
+		err = ErrCouponUsedUp
+	}
+	if err != nil {
+		if undoErr := releaseRedemption(ctx, redemptionCollection, coupon.ID, userID); undoErr != nil {
+			log.Println(undoErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// ReleaseCoupon gives back a use taken by RedeemCoupon, when the order was
+// not placed or was cancelled.
+func ReleaseCoupon(ctx context.Context, couponCollection, redemptionCollection *mongo.Collection, couponID primitive.ObjectID, userID string) error {
+	filter := bson.M{"_id": couponID, "uses": bson.M{"$gt": 0}}
+	if _, err := couponCollection.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"uses": -1}}); err != nil {
+		return err
+	}
+	return releaseRedemption(ctx, redemptionCollection, couponID, userID)
+}
+
+func releaseRedemption(ctx context.Context, redemptionCollection *mongo.Collection, couponID primitive.ObjectID, userID string) error {
+	filter := bson.M{"coupon_id": couponID, "user_id": userID, "count": bson.M{"$gt": 0}}
+	update := bson.M{"$inc": bson.M{"count": -1}, "$set": bson.M{"updated_at": time.Now()}}
+	_, err := redemptionCollection.UpdateOne(ctx, filter, update)
+	return err
+}
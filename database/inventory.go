@@ -0,0 +1,311 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mauroarnedo/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var ErrOutOfStock = errors.New("out of stock")
+
+// Reservation statuses. A held reservation keeps its stock out of the
+// shelf until it expires; checkout commits it, the release worker or a
+// newer reservation of the same user releases it.
+const (
+	ReservationHeld      = "held"
+	ReservationCommitted = "committed"
+	ReservationReleased  = "released"
+)
+
+type StockLine struct {
+	Product_ID primitive.ObjectID `json:"product_id" bson:"product_id"`
+	Quantity   int                `json:"quantity" bson:"quantity"`
+}
+
+type Reservation struct {
+	ID         primitive.ObjectID `json:"_id" bson:"_id"`
+	User_ID    string             `json:"user_id" bson:"user_id"`
+	Lines      []StockLine        `json:"lines" bson:"lines"`
+	Status     string             `json:"status" bson:"status"`
+	Created_At time.Time          `json:"created_at" bson:"created_at"`
+	Expires_At time.Time          `json:"expires_at" bson:"expires_at"`
+}
+
+func ReservationData(db *mongo.Database, collectionName string) *mongo.Collection {
+	var reservationCollection *mongo.Collection = db.Collection(collectionName)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := reservationCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "status", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "expires_at", Value: 1}}},
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	return reservationCollection
+}
+
+// CartLine copies the product into a cart or order line.
+func CartLine(product *models.Product, quantity int) models.ProductUser {
+	return models.ProductUser{
+		Product_ID:   product.Product_ID,
+		Product_Name: product.Product_Name,
+		Price:        product.Price,
+		Rating:       product.Rating,
+		Description:  product.Description,
+		Image:        product.Image,
+		Category:     product.Category,
+		Quantity:     quantity,
+	}
+}
+
+// StockLines sums the quantities of items per product.
+func StockLines(items []models.ProductUser) []StockLine {
+	lines := make([]StockLine, 0, len(items))
+	index := make(map[primitive.ObjectID]int)
+	for _, item := range items {
+		if i, ok := index[item.Product_ID]; ok {
+			lines[i].Quantity += item.Quantity
+			continue
+		}
+		index[item.Product_ID] = len(lines)
+		lines = append(lines, StockLine{Product_ID: item.Product_ID, Quantity: item.Quantity})
+	}
+	return lines
+}
+
+// OutOfStock reports that there are not enough units of the product.
+func OutOfStock(product *models.Product) error {
+	if product.Product_Name == nil {
+		return fmt.Errorf("%w: %s", ErrOutOfStock, product.Product_ID.Hex())
+	}
+	return fmt.Errorf("%w: %s", ErrOutOfStock, *product.Product_Name)
+}
+
+// CartLimit is the most units of the product a cart line may hold and the
+// error reported beyond it.
+func CartLimit(product *models.Product) (int, error) {
+	if product.Stock != nil && *product.Stock < MaxCartQuantity {
+		return *product.Stock, OutOfStock(product)
+	}
+	return MaxCartQuantity, ErrCartQuantityTooLarge
+}
+
+func findProduct(ctx context.Context, productCollection *mongo.Collection, productID primitive.ObjectID) (*models.Product, error) {
+	var product models.Product
+	err := productCollection.FindOne(ctx, bson.M{"_id": productID}).Decode(&product)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrCantFindProduct
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, ErrCantDecodeProducts
+	}
+	return &product, nil
+}
+
+// SetStock sets the units of the product that can still be sold, not
+// counting held reservations. Nil stops tracking its stock.
+func SetStock(ctx context.Context, productCollection *mongo.Collection, productID primitive.ObjectID, stock *int) error {
+	update := bson.M{"$set": bson.M{"stock": stock}}
+	if stock == nil {
+		update = bson.M{"$unset": bson.M{"stock": ""}}
+	}
+	result, err := productCollection.UpdateOne(ctx, bson.M{"_id": productID}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrCantFindProduct
+	}
+	return nil
+}
+
+// TakeStock removes the lines from stock, each with a conditional decrement
+// so stock never goes below zero. Products without a stock are not tracked
+// and always succeed. When one line cannot be taken, the lines taken so far
+// are returned and the error wraps ErrOutOfStock.
+func TakeStock(ctx context.Context, productCollection *mongo.Collection, lines []StockLine) error {
+	for i, line := range lines {
+		if line.Quantity <= 0 {
+			continue
+		}
+		err := takeLine(ctx, productCollection, line)
+		if err == nil {
+			continue
+		}
+		if returnErr := ReturnStock(ctx, productCollection, lines[:i]); returnErr != nil {
+			log.Println(returnErr)
+		}
+		return err
+	}
+	return nil
+}
+
+func takeLine(ctx context.Context, productCollection *mongo.Collection, line StockLine) error {
+	filter := bson.M{"_id": line.Product_ID, "stock": bson.M{"$gte": line.Quantity}}
+	result, err := productCollection.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"stock": -line.Quantity}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 1 {
+		return nil
+	}
+	product, err := findProduct(ctx, productCollection, line.Product_ID)
+	if err != nil {
+		return err
+	}
+	if product.Stock == nil {
+		return nil
+	}
+	return OutOfStock(product)
+}
+
+// ReturnStock puts the lines back on the shelf of the products that track
+// their stock.
+func ReturnStock(ctx context.Context, productCollection *mongo.Collection, lines []StockLine) error {
+	for _, line := range lines {
+		if line.Quantity <= 0 {
+			continue
+		}
+		filter := bson.M{"_id": line.Product_ID, "stock": bson.M{"$type": "number"}}
+		if _, err := productCollection.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"stock": line.Quantity}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StockDiff splits the change from the reserved lines to the wanted ones
+// into the units still to take and the surplus to give back.
+func StockDiff(reserved []StockLine, wanted []StockLine) (take []StockLine, give []StockLine) {
+	diff := make(map[primitive.ObjectID]int)
+	for _, line := range wanted {
+		diff[line.Product_ID] += line.Quantity
+	}
+	for _, line := range reserved {
+		diff[line.Product_ID] -= line.Quantity
+	}
+	for _, line := range append(append([]StockLine(nil), wanted...), reserved...) {
+		quantity, ok := diff[line.Product_ID]
+		if !ok {
+			continue
+		}
+		delete(diff, line.Product_ID)
+		if quantity > 0 {
+			take = append(take, StockLine{Product_ID: line.Product_ID, Quantity: quantity})
+		} else if quantity < 0 {
+			give = append(give, StockLine{Product_ID: line.Product_ID, Quantity: -quantity})
+		}
+	}
+	return take, give
+}
+
+// SettleStock changes what is taken from stock from the reserved lines to
+// the wanted ones, see StockDiff.
+func SettleStock(ctx context.Context, productCollection *mongo.Collection, reserved []StockLine, wanted []StockLine) error {
+	take, give := StockDiff(reserved, wanted)
+	if err := TakeStock(ctx, productCollection, take); err != nil {
+		return err
+	}
+	return ReturnStock(ctx, productCollection, give)
+}
+
+// HoldStock reserves the lines for the user until ttl passes. A reservation
+// the user already holds is released first.
+func HoldStock(ctx context.Context, productCollection, reservationCollection *mongo.Collection, userID string, lines []StockLine, ttl time.Duration) (*Reservation, error) {
+	_, err := releaseReservations(ctx, productCollection, reservationCollection, bson.M{"user_id": userID, "status": ReservationHeld})
+	if err != nil {
+		return nil, err
+	}
+	if err = TakeStock(ctx, productCollection, lines); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	reservation := Reservation{
+		ID:         primitive.NewObjectID(),
+		User_ID:    userID,
+		Lines:      lines,
+		Status:     ReservationHeld,
+		Created_At: now,
+		Expires_At: now.Add(ttl),
+	}
+	if _, err = reservationCollection.InsertOne(ctx, reservation); err != nil {
+		if returnErr := ReturnStock(ctx, productCollection, lines); returnErr != nil {
+			log.Println(returnErr)
+		}
+		return nil, err
+	}
+	return &reservation, nil
+}
+
+// ClaimReservation commits the unexpired reservation the user holds, if
+// any, so its stock can be used by the order being placed.
+func ClaimReservation(ctx context.Context, reservationCollection *mongo.Collection, userID string) (*Reservation, error) {
+	filter := bson.M{"user_id": userID, "status": ReservationHeld, "expires_at": bson.M{"$gt": time.Now()}}
+	update := bson.M{"$set": bson.M{"status": ReservationCommitted}}
+
+	var reservation Reservation
+	err := reservationCollection.FindOneAndUpdate(ctx, filter, update).Decode(&reservation)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &reservation, nil
+}
+
+// UnclaimReservation holds a claimed reservation again after the order it
+// was claimed for could not be placed.
+func UnclaimReservation(ctx context.Context, reservationCollection *mongo.Collection, reservation *Reservation) error {
+	if reservation == nil {
+		return nil
+	}
+	filter := bson.M{"_id": reservation.ID, "status": ReservationCommitted}
+	_, err := reservationCollection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"status": ReservationHeld}})
+	return err
+}
+
+// ReleaseExpiredReservations returns the stock of every held reservation
+// that expired before now. Each reservation is claimed before its stock is
+// returned, so concurrent workers never release one twice.
+func ReleaseExpiredReservations(ctx context.Context, productCollection, reservationCollection *mongo.Collection, now time.Time) (int, error) {
+	return releaseReservations(ctx, productCollection, reservationCollection, bson.M{"status": ReservationHeld, "expires_at": bson.M{"$lte": now}})
+}
+
+func releaseReservations(ctx context.Context, productCollection, reservationCollection *mongo.Collection, filter bson.M) (int, error) {
+	update := bson.M{"$set": bson.M{"status": ReservationReleased}}
+	released := 0
+	for {
+		var reservation Reservation
+		err := reservationCollection.FindOneAndUpdate(ctx, filter, update).Decode(&reservation)
+		if err == mongo.ErrNoDocuments {
+			return released, nil
+		}
+		if err != nil {
+			return released, err
+		}
+		if err = ReturnStock(ctx, productCollection, reservation.Lines); err != nil {
+			return released, err
+		}
+		released++
+	}
+}
+
+// ReservedLines is the stock taken by the reservation, none for nil.
+func (r *Reservation) ReservedLines() []StockLine {
+	if r == nil {
+		return nil
+	}
+	return r.Lines
+}
@@ -0,0 +1,203 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mauroarnedo/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// OrderFilter selects orders for SearchOrders. Zero fields do not filter.
+// To is exclusive.
+type OrderFilter struct {
+	UserID    string
+	ProductID primitive.ObjectID
+	Status    string
+	From      time.Time
+	To        time.Time
+	MinTotal  *models.Money
+	MaxTotal  *models.Money
+	Skip      int64
+	Limit     int64
+}
+
+var (
+	ErrOrderNotFound = errors.New("order not found")
+	ErrOrderChanged  = errors.New("the order was changed concurrently, try again")
+)
+
+func OrderData(db *mongo.Database, collectionName string) *mongo.Collection {
+	var orderCollection *mongo.Collection = db.Collection(collectionName)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := orderCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "ordered_at", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "ordered_at", Value: -1}}},
+		{Keys: bson.D{{Key: "order_list._id", Value: 1}}},
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	return orderCollection
+}
+
+// NewOrder builds a pending order of the user for items, to be paid with
+// payment. It fails when the items are priced in different currencies. A
+// coupon, already redeemed by the caller, is taken off the total and
+// recorded on the order and its lines.
+func NewOrder(userID string, items []models.ProductUser, payment models.Payment, coupon *models.Coupon) (models.Order, error) {
+	total, err := CartTotal(items)
+	if err != nil {
+		return models.Order{}, err
+	}
+	now := time.Now()
+	var order models.Order
+	order.Order_ID = primitive.NewObjectID()
+	order.User_ID = userID
+	order.Ordered_At = now
+	order.Updated_At = now
+	order.Order_Cart = append(make([]models.ProductUser, 0, len(items)), items...)
+	for i := range order.Order_Cart {
+		order.Order_Cart[i].Line_ID = primitive.NewObjectID()
+	}
+	order.Payment_Method = payment
+	order.Status = models.OrderPending
+	order.History = []models.StatusChange{{To: models.OrderPending, Actor: userID, At: now}}
+	order.Price = total
+
+	if coupon == nil {
+		return order, nil
+	}
+	discount, shares, err := CouponDiscount(coupon, items, now)
+	if err != nil {
+		return models.Order{}, err
+	}
+	for i := range order.Order_Cart {
+		if !shares[i].IsZero() {
+			share := shares[i]
+			order.Order_Cart[i].Discount = &share
+		}
+	}
+	if order.Price, err = total.Sub(discount); err != nil {
+		return models.Order{}, err
+	}
+	order.Discount = &discount
+	order.Coupon = &models.AppliedCoupon{
+		Coupon_ID:     coupon.ID,
+		Code:          coupon.Code,
+		Type:          coupon.Type,
+		Free_Shipping: coupon.Type == models.CouponFreeShipping,
+	}
+	return order, nil
+}
+
+func FindOrder(ctx context.Context, orderCollection *mongo.Collection, orderID primitive.ObjectID) (*models.Order, error) {
+	var order models.Order
+	err := orderCollection.FindOne(ctx, bson.M{"_id": orderID}).Decode(&order)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrOrderNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// TransitionOrder moves the order to status and records the change in its
+// history. The update only applies while the order still has the status it
+// was checked against, so two concurrent transitions cannot both succeed.
+func TransitionOrder(ctx context.Context, orderCollection *mongo.Collection, orderID primitive.ObjectID, status string, actor string, note string) (*models.Order, error) {
+	order, err := FindOrder(ctx, orderCollection, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if !models.CanTransition(order.Status, status) {
+		return nil, fmt.Errorf("%w from %s to %s", models.ErrIllegalTransition, order.Status, status)
+	}
+
+	now := time.Now()
+	change := models.StatusChange{From: order.Status, To: status, Actor: actor, Note: note, At: now}
+	filter := bson.M{"_id": orderID, "status": order.Status}
+	update := bson.M{
+		"$set":  bson.M{"status": status, "updated_at": now},
+		"$push": bson.M{"history": change},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var updated models.Order
+	err = orderCollection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&updated)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrOrderChanged
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+func (f OrderFilter) query() bson.M {
+	query := bson.M{}
+	if f.UserID != "" {
+		query["user_id"] = f.UserID
+	}
+	if !f.ProductID.IsZero() {
+		query["order_list._id"] = f.ProductID
+	}
+	if f.Status != "" {
+		query["status"] = f.Status
+	}
+	orderedAt := bson.M{}
+	if !f.From.IsZero() {
+		orderedAt["$gte"] = f.From
+	}
+	if !f.To.IsZero() {
+		orderedAt["$lt"] = f.To
+	}
+	if len(orderedAt) > 0 {
+		query["ordered_at"] = orderedAt
+	}
+	total := bson.M{}
+	if f.MinTotal != nil {
+		total["$gte"] = f.MinTotal.Amount
+		query["total_price.currency"] = f.MinTotal.Currency
+	}
+	if f.MaxTotal != nil {
+		total["$lte"] = f.MaxTotal.Amount
+		query["total_price.currency"] = f.MaxTotal.Currency
+	}
+	if len(total) > 0 {
+		query["total_price.amount"] = total
+	}
+	return query
+}
+
+// SearchOrders returns one page of the matching orders, newest first, and
+// the number of orders matching in total.
+func SearchOrders(ctx context.Context, orderCollection *mongo.Collection, filter OrderFilter) ([]models.Order, int64, error) {
+	query := filter.query()
+	total, err := orderCollection.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "ordered_at", Value: -1}}).SetSkip(filter.Skip).SetLimit(filter.Limit)
+	cursor, err := orderCollection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	orders := make([]models.Order, 0)
+	if err = cursor.All(ctx, &orders); err != nil {
+		return nil, 0, err
+	}
+	return orders, total, nil
+}
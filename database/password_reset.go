@@ -0,0 +1,81 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrResetTokenInvalid = errors.New("reset token is invalid or expired")
+
+type PasswordReset struct {
+	ID         primitive.ObjectID `bson:"_id"`
+	User_ID    string             `bson:"user_id"`
+	Token_Hash string             `bson:"token_hash"`
+	Created_At time.Time          `bson:"created_at"`
+	Expires_At time.Time          `bson:"expires_at"`
+	Used_At    *time.Time         `bson:"used_at"`
+}
+
+func PasswordResetData(db *mongo.Database, collectionName string) *mongo.Collection {
+	var resetCollection *mongo.Collection = db.Collection(collectionName)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := resetCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	return resetCollection
+}
+
+// CreatePasswordReset stores a new reset token for the user and drops any
+// token that was requested before, so only the latest link works.
+func CreatePasswordReset(ctx context.Context, resetCollection *mongo.Collection, userID string, tokenHash string, expiresAt time.Time) error {
+	_, err := resetCollection.DeleteMany(ctx, bson.M{"user_id": userID})
+	if err != nil {
+		return err
+	}
+	_, err = resetCollection.InsertOne(ctx, PasswordReset{
+		ID:         primitive.NewObjectID(),
+		User_ID:    userID,
+		Token_Hash: tokenHash,
+		Created_At: time.Now(),
+		Expires_At: expiresAt,
+	})
+	return err
+}
+
+// ConsumePasswordReset marks the token as used and returns its user. The
+// check and the update are a single operation, so a token is redeemed once.
+func ConsumePasswordReset(ctx context.Context, resetCollection *mongo.Collection, tokenHash string) (string, error) {
+	now := time.Now()
+	filter := bson.M{"token_hash": tokenHash, "used_at": nil, "expires_at": bson.M{"$gt": now}}
+	update := bson.M{"$set": bson.M{"used_at": now}}
+
+	var reset PasswordReset
+	err := resetCollection.FindOneAndUpdate(ctx, filter, update).Decode(&reset)
+	if err == mongo.ErrNoDocuments {
+		return "", ErrResetTokenInvalid
+	}
+	if err != nil {
+		return "", err
+	}
+	return reset.User_ID, nil
+}
+
+// ReleasePasswordReset makes a consumed token usable again, for a reset that
+// failed after consuming it.
+func ReleasePasswordReset(ctx context.Context, resetCollection *mongo.Collection, tokenHash string) error {
+	_, err := resetCollection.UpdateOne(ctx, bson.M{"token_hash": tokenHash}, bson.M{"$set": bson.M{"used_at": nil}})
+	return err
+}
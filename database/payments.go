@@ -0,0 +1,227 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/mauroarnedo/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrPaymentNotFound = errors.New("payment not found")
+	ErrPaymentChanged  = errors.New("the payment was changed concurrently, try again")
+
+	ErrPaymentEventNotFound = errors.New("payment event not found")
+)
+
+// Payment intent statuses. An intent is created before the provider is
+// asked to authorize it and then moves forward only. A capture the provider
+// did not answer leaves it capture_unknown until the webhook says whether
+// the money was taken.
+const (
+	PaymentRequiresAuthorization = "requires_authorization"
+	PaymentAuthorized            = "authorized"
+	PaymentCaptureUnknown        = "capture_unknown"
+	PaymentCaptured              = "captured"
+	PaymentVoided                = "voided"
+	PaymentFailed                = "failed"
+	PaymentRefunded              = "refunded"
+)
+
+// Payment event statuses. An event is processing while one delivery or
+// replay applies it; a failed one is applied again by the next delivery,
+// and so is one left processing for longer than its lease.
+const (
+	EventProcessing = "processing"
+	EventProcessed  = "processed"
+	EventFailed     = "failed"
+)
+
+// PaymentIntent tracks the digital payment of one order at the provider.
+type PaymentIntent struct {
+	ID           primitive.ObjectID `json:"_id" bson:"_id"`
+	Order_ID     primitive.ObjectID `json:"order_id" bson:"order_id"`
+	User_ID      string             `json:"user_id" bson:"user_id"`
+	Provider     string             `json:"provider" bson:"provider"`
+	Provider_Ref string             `json:"provider_ref,omitempty" bson:"provider_ref,omitempty"`
+	Amount       models.Money       `json:"amount" bson:"amount"`
+	Captured     models.Money       `json:"captured" bson:"captured"`
+	Refunded     models.Money       `json:"refunded" bson:"refunded"`
+	Refund_IDs   []string           `json:"refund_ids,omitempty" bson:"refund_ids,omitempty"`
+	Status       string             `json:"status" bson:"status"`
+	Failure      string             `json:"failure,omitempty" bson:"failure,omitempty"`
+	Created_At   time.Time          `json:"created_at" bson:"created_at"`
+	Updated_At   time.Time          `json:"updated_at" bson:"updated_at"`
+}
+
+// PaymentEvent is a webhook delivery as received, kept to deduplicate
+// retries and to replay it after a fix.
+type PaymentEvent struct {
+	ID           string    `json:"_id" bson:"_id"`
+	Type         string    `json:"type" bson:"type"`
+	Provider_Ref string    `json:"provider_ref" bson:"provider_ref"`
+	Payload      string    `json:"payload" bson:"payload"`
+	Signature    string    `json:"signature" bson:"signature"`
+	Status       string    `json:"status" bson:"status"`
+	Result       string    `json:"result,omitempty" bson:"result,omitempty"`
+	Error        string    `json:"error,omitempty" bson:"error,omitempty"`
+	Attempts     int       `json:"attempts" bson:"attempts"`
+	Received_At  time.Time `json:"received_at" bson:"received_at"`
+	Updated_At   time.Time `json:"updated_at" bson:"updated_at"`
+}
+
+func PaymentIntentData(db *mongo.Database, collectionName string) *mongo.Collection {
+	var paymentCollection *mongo.Collection = db.Collection(collectionName)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := paymentCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "order_id", Value: 1}}},
+		{Keys: bson.D{{Key: "provider", Value: 1}, {Key: "provider_ref", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	return paymentCollection
+}
+
+// NewPaymentIntent starts the payment of the whole order with provider.
+func NewPaymentIntent(order *models.Order, provider string) PaymentIntent {
+	now := time.Now()
+	return PaymentIntent{
+		ID:         primitive.NewObjectID(),
+		Order_ID:   order.Order_ID,
+		User_ID:    order.User_ID,
+		Provider:   provider,
+		Amount:     order.Price,
+		Captured:   models.NewMoney(0, order.Price.Currency),
+		Refunded:   models.NewMoney(0, order.Price.Currency),
+		Status:     PaymentRequiresAuthorization,
+		Created_At: now,
+		Updated_At: now,
+	}
+}
+
+func CreatePaymentIntent(ctx context.Context, paymentCollection *mongo.Collection, intent *PaymentIntent) error {
+	_, err := paymentCollection.InsertOne(ctx, intent)
+	return err
+}
+
+// FindOrderPayment returns the latest payment intent of the order.
+func FindOrderPayment(ctx context.Context, paymentCollection *mongo.Collection, orderID primitive.ObjectID) (*PaymentIntent, error) {
+	var intent PaymentIntent
+	opts := options.FindOne().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	err := paymentCollection.FindOne(ctx, bson.M{"order_id": orderID}, opts).Decode(&intent)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrPaymentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &intent, nil
+}
+
+// SavePaymentIntent replaces the intent if it is still in status from, so
+// two processes never move the same payment at once.
+func SavePaymentIntent(ctx context.Context, paymentCollection *mongo.Collection, intent *PaymentIntent, from string) error {
+	intent.Updated_At = time.Now()
+	result, err := paymentCollection.ReplaceOne(ctx, bson.M{"_id": intent.ID, "status": from}, intent)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrPaymentChanged
+	}
+	return nil
+}
+
+// FindProviderPayment returns the intent the provider knows as providerRef.
+func FindProviderPayment(ctx context.Context, paymentCollection *mongo.Collection, provider string, providerRef string) (*PaymentIntent, error) {
+	var intent PaymentIntent
+	err := paymentCollection.FindOne(ctx, bson.M{"provider": provider, "provider_ref": providerRef}).Decode(&intent)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrPaymentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &intent, nil
+}
+
+func PaymentEventData(db *mongo.Database, collectionName string) *mongo.Collection {
+	var eventCollection *mongo.Collection = db.Collection(collectionName)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := eventCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "provider_ref", Value: 1}, {Key: "received_at", Value: 1}},
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	return eventCollection
+}
+
+// ClaimPaymentEvent records a new event as processing and returns true. For
+// an event id already recorded it returns the stored event instead, and
+// true only when its status was one of retry, or processing without an
+// update for lease, and is now processing again.
+func ClaimPaymentEvent(ctx context.Context, eventCollection *mongo.Collection, event PaymentEvent, lease time.Duration, retry ...string) (*PaymentEvent, bool, error) {
+	now := time.Now()
+	event.Status = EventProcessing
+	event.Attempts = 1
+	event.Received_At = now
+	event.Updated_At = now
+	_, err := eventCollection.InsertOne(ctx, event)
+	if err == nil {
+		return &event, true, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return nil, false, err
+	}
+
+	var stored PaymentEvent
+	filter := bson.M{"_id": event.ID, "$or": bson.A{
+		bson.M{"status": bson.M{"$in": retry}},
+		bson.M{"status": EventProcessing, "updated_at": bson.M{"$lt": now.Add(-lease)}},
+	}}
+	update := bson.M{"$set": bson.M{"status": EventProcessing, "updated_at": now}, "$inc": bson.M{"attempts": 1}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = eventCollection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&stored)
+	if err == nil {
+		return &stored, true, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, false, err
+	}
+	if err = eventCollection.FindOne(ctx, bson.M{"_id": event.ID}).Decode(&stored); err != nil {
+		return nil, false, err
+	}
+	return &stored, false, nil
+}
+
+func FindPaymentEvent(ctx context.Context, eventCollection *mongo.Collection, eventID string) (*PaymentEvent, error) {
+	var event PaymentEvent
+	err := eventCollection.FindOne(ctx, bson.M{"_id": eventID}).Decode(&event)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrPaymentEventNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// FinishPaymentEvent records the outcome of processing the event.
+func FinishPaymentEvent(ctx context.Context, eventCollection *mongo.Collection, eventID string, status string, result string, failure string) error {
+	update := bson.M{"$set": bson.M{"status": status, "result": result, "error": failure, "updated_at": time.Now()}}
+	_, err := eventCollection.UpdateOne(ctx, bson.M{"_id": eventID}, update)
+	return err
+}
@@ -0,0 +1,171 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mauroarnedo/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrNotInOrder       = errors.New("the product is not in the order")
+	ErrNothingToRefund  = errors.New("nothing is left to refund")
+	ErrRefundTooLarge   = errors.New("more units than are left to refund")
+	ErrInvalidRefund    = errors.New("refund quantities must be positive")
+	ErrOrderNotRefunded = errors.New("the order has not been paid, there is nothing to refund")
+)
+
+// LineQuantity asks for units of one order line, named by its line id or,
+// for the first line of a product, by the product id.
+type LineQuantity struct {
+	Line_ID    primitive.ObjectID `json:"line_id" bson:"line_id"`
+	Product_ID primitive.ObjectID `json:"product_id" bson:"product_id"`
+	Quantity   int                `json:"quantity" bson:"quantity"`
+}
+
+// FindOrderLine returns the line the request names, nil if the order has
+// no such line.
+func FindOrderLine(order *models.Order, line LineQuantity) *models.ProductUser {
+	for i := range order.Order_Cart {
+		item := &order.Order_Cart[i]
+		if !line.Line_ID.IsZero() && item.Line_ID == line.Line_ID {
+			return item
+		}
+		if line.Line_ID.IsZero() && item.Product_ID == line.Product_ID {
+			return item
+		}
+	}
+	return nil
+}
+
+// RefundableQuantities returns the units of each order line, by line id,
+// that have not been refunded yet. Failed refunds do not count.
+func RefundableQuantities(order *models.Order) map[primitive.ObjectID]int {
+	return unrefunded(order, func(refund models.Refund) bool { return refund.Status != models.RefundFailed })
+}
+
+// FullyRefunded reports whether every unit of the order was refunded by a
+// refund that succeeded.
+func FullyRefunded(order *models.Order) bool {
+	for _, quantity := range unrefunded(order, func(refund models.Refund) bool { return refund.Status == models.RefundSucceeded }) {
+		if quantity > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func unrefunded(order *models.Order, counts func(refund models.Refund) bool) map[primitive.ObjectID]int {
+	left := make(map[primitive.ObjectID]int)
+	for _, item := range order.Order_Cart {
+		left[item.Line_ID] += item.Quantity
+	}
+	for _, refund := range order.Refunds {
+		if !counts(refund) {
+			continue
+		}
+		for _, line := range refund.Lines {
+			left[line.Line_ID] -= line.Quantity
+		}
+	}
+	return left
+}
+
+// RefundLines prices the requested units at what the order paid for them,
+// net of the line's share of the coupon discount. No requested lines means
+// everything not refunded yet.
+func RefundLines(order *models.Order, requested []LineQuantity) ([]models.RefundLine, models.Money, error) {
+	left := RefundableQuantities(order)
+	if len(requested) == 0 {
+		for _, item := range order.Order_Cart {
+			if quantity := left[item.Line_ID]; quantity > 0 {
+				requested = append(requested, LineQuantity{Line_ID: item.Line_ID, Quantity: quantity})
+			}
+		}
+	}
+
+	var lines []models.RefundLine
+	total := models.NewMoney(0, order.Price.Currency)
+	for _, line := range requested {
+		if line.Quantity <= 0 {
+			return nil, models.Money{}, ErrInvalidRefund
+		}
+		item := FindOrderLine(order, line)
+		if item == nil {
+			return nil, models.Money{}, ErrNotInOrder
+		}
+		if line.Quantity > left[item.Line_ID] {
+			return nil, models.Money{}, ErrRefundTooLarge
+		}
+		refunded := item.Quantity - left[item.Line_ID]
+		left[item.Line_ID] -= line.Quantity
+
+		amount := models.NewMoney(0, order.Price.Currency)
+		var err error
+		if item.Price != nil {
+			if amount, err = linePaid(item, refunded, refunded+line.Quantity); err != nil {
+				return nil, models.Money{}, err
+			}
+		}
+		if total, err = total.Add(amount); err != nil {
+			return nil, models.Money{}, err
+		}
+		lines = append(lines, models.RefundLine{Line_ID: item.Line_ID, Product_ID: item.Product_ID, Quantity: line.Quantity, Amount: amount})
+	}
+	if len(lines) == 0 {
+		return nil, models.Money{}, ErrNothingToRefund
+	}
+	return lines, total, nil
+}
+
+// linePaid is what the order paid for the units from+1 to to of the line.
+// Each unit's share is rounded down on the running total, so refunding
+// every unit of a line, at once or not, gives back exactly what it cost.
+func linePaid(item *models.ProductUser, from int, to int) (models.Money, error) {
+	paid := item.Price.Mul(item.Quantity)
+	if item.Discount != nil {
+		var err error
+		if paid, err = paid.Sub(*item.Discount); err != nil {
+			return models.Money{}, err
+		}
+	}
+	quantity := int64(item.Quantity)
+	return models.NewMoney(paid.Amount*int64(to)/quantity-paid.Amount*int64(from)/quantity, paid.Currency), nil
+}
+
+// AddRefund records a refund on the order if it was not updated since
+// updatedAt, so refunds computed from a stale order are rejected with
+// ErrOrderChanged.
+func AddRefund(ctx context.Context, orderCollection *mongo.Collection, orderID primitive.ObjectID, refund models.Refund, updatedAt time.Time) (*models.Order, error) {
+	filter := bson.M{"_id": orderID, "updated_at": updatedAt}
+	update := bson.M{
+		"$set":  bson.M{"updated_at": time.Now()},
+		"$push": bson.M{"refunds": refund},
+	}
+	return updateOrder(ctx, orderCollection, filter, update)
+}
+
+// UpdateRefund replaces the refund of the same id on the order.
+func UpdateRefund(ctx context.Context, orderCollection *mongo.Collection, orderID primitive.ObjectID, refund models.Refund) (*models.Order, error) {
+	filter := bson.M{"_id": orderID, "refunds._id": refund.ID}
+	update := bson.M{"$set": bson.M{"refunds.$": refund, "updated_at": time.Now()}}
+	return updateOrder(ctx, orderCollection, filter, update)
+}
+
+func updateOrder(ctx context.Context, orderCollection *mongo.Collection, filter bson.M, update bson.M) (*models.Order, error) {
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var updated models.Order
+	err := orderCollection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&updated)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrOrderChanged
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
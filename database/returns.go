@@ -0,0 +1,150 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/mauroarnedo/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrReturnNotFound = errors.New("return not found")
+	ErrReturnChanged  = errors.New("the return was changed concurrently, try again")
+	ErrReturnTooLarge = errors.New("more units than are left to return")
+	ErrInvalidReturn  = errors.New("a return needs lines with positive quantities")
+)
+
+// ReturnFilter selects returns for ListReturns. Zero fields do not filter.
+type ReturnFilter struct {
+	UserID  string
+	OrderID primitive.ObjectID
+	Status  string
+}
+
+func ReturnData(db *mongo.Database, collectionName string) *mongo.Collection {
+	var returnCollection *mongo.Collection = db.Collection(collectionName)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := returnCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "order_id", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: -1}}},
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	return returnCollection
+}
+
+// ReturnLines checks the requested units against what is left to return of
+// the order: units not refunded yet and not part of another open return.
+func ReturnLines(order *models.Order, returns []models.ReturnRequest, requested []LineQuantity) ([]models.ReturnLine, error) {
+	left := RefundableQuantities(order)
+	for _, request := range returns {
+		if !request.Open() {
+			continue
+		}
+		for _, line := range request.Lines {
+			left[line.Line_ID] -= line.Quantity
+		}
+	}
+
+	if len(requested) == 0 {
+		return nil, ErrInvalidReturn
+	}
+	var lines []models.ReturnLine
+	for _, line := range requested {
+		if line.Quantity <= 0 {
+			return nil, ErrInvalidReturn
+		}
+		item := FindOrderLine(order, line)
+		if item == nil {
+			return nil, ErrNotInOrder
+		}
+		if line.Quantity > left[item.Line_ID] {
+			return nil, ErrReturnTooLarge
+		}
+		left[item.Line_ID] -= line.Quantity
+		lines = addReturnLine(lines, models.ReturnLine{Line_ID: item.Line_ID, Product_ID: item.Product_ID, Quantity: line.Quantity})
+	}
+	return lines, nil
+}
+
+// addReturnLine merges the units into the line of the same order line.
+func addReturnLine(lines []models.ReturnLine, line models.ReturnLine) []models.ReturnLine {
+	for i := range lines {
+		if lines[i].Line_ID == line.Line_ID {
+			lines[i].Quantity += line.Quantity
+			return lines
+		}
+	}
+	return append(lines, line)
+}
+
+func CreateReturn(ctx context.Context, returnCollection *mongo.Collection, request *models.ReturnRequest) error {
+	_, err := returnCollection.InsertOne(ctx, request)
+	return err
+}
+
+func FindReturn(ctx context.Context, returnCollection *mongo.Collection, returnID primitive.ObjectID) (*models.ReturnRequest, error) {
+	var request models.ReturnRequest
+	err := returnCollection.FindOne(ctx, bson.M{"_id": returnID}).Decode(&request)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrReturnNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+func (f ReturnFilter) query() bson.M {
+	query := bson.M{}
+	if f.UserID != "" {
+		query["user_id"] = f.UserID
+	}
+	if !f.OrderID.IsZero() {
+		query["order_id"] = f.OrderID
+	}
+	if f.Status != "" {
+		query["status"] = f.Status
+	}
+	return query
+}
+
+// ListReturns returns the matching returns, newest first.
+func ListReturns(ctx context.Context, returnCollection *mongo.Collection, filter ReturnFilter) ([]models.ReturnRequest, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cursor, err := returnCollection.Find(ctx, filter.query(), opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	requests := make([]models.ReturnRequest, 0)
+	if err = cursor.All(ctx, &requests); err != nil {
+		return nil, err
+	}
+	return requests, nil
+}
+
+// SaveReturn replaces the return if it is still in status from, so two
+// admins never move the same return at once.
+func SaveReturn(ctx context.Context, returnCollection *mongo.Collection, request *models.ReturnRequest, from string) error {
+	request.Updated_At = time.Now()
+	result, err := returnCollection.ReplaceOne(ctx, bson.M{"_id": request.ID, "status": from}, request)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrReturnChanged
+	}
+	return nil
+}
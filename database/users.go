@@ -0,0 +1,22 @@
+package database
+
+import "go.mongodb.org/mongo-driver/bson"
+
+// Projections matching the response types in models/views.go, so fields
+// that must not leave the server are not even read from Mongo.
+var (
+	PublicUserProjection  = bson.M{"_id": 1, "first_name": 1, "last_name": 1}
+	UserProfileProjection = bson.M{
+		"_id": 1, "user_id": 1, "first_name": 1, "last_name": 1, "email": 1, "phone": 1,
+		"email_verified": 1, "phone_verified": 1, "totp_enabled": 1,
+		"user_cart": 1, "user_favorites": 1, "address": 1, "store_credit": 1,
+	}
+	AdminUserProjection = bson.M{
+		"_id": 1, "user_id": 1, "first_name": 1, "last_name": 1, "email": 1, "phone": 1, "role": 1,
+		"email_verified": 1, "phone_verified": 1, "totp_enabled": 1, "created_at": 1, "updated_at": 1,
+	}
+	LoginProjection = bson.M{
+		"_id": 1, "user_id": 1, "first_name": 1, "last_name": 1, "email": 1, "role": 1,
+		"password": 1, "totp_enabled": 1,
+	}
+)
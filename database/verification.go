@@ -0,0 +1,129 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrVerificationInvalid = errors.New("verification code is invalid or expired")
+	ErrVerificationLocked  = errors.New("too many wrong codes, request a new one")
+	ErrResendTooSoon       = errors.New("a code was sent recently, try again later")
+)
+
+const MaxVerificationAttempts = 5
+
+type Verification struct {
+	ID           primitive.ObjectID `bson:"_id"`
+	User_ID      string             `bson:"user_id"`
+	Channel      string             `bson:"channel"`
+	Target       string             `bson:"target"`
+	Code_Hash    string             `bson:"code_hash"`
+	Attempts     int                `bson:"attempts"`
+	Expires_At   time.Time          `bson:"expires_at"`
+	Last_Sent_At time.Time          `bson:"last_sent_at"`
+	Window_Start time.Time          `bson:"window_start"`
+	Sent_Count   int                `bson:"sent_count"`
+}
+
+type ResendPolicy struct {
+	MinInterval  time.Duration
+	Window       time.Duration
+	MaxPerWindow int
+}
+
+func VerificationData(db *mongo.Database, collectionName string) *mongo.Collection {
+	var verificationCollection *mongo.Collection = db.Collection(collectionName)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := verificationCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "channel", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "channel", Value: 1}, {Key: "target", Value: 1}}},
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	return verificationCollection
+}
+
+// SaveVerificationCode replaces the pending code of the user for channel,
+// enforcing the resend policy against the previous sends.
+func SaveVerificationCode(ctx context.Context, verificationCollection *mongo.Collection, userID string, channel string, target string, codeHash string, expiresAt time.Time, policy ResendPolicy) error {
+	now := time.Now()
+	var previous Verification
+	err := verificationCollection.FindOne(ctx, bson.M{"user_id": userID, "channel": channel}).Decode(&previous)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	windowStart, sentCount := now, 1
+	if err == nil {
+		if now.Sub(previous.Last_Sent_At) < policy.MinInterval {
+			return ErrResendTooSoon
+		}
+		if now.Sub(previous.Window_Start) < policy.Window {
+			if previous.Sent_Count >= policy.MaxPerWindow {
+				return ErrResendTooSoon
+			}
+			windowStart, sentCount = previous.Window_Start, previous.Sent_Count+1
+		}
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"target":       target,
+			"code_hash":    codeHash,
+			"attempts":     0,
+			"expires_at":   expiresAt,
+			"last_sent_at": now,
+			"window_start": windowStart,
+			"sent_count":   sentCount,
+		},
+		"$setOnInsert": bson.M{"_id": primitive.NewObjectID()},
+	}
+	_, err = verificationCollection.UpdateOne(ctx, bson.M{"user_id": userID, "channel": channel}, update, options.Update().SetUpsert(true))
+	return err
+}
+
+// CheckVerificationCode returns the user whose pending code for target
+// matches. hash derives the stored hash of the code for a given user. An
+// attempt is counted before the code is compared, so concurrent guesses can
+// not get past MaxVerificationAttempts.
+func CheckVerificationCode(ctx context.Context, verificationCollection *mongo.Collection, channel string, target string, hash func(userID string) string) (string, error) {
+	filter := bson.M{"channel": channel, "target": target, "attempts": bson.M{"$lt": MaxVerificationAttempts}}
+	var pending Verification
+	err := verificationCollection.FindOneAndUpdate(ctx, filter, bson.M{"$inc": bson.M{"attempts": 1}}).Decode(&pending)
+	if err == mongo.ErrNoDocuments {
+		count, err := verificationCollection.CountDocuments(ctx, bson.M{"channel": channel, "target": target})
+		if err != nil {
+			return "", err
+		}
+		if count > 0 {
+			return "", ErrVerificationLocked
+		}
+		return "", ErrVerificationInvalid
+	}
+	if err != nil {
+		return "", err
+	}
+	if time.Now().After(pending.Expires_At) || hash(pending.User_ID) != pending.Code_Hash {
+		return "", ErrVerificationInvalid
+	}
+
+	result, err := verificationCollection.DeleteOne(ctx, bson.M{"_id": pending.ID, "code_hash": pending.Code_Hash})
+	if err != nil {
+		return "", err
+	}
+	if result.DeletedCount == 0 {
+		return "", ErrVerificationInvalid
+	}
+	return pending.User_ID, nil
+}
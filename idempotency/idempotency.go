@@ -0,0 +1,42 @@
+package idempotency
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// Record is the stored outcome of the first request made with a key.
+// Until the handler finishes it is not Completed and has no response.
+type Record struct {
+	Key          string    `bson:"_id"`
+	Request_Hash string    `bson:"request_hash"`
+	Completed    bool      `bson:"completed"`
+	Status       int       `bson:"status"`
+	Content_Type string    `bson:"content_type"`
+	Body         []byte    `bson:"body"`
+	Created_At   time.Time `bson:"created_at"`
+	Expires_At   time.Time `bson:"expires_at"`
+}
+
+// Store keeps one record per key. Begin must be atomic: of two requests
+// with the same key only one may create the record, the other gets the
+// existing record and false.
+type Store interface {
+	Begin(ctx context.Context, key string, requestHash string, now time.Time, expiresAt time.Time) (Record, bool, error)
+	Complete(ctx context.Context, key string, status int, contentType string, body []byte) error
+	Abandon(ctx context.Context, key string) error
+}
+
+// RequestHash fingerprints a request so a key reused for another request
+// can be told apart from a retry.
+func RequestHash(method string, path string, query string, body []byte) string {
+	h := sha256.New()
+	for _, part := range []string{method, path, query} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
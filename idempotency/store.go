@@ -0,0 +1,107 @@
+package idempotency
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type MongoStore struct {
+	collection *mongo.Collection
+}
+
+// NewMongoStore keeps one document per key. A TTL index removes the
+// records once they expire, after which the key can be used again.
+func NewMongoStore(collection *mongo.Collection) *MongoStore {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	return &MongoStore{collection: collection}
+}
+
+// Begin inserts the record and relies on the unique _id to detect a key
+// that is already in use. The TTL monitor only runs once a minute, so an
+// expired record is replaced here rather than replayed.
+func (s *MongoStore) Begin(ctx context.Context, key string, requestHash string, now time.Time, expiresAt time.Time) (Record, bool, error) {
+	record := Record{Key: key, Request_Hash: requestHash, Created_At: now, Expires_At: expiresAt}
+	filter := bson.M{"_id": key, "expires_at": bson.M{"$lte": now}}
+	_, err := s.collection.ReplaceOne(ctx, filter, record, options.Replace().SetUpsert(true))
+	if err == nil {
+		return record, true, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return Record{}, false, err
+	}
+	var existing Record
+	if err = s.collection.FindOne(ctx, bson.M{"_id": key}).Decode(&existing); err != nil {
+		return Record{}, false, err
+	}
+	return existing, false, nil
+}
+
+func (s *MongoStore) Complete(ctx context.Context, key string, status int, contentType string, body []byte) error {
+	update := bson.M{"$set": bson.M{"completed": true, "status": status, "content_type": contentType, "body": body}}
+	_, err := s.collection.UpdateOne(ctx, bson.M{"_id": key}, update)
+	return err
+}
+
+func (s *MongoStore) Abandon(ctx context.Context, key string) error {
+	_, err := s.collection.DeleteOne(ctx, bson.M{"_id": key, "completed": false})
+	return err
+}
+
+type MemoryStore struct {
+	mu      sync.Mutex
+	records map[string]Record
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: make(map[string]Record)}
+}
+
+func (s *MemoryStore) Begin(ctx context.Context, key string, requestHash string, now time.Time, expiresAt time.Time) (Record, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.records[key]; ok && existing.Expires_At.After(now) {
+		return existing, false, nil
+	}
+	record := Record{Key: key, Request_Hash: requestHash, Created_At: now, Expires_At: expiresAt}
+	s.records[key] = record
+	return record, true, nil
+}
+
+func (s *MemoryStore) Complete(ctx context.Context, key string, status int, contentType string, body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.records[key]
+	if !ok {
+		return nil
+	}
+	record.Completed = true
+	record.Status = status
+	record.Content_Type = contentType
+	record.Body = append([]byte(nil), body...)
+	s.records[key] = record
+	return nil
+}
+
+func (s *MemoryStore) Abandon(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if record, ok := s.records[key]; ok && !record.Completed {
+		delete(s.records, key)
+	}
+	return nil
+}
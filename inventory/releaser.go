@@ -0,0 +1,36 @@
+package inventory
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Releaser returns the stock of reservations that expired before now.
+type Releaser interface {
+	ReleaseExpired(ctx context.Context, now time.Time) (int, error)
+}
+
+// RunReleaser releases expired reservations every interval until ctx is
+// done. Several instances may run against the same database, each
+// reservation is only released once.
+func RunReleaser(ctx context.Context, releaser Releaser, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			runCtx, cancel := context.WithTimeout(ctx, interval)
+			released, err := releaser.ReleaseExpired(runCtx, now)
+			cancel()
+			if err != nil {
+				log.Println("releasing reservations:", err)
+			}
+			if released > 0 {
+				log.Printf("released %d expired reservations", released)
+			}
+		}
+	}
+}
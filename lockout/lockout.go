@@ -0,0 +1,212 @@
+package lockout
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/mauroarnedo/ecommerce/audit"
+)
+
+var (
+	ErrLocked   = errors.New("too many failed attempts, the account is temporarily locked")
+	ErrTooEarly = errors.New("too many failed attempts, wait before trying again")
+)
+
+type Record struct {
+	Key          string    `bson:"_id"`
+	Failures     int       `bson:"failures"`
+	Last_Failure time.Time `bson:"last_failure"`
+	Locked_Until time.Time `bson:"locked_until"`
+	Expires_At   time.Time `bson:"expires_at"`
+}
+
+// Store keeps attempt counters. Take must be atomic: it counts an attempt,
+// restarting the count when the previous one is older than window, and
+// returns the record as it was before. Release gives one attempt back.
+type Store interface {
+	Get(ctx context.Context, key string) (Record, error)
+	Take(ctx context.Context, key string, now time.Time, window time.Duration) (Record, error)
+	Release(ctx context.Context, key string) error
+	Lock(ctx context.Context, key string, until time.Time) error
+	Reset(ctx context.Context, key string) error
+}
+
+// Policy describes how failures against one key are throttled. The first
+// FreeAttempts failures cost nothing, later ones double the wait between
+// attempts starting at BaseDelay, and MaxFailures locks the key.
+type Policy struct {
+	FreeAttempts    int
+	MaxFailures     int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutDuration time.Duration
+	Window          time.Duration
+}
+
+var (
+	AccountPolicy = Policy{
+		FreeAttempts:    3,
+		MaxFailures:     10,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Minute,
+		LockoutDuration: 15 * time.Minute,
+		Window:          time.Hour,
+	}
+	IPPolicy = Policy{
+		FreeAttempts:    20,
+		MaxFailures:     100,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Minute,
+		LockoutDuration: time.Hour,
+		Window:          time.Hour,
+	}
+)
+
+func (p Policy) delay(failures int) time.Duration {
+	over := failures - p.FreeAttempts
+	if over <= 0 {
+		return 0
+	}
+	d := time.Duration(float64(p.BaseDelay) * math.Pow(2, float64(over-1)))
+	if d > p.MaxDelay || d <= 0 {
+		return p.MaxDelay
+	}
+	return d
+}
+
+// wait reports how long a caller has to wait after the attempts in record.
+func (p Policy) wait(record Record, now time.Time) (time.Duration, error) {
+	if now.Before(record.Locked_Until) {
+		return record.Locked_Until.Sub(now), ErrLocked
+	}
+	if now.Sub(record.Last_Failure) > p.Window {
+		return 0, nil
+	}
+	if next := record.Last_Failure.Add(p.delay(record.Failures)); now.Before(next) {
+		return next.Sub(now), ErrTooEarly
+	}
+	return 0, nil
+}
+
+// Guard throttles login attempts per account and per client IP.
+type Guard struct {
+	Store   Store
+	Audit   audit.Log
+	Account Policy
+	IP      Policy
+}
+
+func NewGuard(store Store, auditLog audit.Log) *Guard {
+	return &Guard{Store: store, Audit: auditLog, Account: AccountPolicy, IP: IPPolicy}
+}
+
+func AccountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func IPKey(ip string) string {
+	return "ip:" + ip
+}
+
+type guardKey struct {
+	key    string
+	policy Policy
+}
+
+func (g *Guard) keys(email string, ip string) []guardKey {
+	return []guardKey{{AccountKey(email), g.Account}, {IPKey(ip), g.IP}}
+}
+
+// Check must run before the password is compared. It counts the attempt
+// against the account and the IP before looking at the earlier ones, so
+// parallel requests cannot share one free slot, and the attempt stays
+// counted as a failure until Succeed or Release gives it back. It returns
+// how long the caller has to wait when either key is throttled; such an
+// attempt is given back at once but still restarts the wait.
+func (g *Guard) Check(ctx context.Context, email string, ip string) (time.Duration, error) {
+	now := time.Now()
+	var taken []string
+	for _, k := range g.keys(email, ip) {
+		record, err := g.Store.Take(ctx, k.key, now, k.policy.Window)
+		if err != nil {
+			g.release(ctx, taken...)
+			return 0, err
+		}
+		taken = append(taken, k.key)
+		if wait, err := k.policy.wait(record, now); err != nil {
+			g.release(ctx, taken...)
+			return wait, err
+		}
+	}
+	return 0, nil
+}
+
+// Fail keeps the attempt taken by Check and locks a key that reached its
+// MaxFailures.
+func (g *Guard) Fail(ctx context.Context, email string, ip string) {
+	now := time.Now()
+	for _, k := range g.keys(email, ip) {
+		g.fail(ctx, k.key, k.policy, now, email, ip)
+	}
+}
+
+func (g *Guard) fail(ctx context.Context, key string, policy Policy, now time.Time, email string, ip string) {
+	record, err := g.Store.Get(ctx, key)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if record.Failures < policy.MaxFailures || now.Before(record.Locked_Until) {
+		return
+	}
+	until := now.Add(policy.LockoutDuration)
+	if err = g.Store.Lock(ctx, key, until); err != nil {
+		log.Println(err)
+		return
+	}
+	err = g.Audit.Record(ctx, audit.Entry{
+		Action:  audit.ActionLockout,
+		Subject: key,
+		IP:      ip,
+		Details: map[string]string{"email": email, "locked_until": until.Format(time.RFC3339)},
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Succeed clears the account counter after a successful login. The IP
+// counter only gets the attempt back, so one valid account cannot launder
+// guesses against others.
+func (g *Guard) Succeed(ctx context.Context, email string, ip string) {
+	if err := g.Store.Reset(ctx, AccountKey(email)); err != nil {
+		log.Println(err)
+	}
+	g.release(ctx, IPKey(ip))
+}
+
+// Release gives back the attempt taken by Check for a step that passed
+// without completing the login, such as a password ahead of its second
+// factor.
+func (g *Guard) Release(ctx context.Context, email string, ip string) {
+	g.release(ctx, AccountKey(email), IPKey(ip))
+}
+
+func (g *Guard) release(ctx context.Context, keys ...string) {
+	for _, key := range keys {
+		if err := g.Store.Release(ctx, key); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (g *Guard) Unlock(ctx context.Context, key string, actor string) error {
+	if err := g.Store.Reset(ctx, key); err != nil {
+		return err
+	}
+	return g.Audit.Record(ctx, audit.Entry{Action: audit.ActionUnlock, Actor: actor, Subject: key})
+}
@@ -0,0 +1,155 @@
+package lockout
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type MongoStore struct {
+	collection *mongo.Collection
+}
+
+// NewMongoStore keeps one document per key. A TTL index removes counters
+// once their failures fall out of the window and any lock has ended.
+func NewMongoStore(collection *mongo.Collection) *MongoStore {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	return &MongoStore{collection: collection}
+}
+
+func (s *MongoStore) Get(ctx context.Context, key string) (Record, error) {
+	var record Record
+	err := s.collection.FindOne(ctx, bson.M{"_id": key}).Decode(&record)
+	if err == mongo.ErrNoDocuments {
+		return Record{Key: key}, nil
+	}
+	return record, err
+}
+
+// Take counts an attempt in the same update that reads the counter, so
+// parallel attempts each see the ones before them.
+func (s *MongoStore) Take(ctx context.Context, key string, now time.Time, window time.Duration) (Record, error) {
+	stale := bson.M{"$lt": bson.A{"$last_failure", now.Add(-window)}}
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"failures": bson.M{"$cond": bson.A{
+				stale,
+				1,
+				bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$failures", 0}}, 1}},
+			}},
+			"last_failure": now,
+			"expires_at": bson.M{"$max": bson.A{
+				now.Add(window),
+				bson.M{"$ifNull": bson.A{"$locked_until", now}},
+			}},
+		}}},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.Before)
+
+	var record Record
+	err := s.collection.FindOneAndUpdate(ctx, bson.M{"_id": key}, update, opts).Decode(&record)
+	if err == mongo.ErrNoDocuments {
+		return Record{Key: key}, nil
+	}
+	return record, err
+}
+
+func (s *MongoStore) Release(ctx context.Context, key string) error {
+	_, err := s.collection.UpdateOne(ctx, bson.M{"_id": key, "failures": bson.M{"$gt": 0}}, bson.M{"$inc": bson.M{"failures": -1}})
+	return err
+}
+
+func (s *MongoStore) Lock(ctx context.Context, key string, until time.Time) error {
+	update := bson.M{"$set": bson.M{"locked_until": until}, "$max": bson.M{"expires_at": until}}
+	_, err := s.collection.UpdateOne(ctx, bson.M{"_id": key}, update, options.Update().SetUpsert(true))
+	return err
+}
+
+func (s *MongoStore) Reset(ctx context.Context, key string) error {
+	_, err := s.collection.DeleteOne(ctx, bson.M{"_id": key})
+	return err
+}
+
+type MemoryStore struct {
+	mu      sync.Mutex
+	records map[string]Record
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: make(map[string]Record)}
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string) (Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.records[key]
+	if !ok {
+		return Record{Key: key}, nil
+	}
+	return record, nil
+}
+
+func (s *MemoryStore) Take(ctx context.Context, key string, now time.Time, window time.Duration) (Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before, ok := s.records[key]
+	if !ok {
+		before = Record{Key: key}
+	}
+	record := before
+	if record.Last_Failure.Before(now.Add(-window)) {
+		record.Failures = 0
+	}
+	record.Failures++
+	record.Last_Failure = now
+	record.Expires_At = now.Add(window)
+	if record.Locked_Until.After(record.Expires_At) {
+		record.Expires_At = record.Locked_Until
+	}
+	s.records[key] = record
+	return before, nil
+}
+
+func (s *MemoryStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if record, ok := s.records[key]; ok && record.Failures > 0 {
+		record.Failures--
+		s.records[key] = record
+	}
+	return nil
+}
+
+func (s *MemoryStore) Lock(ctx context.Context, key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record := s.records[key]
+	record.Key = key
+	record.Locked_Until = until
+	if until.After(record.Expires_At) {
+		record.Expires_At = until
+	}
+	s.records[key] = record
+	return nil
+}
+
+func (s *MemoryStore) Reset(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, key)
+	return nil
+}
@@ -1,37 +1,80 @@
 package main
 
 import (
+	"context"
 	"log"
-	"os"
 
 	"github.com/gin-gonic/gin"
+	"github.com/mauroarnedo/ecommerce/audit"
+	"github.com/mauroarnedo/ecommerce/config"
 	"github.com/mauroarnedo/ecommerce/controllers"
 	"github.com/mauroarnedo/ecommerce/database"
+	"github.com/mauroarnedo/ecommerce/idempotency"
+	"github.com/mauroarnedo/ecommerce/inventory"
+	"github.com/mauroarnedo/ecommerce/lockout"
 	"github.com/mauroarnedo/ecommerce/middleware"
+	"github.com/mauroarnedo/ecommerce/models"
+	"github.com/mauroarnedo/ecommerce/notify"
+	"github.com/mauroarnedo/ecommerce/payment"
+	"github.com/mauroarnedo/ecommerce/repository"
 	"github.com/mauroarnedo/ecommerce/routes"
+	"github.com/mauroarnedo/ecommerce/tokens"
 )
 
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8000"
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal(err)
 	}
-	app := controllers.NewApplication(database.ProductData(database.Client, "products"), database.UserData(database.Client, "users"))
+	keys, err := tokens.LoadKeys(cfg.Auth.KeysFile, cfg.Auth.SecretKey, cfg.Auth.KeyGracePeriod)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	client, err := database.DBSet(cfg.Mongo)
+	if err != nil {
+		log.Fatal(err)
+	}
+	db := client.Database(cfg.Mongo.Database)
+	repos := repository.NewMongoRepositories(db, cfg.Mongo.CheckoutStrategy)
+	tokenManager := tokens.NewManager(keys, repos.Users, tokens.NewMongoRevocationStore(database.TokenData(db, "revoked_tokens")), cfg.Auth.AccessTokenTTL, cfg.Auth.RefreshTokenTTL)
+	loginGuard := lockout.NewGuard(lockout.NewMongoStore(database.LoginAttemptData(db, "login_attempts")), audit.NewMongoLog(database.AuditData(db, "audit_log")))
+
+	provider, err := payment.New(cfg.Payments.Provider)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	idempotent := middleware.Idempotency(idempotency.NewMongoStore(database.IdempotencyData(db, "idempotency_keys")), cfg.Server.IdempotencyKeyTTL)
+	go inventory.RunReleaser(context.Background(), repos.Inventory, cfg.Inventory.ReleaseInterval)
+
+	app := controllers.NewApplication(cfg, repos, tokenManager, loginGuard, notify.New(cfg.Notify.File), provider)
 
 	router := gin.New()
+	if err = router.SetTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		log.Fatal(err)
+	}
 	router.Use(gin.Logger())
-	routes.UserRoutes(router)
-	router.Use(middleware.Authentication())
+	routes.UserRoutes(router, app, tokenManager)
+	routes.AdminRoutes(router, app, tokenManager)
+	routes.PaymentRoutes(router, app)
+	router.Use(middleware.Authentication(tokenManager), middleware.Authorization(models.RoleCustomer, models.RoleAdmin))
 	router.GET("/addtocart", app.AddToCart())
 	router.GET("/removeitem", app.RemoveItem())
+	router.GET("/setcartquantity", app.SetCartQuantity())
+	router.GET("/incrementitem", app.IncrementItem())
+	router.GET("/decrementitem", app.DecrementItem())
 	router.GET("/listcart", app.GetItemFromCart())
-	router.POST("/addaddress", controllers.AddAddress())
-	router.PUT("/edithomeaddress", controllers.EditHomeAddress())
-	router.PUT("/editworkaddress", controllers.EditWorkAddress())
-	router.GET("/deleteaddresses", controllers.DeleteAddress())
-	router.GET("/cartcheckout", app.BuyFromCart())
-	router.GET("/instantbuy", app.InstantBuy())
-	router.POST("/addcomments", controllers.AddComments())
-	router.DELETE("/deletecomments", controllers.DeleteComments())
-	log.Fatal(router.Run(":" + port))
+	router.POST("/applycoupon", app.ApplyCoupon())
+	router.DELETE("/removecoupon", app.RemoveCoupon())
+	router.POST("/addaddress", app.AddAddress())
+	router.PUT("/edithomeaddress", app.EditHomeAddress())
+	router.PUT("/editworkaddress", app.EditWorkAddress())
+	router.GET("/deleteaddresses", app.DeleteAddress())
+	router.POST("/reservecart", app.ReserveCart())
+	router.POST("/cartcheckout", idempotent, app.BuyFromCart())
+	router.POST("/instantbuy", idempotent, app.InstantBuy())
+	router.POST("/addcomments", app.AddComments())
+	router.DELETE("/deletecomments", app.DeleteComments())
+	log.Fatal(router.Run(":" + cfg.Server.Port))
 }
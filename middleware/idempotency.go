@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mauroarnedo/ecommerce/idempotency"
+)
+
+const maxIdempotencyKeyLength = 255
+
+// Idempotency makes retries of a request carrying an Idempotency-Key
+// header safe. The first request runs and its response is stored for ttl;
+// a retry with the same key and request gets that response again, the
+// same key with a different request is rejected. Keys are scoped to the
+// authenticated user. Responses with a 5xx status are not kept, so the
+// request can be retried with the same key.
+func Idempotency(store idempotency.Store, ttl time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"Error": "Idempotency-Key is too long"})
+			return
+		}
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"Error": "the request body cannot be read"})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		ctx := c.Request.Context()
+		scoped := c.GetString("uid") + ":" + key
+		hash := idempotency.RequestHash(c.Request.Method, c.Request.URL.Path, c.Request.URL.RawQuery, body)
+		now := time.Now()
+		record, created, err := store.Begin(ctx, scoped, hash, now, now.Add(ttl))
+		if err != nil {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"Error": "the idempotency key cannot be checked"})
+			return
+		}
+		if !created {
+			switch {
+			case record.Request_Hash != hash:
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{"Error": "the Idempotency-Key was already used for a different request"})
+			case !record.Completed:
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{"Error": "a request with this Idempotency-Key is still in progress"})
+			default:
+				c.Header("Idempotent-Replayed", "true")
+				c.Data(record.Status, record.Content_Type, record.Body)
+				c.Abort()
+			}
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		finished := false
+		defer func() {
+			// The handler panicked, nothing was stored.
+			if !finished {
+				abandon(c, store, scoped)
+			}
+		}()
+
+		c.Next()
+		finished = true
+
+		if recorder.Status() >= http.StatusInternalServerError {
+			abandon(c, store, scoped)
+			return
+		}
+		// When the response cannot be stored the key stays in progress until
+		// it expires: refusing retries is safer than running them twice.
+		err = store.Complete(ctx, scoped, recorder.Status(), recorder.Header().Get("Content-Type"), recorder.body.Bytes())
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func abandon(c *gin.Context, store idempotency.Store, key string) {
+	if err := store.Abandon(c.Request.Context(), key); err != nil {
+		log.Println(err)
+	}
+}
+
+// responseRecorder keeps a copy of the body written to the client.
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
+
+func (r *responseRecorder) WriteString(s string) (int, error) {
+	r.body.WriteString(s)
+	return r.ResponseWriter.WriteString(s)
+}
@@ -7,7 +7,7 @@ import (
 	token "github.com/mauroarnedo/ecommerce/tokens"
 )
 
-func Authentication() gin.HandlerFunc {
+func Authentication(tm *token.Manager) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		clientToken := c.Request.Header.Get("token")
 		if clientToken == "" {
@@ -15,14 +15,39 @@ func Authentication() gin.HandlerFunc {
 			c.Abort()
 			return
 		}
-		claims, err := token.ValidateToken(clientToken)
+		claims, err := tm.ValidateToken(clientToken)
 		if err != "" {
 			c.JSON(http.StatusInternalServerError, gin.H{"Error": err})
 			c.Abort()
 			return
 		}
+		revoked, revokedErr := tm.IsRevoked(c.Request.Context(), claims.ID, claims.Family, claims.Uid, claims.Generation)
+		if revokedErr != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"Error": "the token cannot be checked"})
+			return
+		}
+		if revoked {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"Error": "Token has been revoked"})
+			return
+		}
 		c.Set("email", claims.Email)
 		c.Set("uid", claims.Uid)
+		c.Set("role", claims.Role)
+		c.Set("jti", claims.ID)
+		c.Set("expires_at", claims.ExpiresAt.Time)
 		c.Next()
 	}
 }
+
+func Authorization(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role := c.GetString("role")
+		for _, allowed := range roles {
+			if role == allowed {
+				c.Next()
+				return
+			}
+		}
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"Error": "You are not allowed to access this resource"})
+	}
+}
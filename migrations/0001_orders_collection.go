@@ -0,0 +1,89 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mauroarnedo/ecommerce/database"
+	"github.com/mauroarnedo/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// moveEmbeddedOrders copies every order of users.orders into the orders
+// collection as a pending order, keeping its id, and then drops the array.
+// Orders that were already copied by an interrupted run are skipped. The
+// orders are copied as documents rather than models.Order since their
+// prices are still the legacy numbers 0003_money converts.
+func moveEmbeddedOrders(ctx context.Context, db *mongo.Database) error {
+	users := database.UserData(db, "users")
+	orders := database.OrderData(db, "orders")
+
+	cursor, err := users.Find(ctx, bson.M{"orders.0": bson.M{"$exists": true}}, options.Find().SetProjection(bson.M{"user_id": 1, "orders": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	now := time.Now()
+	for cursor.Next(ctx) {
+		var user struct {
+			ID      primitive.ObjectID `bson:"_id"`
+			User_ID string             `bson:"user_id"`
+			Orders  []bson.M           `bson:"orders"`
+		}
+		if err = cursor.Decode(&user); err != nil {
+			return err
+		}
+		if user.User_ID == "" {
+			user.User_ID = user.ID.Hex()
+		}
+
+		documents := make([]interface{}, 0, len(user.Orders))
+		for _, order := range user.Orders {
+			order["user_id"] = user.User_ID
+			if _, ok := order["order_list"].(bson.A); !ok {
+				order["order_list"] = bson.A{}
+			}
+			if status, _ := order["status"].(string); status == "" {
+				var orderedAt time.Time
+				if at, ok := order["ordered_at"].(primitive.DateTime); ok {
+					orderedAt = at.Time()
+				}
+				order["status"] = models.OrderPending
+				order["history"] = bson.A{models.StatusChange{To: models.OrderPending, Actor: "migration", At: orderedAt}}
+			}
+			order["updated_at"] = now
+			documents = append(documents, order)
+		}
+		_, err = orders.InsertMany(ctx, documents, options.InsertMany().SetOrdered(false))
+		if err != nil && !onlyDuplicates(err) {
+			return err
+		}
+		if _, err = users.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$unset": bson.M{"orders": ""}}); err != nil {
+			return err
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return err
+	}
+
+	_, err = users.UpdateMany(ctx, bson.M{"orders": bson.M{"$exists": true}}, bson.M{"$unset": bson.M{"orders": ""}})
+	return err
+}
+
+func onlyDuplicates(err error) bool {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+		return false
+	}
+	for _, writeErr := range bulkErr.WriteErrors {
+		if writeErr.Code != 11000 {
+			return false
+		}
+	}
+	return true
+}
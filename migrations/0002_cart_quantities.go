@@ -0,0 +1,64 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/mauroarnedo/ecommerce/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mergeCartLines turns carts holding one entry per unit into one line per
+// product with a quantity, and gives order lines a quantity of one. Lines
+// are merged as documents so their legacy number prices are kept for
+// 0003_money.
+func mergeCartLines(ctx context.Context, db *mongo.Database) error {
+	users := database.UserData(db, "users")
+	orders := database.OrderData(db, "orders")
+
+	cursor, err := users.Find(ctx, bson.M{"user_cart.0": bson.M{"$exists": true}}, options.Find().SetProjection(bson.M{"user_cart": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var user struct {
+			ID        primitive.ObjectID `bson:"_id"`
+			User_Cart []bson.M           `bson:"user_cart"`
+		}
+		if err = cursor.Decode(&user); err != nil {
+			return err
+		}
+
+		lines := make([]bson.M, 0, len(user.User_Cart))
+		index := make(map[interface{}]int)
+		for _, item := range user.User_Cart {
+			quantity, _ := toInt(item["quantity"])
+			if quantity == 0 {
+				quantity = 1
+			}
+			if i, ok := index[item["_id"]]; ok {
+				merged, _ := toInt(lines[i]["quantity"])
+				lines[i]["quantity"] = merged + quantity
+				continue
+			}
+			index[item["_id"]] = len(lines)
+			item["quantity"] = quantity
+			lines = append(lines, item)
+		}
+		if _, err = users.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"user_cart": lines}}); err != nil {
+			return err
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return err
+	}
+
+	missing := bson.M{"quantity": bson.M{"$exists": false}}
+	opts := options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{bson.M{"line.quantity": bson.M{"$exists": false}}}})
+	_, err = orders.UpdateMany(ctx, bson.M{"order_list": bson.M{"$elemMatch": missing}}, bson.M{"$set": bson.M{"order_list.$[line].quantity": 1}}, opts)
+	return err
+}
@@ -0,0 +1,129 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/mauroarnedo/ecommerce/database"
+	"github.com/mauroarnedo/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Currency is the store currency legacy float prices are converted to.
+// cmd/migrate sets it from the configuration.
+var Currency = "USD"
+
+// convertPrices rewrites the float prices of products, cart, favorite and
+// order lines as Money, and order totals from the sum of their lines since
+// the stored int totals were truncated. Documents already converted are
+// left alone.
+func convertPrices(ctx context.Context, db *mongo.Database) error {
+	products := database.ProductData(db, "products")
+	users := database.UserData(db, "users")
+	orders := database.OrderData(db, "orders")
+
+	number := bson.M{"$type": "number"}
+	err := convertDocuments(ctx, products, bson.M{"price": number}, func(doc bson.M) bson.M {
+		return bson.M{"price": toMoney(doc["price"])}
+	})
+	if err != nil {
+		return err
+	}
+
+	legacyLines := bson.M{"$elemMatch": bson.M{"price": number}}
+	userFilter := bson.M{"$or": bson.A{bson.M{"user_cart": legacyLines}, bson.M{"user_favorites": legacyLines}}}
+	err = convertDocuments(ctx, users, userFilter, func(doc bson.M) bson.M {
+		return bson.M{"user_cart": convertLines(doc["user_cart"]), "user_favorites": convertLines(doc["user_favorites"])}
+	})
+	if err != nil {
+		return err
+	}
+
+	orderFilter := bson.M{"$or": bson.A{bson.M{"order_list": legacyLines}, bson.M{"total_price": number}}}
+	return convertDocuments(ctx, orders, orderFilter, func(doc bson.M) bson.M {
+		lines := convertLines(doc["order_list"])
+		total := models.NewMoney(0, Currency)
+		for _, line := range lines {
+			item, _ := line.(bson.M)
+			quantity, _ := toInt(item["quantity"])
+			if quantity == 0 {
+				quantity = 1
+			}
+			total.Amount += priceAmount(item["price"]) * int64(quantity)
+		}
+		return bson.M{"order_list": lines, "total_price": total}
+	})
+}
+
+func convertDocuments(ctx context.Context, collection *mongo.Collection, filter bson.M, convert func(doc bson.M) bson.M) error {
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var doc bson.M
+		if err = cursor.Decode(&doc); err != nil {
+			return err
+		}
+		if _, err = collection.UpdateOne(ctx, bson.M{"_id": doc["_id"]}, bson.M{"$set": convert(doc)}); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// convertLines converts the price of every line stored as a number and
+// keeps the other lines as they are.
+func convertLines(value interface{}) bson.A {
+	lines, _ := value.(bson.A)
+	converted := make(bson.A, 0, len(lines))
+	for _, line := range lines {
+		item, ok := line.(bson.M)
+		if ok {
+			if _, legacy := toFloat(item["price"]); legacy {
+				item["price"] = toMoney(item["price"])
+			}
+		}
+		converted = append(converted, item)
+	}
+	return converted
+}
+
+// priceAmount is the minor units of a converted line price, which is the
+// Money set by convertLines or a document converted by an earlier run.
+func priceAmount(value interface{}) int64 {
+	switch price := value.(type) {
+	case models.Money:
+		return price.Amount
+	case bson.M:
+		amount, _ := toFloat(price["amount"])
+		return int64(amount)
+	}
+	return 0
+}
+
+func toMoney(value interface{}) models.Money {
+	amount, _ := toFloat(value)
+	return models.MoneyFromFloat(amount, Currency)
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch n := value.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func toInt(value interface{}) (int, bool) {
+	n, ok := toFloat(value)
+	return int(n), ok
+}
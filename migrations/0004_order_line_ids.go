@@ -0,0 +1,52 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/mauroarnedo/ecommerce/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// addOrderLineIDs gives every order line without one a line id, and points
+// the refund lines recorded before line ids existed at the first line of
+// their product.
+func addOrderLineIDs(ctx context.Context, db *mongo.Database) error {
+	orders := database.OrderData(db, "orders")
+
+	filter := bson.M{"order_list": bson.M{"$elemMatch": bson.M{"line_id": bson.M{"$exists": false}}}}
+	return convertDocuments(ctx, orders, filter, func(doc bson.M) bson.M {
+		lines, _ := doc["order_list"].(bson.A)
+		byProduct := make(map[interface{}]interface{})
+		for _, line := range lines {
+			item, ok := line.(bson.M)
+			if !ok {
+				continue
+			}
+			if _, ok = item["line_id"]; !ok {
+				item["line_id"] = primitive.NewObjectID()
+			}
+			if _, seen := byProduct[item["_id"]]; !seen {
+				byProduct[item["_id"]] = item["line_id"]
+			}
+		}
+
+		refunds, _ := doc["refunds"].(bson.A)
+		for _, refund := range refunds {
+			entry, _ := refund.(bson.M)
+			refundLines, _ := entry["lines"].(bson.A)
+			for _, line := range refundLines {
+				item, ok := line.(bson.M)
+				if _, done := item["line_id"]; ok && !done {
+					item["line_id"] = byProduct[item["product_id"]]
+				}
+			}
+		}
+		set := bson.M{"order_list": lines}
+		if refunds != nil {
+			set["refunds"] = refunds
+		}
+		return set
+	})
+}
@@ -0,0 +1,57 @@
+package migrations
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Migration changes stored data from one schema to the next. Up must be safe
+// to run again after a partial failure, since it is only recorded as applied
+// once it returns nil.
+type Migration struct {
+	ID          string
+	Description string
+	Up          func(ctx context.Context, db *mongo.Database) error
+}
+
+// All lists every migration in the order it is applied.
+var All = []Migration{
+	{ID: "0001_orders_collection", Description: "move orders embedded in users into the orders collection", Up: moveEmbeddedOrders},
+	{ID: "0002_cart_quantities", Description: "merge duplicate cart entries into lines with a quantity", Up: mergeCartLines},
+	{ID: "0003_money", Description: "convert float prices and int order totals to exact money amounts", Up: convertPrices},
+	{ID: "0004_order_line_ids", Description: "give order lines stable ids for refunds and returns", Up: addOrderLineIDs},
+}
+
+type record struct {
+	ID         string    `bson:"_id"`
+	Applied_At time.Time `bson:"applied_at"`
+}
+
+// Run applies the migrations of All that are not recorded in the
+// schema_migrations collection yet and returns the ids it applied.
+func Run(ctx context.Context, db *mongo.Database) ([]string, error) {
+	history := db.Collection("schema_migrations")
+	var applied []string
+	for _, migration := range All {
+		count, err := history.CountDocuments(ctx, bson.M{"_id": migration.ID})
+		if err != nil {
+			return applied, err
+		}
+		if count > 0 {
+			continue
+		}
+		log.Printf("applying %s: %s", migration.ID, migration.Description)
+		if err = migration.Up(ctx, db); err != nil {
+			return applied, err
+		}
+		if _, err = history.InsertOne(ctx, record{ID: migration.ID, Applied_At: time.Now()}); err != nil {
+			return applied, err
+		}
+		applied = append(applied, migration.ID)
+	}
+	return applied, nil
+}
@@ -0,0 +1,115 @@
+package migrations
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mauroarnedo/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// testDatabase connects to the server in MONGO_TEST_URI and returns a fresh
+// database that is dropped when the test ends. Tests are skipped without it.
+func testDatabase(t *testing.T) *mongo.Database {
+	t.Helper()
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGO_TEST_URI is not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.Ping(ctx, nil); err != nil {
+		t.Skipf("mongodb is not reachable: %v", err)
+	}
+	db := client.Database("ecommerce_test_" + primitive.NewObjectID().Hex())
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := db.Drop(ctx); err != nil {
+			t.Log(err)
+		}
+		if err := client.Disconnect(ctx); err != nil {
+			t.Log(err)
+		}
+	})
+	return db
+}
+
+// TestRunConvertsLegacyDocuments seeds a user the way the store wrote them
+// before any migration: orders embedded in the user with float prices and
+// an int total, and a cart holding one entry per unit.
+func TestRunConvertsLegacyDocuments(t *testing.T) {
+	db := testDatabase(t)
+	ctx := context.Background()
+
+	userID := primitive.NewObjectID()
+	productID := primitive.NewObjectID()
+	orderID := primitive.NewObjectID()
+	line := bson.M{"_id": productID, "product_name": "mug", "price": 12.5}
+	user := bson.M{
+		"_id":       userID,
+		"user_id":   userID.Hex(),
+		"user_cart": bson.A{line, line, bson.M{"_id": primitive.NewObjectID(), "product_name": "pen", "price": int32(3)}},
+		"orders": bson.A{bson.M{
+			"_id":         orderID,
+			"order_list":  bson.A{line, line},
+			"ordered_at":  time.Now(),
+			"total_price": int32(25),
+		}},
+	}
+	if _, err := db.Collection("users").InsertOne(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	applied, err := Run(ctx, db)
+	if err != nil {
+		t.Fatalf("Run after %v: %v", applied, err)
+	}
+	if len(applied) != len(All) {
+		t.Fatalf("applied %v, want every migration", applied)
+	}
+
+	var order models.Order
+	if err = db.Collection("orders").FindOne(ctx, bson.M{"_id": orderID}).Decode(&order); err != nil {
+		t.Fatal(err)
+	}
+	if order.User_ID != userID.Hex() || order.Status != models.OrderPending {
+		t.Errorf("order user %q status %q, want %q pending", order.User_ID, order.Status, userID.Hex())
+	}
+	if order.Price != models.NewMoney(2500, Currency) {
+		t.Errorf("order total = %v, want 25.00 %s", order.Price, Currency)
+	}
+	for _, item := range order.Order_Cart {
+		if item.Price == nil || *item.Price != models.NewMoney(1250, Currency) || item.Quantity != 1 || item.Line_ID.IsZero() {
+			t.Errorf("order line = %+v, want one unit at 12.50 with a line id", item)
+		}
+	}
+
+	var migrated models.User
+	if err = db.Collection("users").FindOne(ctx, bson.M{"_id": userID}).Decode(&migrated); err != nil {
+		t.Fatal(err)
+	}
+	if len(migrated.User_Cart) != 2 {
+		t.Fatalf("cart = %+v, want the mug entries merged into one line", migrated.User_Cart)
+	}
+	mug, pen := migrated.User_Cart[0], migrated.User_Cart[1]
+	if mug.Quantity != 2 || mug.Price == nil || *mug.Price != models.NewMoney(1250, Currency) {
+		t.Errorf("mug line = %+v, want 2 units at 12.50", mug)
+	}
+	if pen.Quantity != 1 || pen.Price == nil || *pen.Price != models.NewMoney(300, Currency) {
+		t.Errorf("pen line = %+v, want 1 unit at 3.00", pen)
+	}
+
+	if applied, err = Run(ctx, db); err != nil || len(applied) != 0 {
+		t.Errorf("second Run applied %v, %v, want nothing", applied, err)
+	}
+}
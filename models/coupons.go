@@ -0,0 +1,87 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Coupon types. The store charges no shipping itself, so a free shipping
+// coupon takes nothing off the total; the order records it for whoever
+// ships it.
+const (
+	CouponPercentage   = "percentage"
+	CouponFixed        = "fixed"
+	CouponFreeShipping = "free_shipping"
+)
+
+// Coupon is a promotion code. Product_IDs and Categories scope it to the
+// matching cart lines, both empty means every line. Zero limits and times
+// do not restrict it.
+type Coupon struct {
+	ID   primitive.ObjectID `json:"_id" bson:"_id"`
+	Code string             `json:"code" bson:"code"`
+	Type string             `json:"type" bson:"type"`
+	// Basis_Points is the discount of a percentage coupon in hundredths of
+	// a percent, 1500 is 15%.
+	Basis_Points int64  `json:"basis_points,omitempty" bson:"basis_points,omitempty"`
+	Amount       *Money `json:"amount,omitempty" bson:"amount,omitempty"`
+	// Min_Total is the cart value, before any discount, the coupon needs.
+	Min_Total         *Money               `json:"min_total,omitempty" bson:"min_total,omitempty"`
+	Product_IDs       []primitive.ObjectID `json:"product_ids,omitempty" bson:"product_ids,omitempty"`
+	Categories        []string             `json:"categories,omitempty" bson:"categories,omitempty"`
+	Max_Uses          int                  `json:"max_uses" bson:"max_uses"`
+	Max_Uses_Per_User int                  `json:"max_uses_per_user" bson:"max_uses_per_user"`
+	Uses              int                  `json:"uses" bson:"uses"`
+	Starts_At         time.Time            `json:"starts_at,omitempty" bson:"starts_at,omitempty"`
+	Ends_At           time.Time            `json:"ends_at,omitempty" bson:"ends_at,omitempty"`
+	Active            bool                 `json:"active" bson:"active"`
+	Created_At        time.Time            `json:"created_at" bson:"created_at"`
+	Updated_At        time.Time            `json:"updated_at" bson:"updated_at"`
+}
+
+// AppliedCoupon is the coupon an order was placed with.
+type AppliedCoupon struct {
+	Coupon_ID     primitive.ObjectID `json:"coupon_id" bson:"coupon_id"`
+	Code          string             `json:"code" bson:"code"`
+	Type          string             `json:"type" bson:"type"`
+	Free_Shipping bool               `json:"free_shipping,omitempty" bson:"free_shipping,omitempty"`
+}
+
+// NormalizeCouponCode makes codes case insensitive.
+func NormalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// ValidAt reports whether the coupon is active and inside its window.
+func (c *Coupon) ValidAt(now time.Time) bool {
+	if !c.Active {
+		return false
+	}
+	if !c.Starts_At.IsZero() && now.Before(c.Starts_At) {
+		return false
+	}
+	return c.Ends_At.IsZero() || now.Before(c.Ends_At)
+}
+
+// Covers reports whether the coupon discounts the cart line.
+func (c *Coupon) Covers(item ProductUser) bool {
+	if len(c.Product_IDs) == 0 && len(c.Categories) == 0 {
+		return true
+	}
+	for _, id := range c.Product_IDs {
+		if id == item.Product_ID {
+			return true
+		}
+	}
+	if item.Category == nil {
+		return false
+	}
+	for _, category := range c.Categories {
+		if strings.EqualFold(category, *item.Category) {
+			return true
+		}
+	}
+	return false
+}
@@ -6,41 +6,73 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+const (
+	RoleAdmin    = "ADMIN"
+	RoleCustomer = "CUSTOMER"
+)
+
 type User struct {
 	ID              primitive.ObjectID `json:"_id" bson:"_id"`
 	First_Name      *string            `json:"first_name" validate:"required,min=3,max=20"`
 	Last_Name       *string            `json:"last_name" validate:"required,min=3,max=20"`
 	Email           *string            `json:"email" validate:"email,required"`
 	Phone           *string            `json:"phone" validate:"required"`
+	Email_Verified  bool               `json:"email_verified" bson:"email_verified"`
+	Phone_Verified  bool               `json:"phone_verified" bson:"phone_verified"`
 	Password        *string            `json:"password" validate:"required,min=6"`
 	Token           *string            `json:"token"`
 	Refresh_Token   *string            `json:"refresh_token"`
+	Role            string             `json:"role" bson:"role"`
+	TOTP_Enabled    bool               `json:"totp_enabled" bson:"totp_enabled"`
+	TOTP_Secret     string             `json:"-" bson:"totp_secret"`
+	TOTP_Pending    string             `json:"-" bson:"totp_pending"`
+	TOTP_Last_Step  int64              `json:"-" bson:"totp_last_step"`
+	Recovery_Codes  []string           `json:"-" bson:"recovery_codes"`
 	Created_At      time.Time          `json:"created_at"`
 	Updated_At      time.Time          `json:"updated_at"`
 	User_ID         string             `json:"user_id"`
 	User_Cart       []ProductUser      `json:"user_cart" bson:"user_cart"`
 	User_Favorites  []ProductUser      `json:"user_favorites" bson:"user_favorites"`
 	Address_Details []Address          `json:"address" bson:"address"`
-	Order_Status    []Order            `json:"orders" bson:"orders"`
+	// Cart_Coupon is the code applied to the cart, used by its checkout.
+	Cart_Coupon string `json:"cart_coupon,omitempty" bson:"cart_coupon,omitempty"`
+	// Store_Credit is the balance given back by returns resolved as credit.
+	Store_Credit *Money `json:"store_credit,omitempty" bson:"store_credit,omitempty"`
+	// Bootstrap_Admin marks the admin created with the bootstrap token. A
+	// unique index on it lets only one such admin ever be created.
+	Bootstrap_Admin bool `json:"-" bson:"bootstrap_admin,omitempty"`
 }
 
 type Product struct {
 	Product_ID   primitive.ObjectID `bson:"_id"`
 	Product_Name *string            `json:"product_name"`
-	Price        *float64           `json:"price"`
+	Price        *Money             `json:"price"`
 	Rating       *float32           `json:"rating"`
 	Description  *string            `json:"description"`
 	Image        *string            `json:"image"`
-	Comments     []Comment          `bson:"product_comments" json:"product_comments"`
+	Category     *string            `json:"category" bson:"category,omitempty"`
+	// Stock is the number of units left to sell, nil when the product does
+	// not track its stock.
+	Stock    *int      `json:"stock" bson:"stock,omitempty"`
+	Comments []Comment `bson:"product_comments" json:"product_comments"`
 }
 
 type ProductUser struct {
 	Product_ID   primitive.ObjectID `bson:"_id"`
 	Product_Name *string            `json:"product_name" bson:"product_name"`
-	Price        *float64           `json:"price" bson:"price"`
+	Price        *Money             `json:"price" bson:"price"`
 	Rating       *float32           `json:"rating" bson:"rating"`
 	Description  *string            `json:"description" bson:"description"`
 	Image        *string            `json:"image" bson:"image"`
+	Category     *string            `json:"category,omitempty" bson:"category,omitempty"`
+	// Quantity is set on cart and order lines; favorites leave it empty.
+	Quantity int `json:"quantity,omitempty" bson:"quantity,omitempty"`
+	// Line_ID identifies an order line for refunds and returns. Cart and
+	// favorite lines have none.
+	Line_ID primitive.ObjectID `json:"line_id,omitempty" bson:"line_id,omitempty"`
+	// Discount is the share of the order's coupon discount taken off this
+	// order line.
+	Discount *Money `json:"discount,omitempty" bson:"discount,omitempty"`
 }
 
 type Address struct {
@@ -51,13 +83,21 @@ type Address struct {
 	Pin_Code   *string            `json:"pin_code" bson:"pin_code"`
 }
 
+// Order is a placed cart. Price is what the customer pays, net of the
+// Discount of the Coupon it was placed with.
 type Order struct {
-	Order_ID       primitive.ObjectID `bson:"_id"`
+	Order_ID       primitive.ObjectID `json:"_id" bson:"_id"`
+	User_ID        string             `json:"user_id" bson:"user_id"`
 	Order_Cart     []ProductUser      `json:"order_list" bson:"order_list"`
 	Ordered_At     time.Time          `json:"ordered_at" bson:"ordered_at"`
-	Price          int                `json:"total_price" bson:"total_price"`
-	Discount       *uint32            `json:"discount" bson:"discount"`
+	Price          Money              `json:"total_price" bson:"total_price"`
+	Discount       *Money             `json:"discount" bson:"discount"`
+	Coupon         *AppliedCoupon     `json:"coupon,omitempty" bson:"coupon,omitempty"`
 	Payment_Method Payment            `json:"payment_method" bson:"payment_method"`
+	Status         string             `json:"status" bson:"status"`
+	History        []StatusChange     `json:"history" bson:"history"`
+	Refunds        []Refund           `json:"refunds,omitempty" bson:"refunds,omitempty"`
+	Updated_At     time.Time          `json:"updated_at" bson:"updated_at"`
 }
 
 type Payment struct {
@@ -66,8 +106,8 @@ type Payment struct {
 }
 
 type Comment struct {
-	User       User      `bson:"user" json:"user"`
-	Comment    *string   `bson:"comment" json:"comment"`
-	Created_At time.Time `json:"created_at"`
-	Updated_At time.Time `json:"updated_at"`
+	User       PublicUser `bson:"user" json:"user"`
+	Comment    *string    `bson:"comment" json:"comment"`
+	Created_At time.Time  `json:"created_at"`
+	Updated_At time.Time  `json:"updated_at"`
 }
@@ -0,0 +1,145 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrCurrencyMismatch = errors.New("amounts are in different currencies")
+	ErrInvalidAmount    = errors.New("amount is not a valid decimal for its currency")
+)
+
+// Money is an exact amount in the minor unit of an ISO 4217 currency, for
+// example cents for USD. It is stored as an integer so sums never drift.
+type Money struct {
+	Amount   int64  `json:"amount" bson:"amount"`
+	Currency string `json:"currency" bson:"currency"`
+}
+
+// currencyExponents lists the currencies whose minor unit is not a
+// hundredth of the major unit.
+var currencyExponents = map[string]int{
+	"BHD": 3, "CLP": 0, "ISK": 0, "JOD": 3, "JPY": 0, "KRW": 0,
+	"KWD": 3, "OMR": 3, "PYG": 0, "TND": 3, "UGX": 0, "VND": 0,
+}
+
+// CurrencyExponent is the number of decimals of the currency's minor unit.
+func CurrencyExponent(currency string) int {
+	if exponent, ok := currencyExponents[currency]; ok {
+		return exponent
+	}
+	return 2
+}
+
+// IsCurrency reports whether code looks like an ISO 4217 code.
+func IsCurrency(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, r := range code {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+func NewMoney(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: currency}
+}
+
+// MoneyFromFloat converts a legacy float price, rounding half away from
+// zero to the minor unit. Only used to migrate old documents.
+func MoneyFromFloat(amount float64, currency string) Money {
+	scale := math.Pow10(CurrencyExponent(currency))
+	return Money{Amount: int64(math.Round(amount * scale)), Currency: currency}
+}
+
+// ParseMoney reads a decimal such as "19.99" without going through a
+// float. It rejects more decimals than the currency has.
+func ParseMoney(value string, currency string) (Money, error) {
+	exponent := CurrencyExponent(currency)
+	negative := strings.HasPrefix(value, "-")
+	value = strings.TrimPrefix(value, "-")
+	whole, fraction, _ := strings.Cut(value, ".")
+	if whole == "" || len(fraction) > exponent {
+		return Money{}, ErrInvalidAmount
+	}
+	fraction += strings.Repeat("0", exponent-len(fraction))
+	amount, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil || amount < 0 {
+		return Money{}, ErrInvalidAmount
+	}
+	if negative {
+		amount = -amount
+	}
+	return Money{Amount: amount, Currency: currency}, nil
+}
+
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+// Add sums two amounts of the same currency. The zero Money takes the
+// currency of the other operand, so it can start a sum.
+func (m Money) Add(other Money) (Money, error) {
+	if m.Currency == "" {
+		m.Currency = other.Currency
+	}
+	if other.Currency != "" && other.Currency != m.Currency {
+		return Money{}, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, other.Currency)
+	}
+	m.Amount += other.Amount
+	return m, nil
+}
+
+func (m Money) Sub(other Money) (Money, error) {
+	other.Amount = -other.Amount
+	return m.Add(other)
+}
+
+func (m Money) Mul(quantity int) Money {
+	m.Amount *= int64(quantity)
+	return m
+}
+
+// Percent returns basisPoints hundredths of a percent of m, for discounts
+// and taxes. Half a minor unit is rounded to the even neighbour, so
+// rounding errors do not pile up in one direction over many orders.
+func (m Money) Percent(basisPoints int64) Money {
+	product := m.Amount * basisPoints
+	quotient, remainder := product/10000, product%10000
+	if remainder < 0 {
+		remainder = -remainder
+	}
+	if remainder > 5000 || remainder == 5000 && quotient%2 != 0 {
+		if product < 0 {
+			quotient--
+		} else {
+			quotient++
+		}
+	}
+	m.Amount = quotient
+	return m
+}
+
+// String formats m as a decimal followed by its currency, e.g. 19.99 USD.
+func (m Money) String() string {
+	exponent := CurrencyExponent(m.Currency)
+	sign, amount := "", m.Amount
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	digits := strconv.FormatInt(amount, 10)
+	if exponent > 0 {
+		if len(digits) <= exponent {
+			digits = strings.Repeat("0", exponent+1-len(digits)) + digits
+		}
+		digits = digits[:len(digits)-exponent] + "." + digits[len(digits)-exponent:]
+	}
+	return strings.TrimSpace(sign + digits + " " + m.Currency)
+}
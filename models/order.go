@@ -0,0 +1,100 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Order statuses. A new order is pending; OrderTransitions lists where each
+// status may move next.
+const (
+	OrderPending   = "pending"
+	OrderPaid      = "paid"
+	OrderFulfilled = "fulfilled"
+	OrderShipped   = "shipped"
+	OrderDelivered = "delivered"
+	OrderCancelled = "cancelled"
+	OrderRefunded  = "refunded"
+)
+
+var ErrIllegalTransition = errors.New("illegal order status transition")
+
+var OrderTransitions = map[string][]string{
+	OrderPending:   {OrderPaid, OrderCancelled},
+	OrderPaid:      {OrderFulfilled, OrderCancelled, OrderRefunded},
+	OrderFulfilled: {OrderShipped, OrderCancelled, OrderRefunded},
+	OrderShipped:   {OrderDelivered},
+	OrderDelivered: {OrderRefunded},
+	OrderCancelled: {},
+	OrderRefunded:  {},
+}
+
+// StatusChange is one entry of Order.History. Actor is the user id of whoever
+// made the change, or the name of the process that did.
+type StatusChange struct {
+	From  string    `json:"from" bson:"from"`
+	To    string    `json:"to" bson:"to"`
+	Actor string    `json:"actor" bson:"actor"`
+	Note  string    `json:"note,omitempty" bson:"note,omitempty"`
+	At    time.Time `json:"at" bson:"at"`
+}
+
+// Refund statuses. A refund is recorded as pending before the money moves,
+// so two refunds of the same lines cannot both start; a failed one no longer
+// counts against what is left to refund.
+const (
+	RefundPending   = "pending"
+	RefundSucceeded = "succeeded"
+	RefundFailed    = "failed"
+)
+
+// Refund gives back money of an order. Lines is empty for refunds that are
+// only an amount, such as those made at the payment provider. Provider_Ref
+// is the provider's id of the refund of a digital payment; cash on delivery
+// refunds are settled outside the store. Method is empty for refunds to the
+// payment made before store credit existed.
+type Refund struct {
+	ID           primitive.ObjectID `json:"_id" bson:"_id"`
+	Lines        []RefundLine       `json:"lines,omitempty" bson:"lines,omitempty"`
+	Amount       Money              `json:"amount" bson:"amount"`
+	Reason       string             `json:"reason,omitempty" bson:"reason,omitempty"`
+	Actor        string             `json:"actor" bson:"actor"`
+	Status       string             `json:"status" bson:"status"`
+	Method       string             `json:"method,omitempty" bson:"method,omitempty"`
+	Provider_Ref string             `json:"provider_ref,omitempty" bson:"provider_ref,omitempty"`
+	Failure      string             `json:"failure,omitempty" bson:"failure,omitempty"`
+	Created_At   time.Time          `json:"created_at" bson:"created_at"`
+}
+
+type RefundLine struct {
+	Line_ID    primitive.ObjectID `json:"line_id" bson:"line_id"`
+	Product_ID primitive.ObjectID `json:"product_id" bson:"product_id"`
+	Quantity   int                `json:"quantity" bson:"quantity"`
+	Amount     Money              `json:"amount" bson:"amount"`
+}
+
+func IsOrderStatus(status string) bool {
+	_, ok := OrderTransitions[status]
+	return ok
+}
+
+func CanTransition(from string, to string) bool {
+	for _, next := range OrderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// WasPaid reports whether the order was ever marked paid.
+func (o *Order) WasPaid() bool {
+	for _, change := range o.History {
+		if change.To == OrderPaid {
+			return true
+		}
+	}
+	return false
+}
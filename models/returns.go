@@ -0,0 +1,87 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Return statuses. A customer requests a return, an admin approves or
+// rejects it, records the goods that came back and resolves it with a
+// refund or store credit.
+const (
+	ReturnRequested = "requested"
+	ReturnApproved  = "approved"
+	ReturnRejected  = "rejected"
+	ReturnReceived  = "received"
+	ReturnRefunded  = "refunded"
+	ReturnCredited  = "credited"
+)
+
+var ErrIllegalReturnTransition = errors.New("illegal return status transition")
+
+var ReturnTransitions = map[string][]string{
+	ReturnRequested: {ReturnApproved, ReturnRejected},
+	ReturnApproved:  {ReturnReceived, ReturnRejected},
+	ReturnReceived:  {ReturnRefunded, ReturnCredited},
+	ReturnRejected:  {},
+	ReturnRefunded:  {},
+	ReturnCredited:  {},
+}
+
+// Refund methods. A refund goes back to the payment of the order unless it
+// is given as store credit.
+const (
+	RefundToPayment     = "payment"
+	RefundToStoreCredit = "store_credit"
+)
+
+// ReturnRequest asks to send back units of a delivered order. History uses
+// the return statuses; Refund_ID is the order refund that resolved it.
+type ReturnRequest struct {
+	ID         primitive.ObjectID `json:"_id" bson:"_id"`
+	Order_ID   primitive.ObjectID `json:"order_id" bson:"order_id"`
+	User_ID    string             `json:"user_id" bson:"user_id"`
+	Lines      []ReturnLine       `json:"lines" bson:"lines"`
+	Reason     string             `json:"reason" bson:"reason"`
+	Status     string             `json:"status" bson:"status"`
+	Refund_ID  primitive.ObjectID `json:"refund_id,omitempty" bson:"refund_id,omitempty"`
+	History    []StatusChange     `json:"history" bson:"history"`
+	Created_At time.Time          `json:"created_at" bson:"created_at"`
+	Updated_At time.Time          `json:"updated_at" bson:"updated_at"`
+}
+
+// ReturnLine is one order line of a return. Received counts the units that
+// arrived back, Restocked whether they went back on the shelf.
+type ReturnLine struct {
+	Line_ID    primitive.ObjectID `json:"line_id" bson:"line_id"`
+	Product_ID primitive.ObjectID `json:"product_id" bson:"product_id"`
+	Quantity   int                `json:"quantity" bson:"quantity"`
+	Received   int                `json:"received" bson:"received"`
+	Restocked  bool               `json:"restocked" bson:"restocked"`
+}
+
+func CanReturnTransition(from string, to string) bool {
+	for _, next := range ReturnTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Open reports whether the return still holds units that may be refunded.
+func (r *ReturnRequest) Open() bool {
+	return r.Status == ReturnRequested || r.Status == ReturnApproved || r.Status == ReturnReceived
+}
+
+// DeliveredAt is when the order was delivered, zero if it never was.
+func (o *Order) DeliveredAt() time.Time {
+	for _, change := range o.History {
+		if change.To == OrderDelivered {
+			return change.At
+		}
+	}
+	return time.Time{}
+}
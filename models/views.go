@@ -0,0 +1,73 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The types below are what the API returns for users. Handlers never
+// serialize User itself, since it carries the password hash and the stored
+// tokens.
+
+type PublicUser struct {
+	ID         primitive.ObjectID `json:"_id" bson:"_id"`
+	First_Name *string            `json:"first_name" bson:"first_name"`
+	Last_Name  *string            `json:"last_name" bson:"last_name"`
+}
+
+type UserProfile struct {
+	ID              primitive.ObjectID `json:"_id" bson:"_id"`
+	User_ID         string             `json:"user_id" bson:"user_id"`
+	First_Name      *string            `json:"first_name" bson:"first_name"`
+	Last_Name       *string            `json:"last_name" bson:"last_name"`
+	Email           *string            `json:"email" bson:"email"`
+	Phone           *string            `json:"phone" bson:"phone"`
+	Email_Verified  bool               `json:"email_verified" bson:"email_verified"`
+	Phone_Verified  bool               `json:"phone_verified" bson:"phone_verified"`
+	TOTP_Enabled    bool               `json:"totp_enabled" bson:"totp_enabled"`
+	User_Cart       []ProductUser      `json:"user_cart" bson:"user_cart"`
+	User_Favorites  []ProductUser      `json:"user_favorites" bson:"user_favorites"`
+	Address_Details []Address          `json:"address" bson:"address"`
+	Store_Credit    *Money             `json:"store_credit,omitempty" bson:"store_credit,omitempty"`
+}
+
+type AdminUserView struct {
+	ID             primitive.ObjectID `json:"_id" bson:"_id"`
+	User_ID        string             `json:"user_id" bson:"user_id"`
+	First_Name     *string            `json:"first_name" bson:"first_name"`
+	Last_Name      *string            `json:"last_name" bson:"last_name"`
+	Email          *string            `json:"email" bson:"email"`
+	Phone          *string            `json:"phone" bson:"phone"`
+	Role           string             `json:"role" bson:"role"`
+	Email_Verified bool               `json:"email_verified" bson:"email_verified"`
+	Phone_Verified bool               `json:"phone_verified" bson:"phone_verified"`
+	TOTP_Enabled   bool               `json:"totp_enabled" bson:"totp_enabled"`
+	Created_At     time.Time          `json:"created_at" bson:"created_at"`
+	Updated_At     time.Time          `json:"updated_at" bson:"updated_at"`
+}
+
+type AuthResponse struct {
+	Token         string     `json:"token"`
+	Refresh_Token string     `json:"refresh_token"`
+	User          PublicUser `json:"user"`
+	User_ID       string     `json:"user_id"`
+	Role          string     `json:"role"`
+}
+
+type OrderList struct {
+	Orders []Order `json:"orders"`
+	Total  int64   `json:"total"`
+	Page   int64   `json:"page"`
+	Limit  int64   `json:"limit"`
+}
+
+// CartList is the cart with its total. With a coupon applied, Discount is
+// what it would take off at checkout, or Coupon_Error why it would not.
+type CartList struct {
+	Items        []ProductUser `json:"items"`
+	Total        Money         `json:"total"`
+	Coupon       string        `json:"coupon,omitempty"`
+	Discount     *Money        `json:"discount,omitempty"`
+	Coupon_Error string        `json:"coupon_error,omitempty"`
+}
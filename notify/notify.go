@@ -0,0 +1,64 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	ChannelEmail = "email"
+	ChannelSMS   = "sms"
+)
+
+type Message struct {
+	Channel string    `json:"channel"`
+	To      string    `json:"to"`
+	Subject string    `json:"subject"`
+	Body    string    `json:"body"`
+	Sent_At time.Time `json:"sent_at"`
+}
+
+// Notifier delivers messages to users. Production deployments plug in a
+// mail or SMS gateway; LogNotifier and FileNotifier work offline.
+type Notifier interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+type LogNotifier struct{}
+
+func (LogNotifier) Send(ctx context.Context, msg Message) error {
+	log.Printf("notify: %s to %s: %s\n%s", msg.Channel, msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// FileNotifier appends every message as a JSON line to Path.
+type FileNotifier struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (n *FileNotifier) Send(ctx context.Context, msg Message) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	f, err := os.OpenFile(n.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	msg.Sent_At = time.Now()
+	return json.NewEncoder(f).Encode(msg)
+}
+
+// New returns a FileNotifier when path is set and a LogNotifier otherwise.
+func New(path string) Notifier {
+	if path != "" {
+		return &FileNotifier{Path: path}
+	}
+	return LogNotifier{}
+}
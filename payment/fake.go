@@ -0,0 +1,127 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/mauroarnedo/ecommerce/models"
+)
+
+var ErrProcessing = errors.New("fake provider: processing error")
+
+// Test cards understood by FakeProvider. Any other token is declined with
+// "unsupported_card", so a typo never looks like a successful payment.
+const (
+	CardApproved          = "4242424242424242"
+	CardDeclined          = "4000000000000002"
+	CardInsufficientFunds = "4000000000009995"
+	CardExpired           = "4000000000000069"
+	CardProcessingError   = "4000000000000119"
+	CardCaptureFails      = "4000000000000341"
+)
+
+var fakeDeclines = map[string]string{
+	CardDeclined:          "card_declined",
+	CardInsufficientFunds: "insufficient_funds",
+	CardExpired:           "expired_card",
+}
+
+type fakePayment struct {
+	token      string
+	authorized models.Money
+	captured   models.Money
+	refunded   models.Money
+	voided     bool
+}
+
+// FakeProvider is an in-memory provider for local development and tests.
+// Its behaviour depends only on the card token, see the Card constants.
+type FakeProvider struct {
+	mu       sync.Mutex
+	payments map[string]*fakePayment
+	refunds  int
+}
+
+func NewFakeProvider() *FakeProvider {
+	return &FakeProvider{payments: make(map[string]*fakePayment)}
+}
+
+func (p *FakeProvider) Name() string {
+	return "fake"
+}
+
+func (p *FakeProvider) Authorize(ctx context.Context, reference string, amount models.Money, token string) (Authorization, error) {
+	if token == CardProcessingError {
+		return Authorization{}, ErrProcessing
+	}
+	if code, ok := fakeDeclines[token]; ok {
+		return Authorization{Decline_Code: code}, nil
+	}
+	if token != CardApproved && token != CardCaptureFails {
+		return Authorization{Decline_Code: "unsupported_card"}, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	providerRef := "fake_" + reference
+	p.payments[providerRef] = &fakePayment{token: token, authorized: amount}
+	return Authorization{Reference: providerRef, Approved: true}, nil
+}
+
+func (p *FakeProvider) Capture(ctx context.Context, providerRef string, amount models.Money) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	payment, ok := p.payments[providerRef]
+	if !ok {
+		return ErrUnknownReference
+	}
+	if payment.voided || !payment.captured.IsZero() {
+		return ErrNotCapturable
+	}
+	if payment.token == CardCaptureFails {
+		return ErrProcessing
+	}
+	if amount.Currency != payment.authorized.Currency || amount.Amount > payment.authorized.Amount {
+		return ErrAmountTooLarge
+	}
+	payment.captured = amount
+	return nil
+}
+
+func (p *FakeProvider) Void(ctx context.Context, providerRef string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	payment, ok := p.payments[providerRef]
+	if !ok {
+		return ErrUnknownReference
+	}
+	if !payment.captured.IsZero() {
+		return ErrNotVoidable
+	}
+	payment.voided = true
+	return nil
+}
+
+func (p *FakeProvider) Refund(ctx context.Context, providerRef string, amount models.Money) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	payment, ok := p.payments[providerRef]
+	if !ok {
+		return "", ErrUnknownReference
+	}
+	if payment.captured.IsZero() {
+		return "", ErrNotRefundable
+	}
+	refunded, err := payment.refunded.Add(amount)
+	if err != nil {
+		return "", err
+	}
+	if refunded.Amount > payment.captured.Amount {
+		return "", fmt.Errorf("%w: %s left to refund", ErrAmountTooLarge, models.NewMoney(payment.captured.Amount-payment.refunded.Amount, payment.captured.Currency))
+	}
+	payment.refunded = refunded
+	p.refunds++
+	return fmt.Sprintf("%s_re_%d", providerRef, p.refunds), nil
+}
@@ -0,0 +1,54 @@
+// Package payment abstracts the card processor behind the digital payment
+// method. Orders paid cash on delivery never reach a provider.
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/mauroarnedo/ecommerce/models"
+)
+
+var (
+	ErrUnknownReference = errors.New("the provider does not know this payment")
+	ErrAmountTooLarge   = errors.New("amount exceeds what the payment allows")
+	ErrNotCapturable    = errors.New("the payment cannot be captured in its current state")
+	ErrNotVoidable      = errors.New("the payment cannot be voided in its current state")
+	ErrNotRefundable    = errors.New("the payment cannot be refunded in its current state")
+)
+
+// Authorization is the provider's answer to an authorization request. A
+// declined card is not an error: Approved is false and Decline_Code says
+// why, in the provider's own words.
+type Authorization struct {
+	Reference    string
+	Approved     bool
+	Decline_Code string
+}
+
+// Provider moves money for orders paid digitally. Authorize puts a hold on
+// the amount, Capture takes up to the held amount, Void drops a hold that
+// was not captured and Refund gives back part or all of a capture, returning
+// the provider's id of the refund. An error
+// means the provider could not be reached or failed, so the outcome is
+// unknown to the caller.
+type Provider interface {
+	Name() string
+	Authorize(ctx context.Context, reference string, amount models.Money, token string) (Authorization, error)
+	Capture(ctx context.Context, providerRef string, amount models.Money) error
+	Void(ctx context.Context, providerRef string) error
+	Refund(ctx context.Context, providerRef string, amount models.Money) (string, error)
+}
+
+// New returns the provider configured by name. An empty name disables
+// digital payments and returns nil.
+func New(name string) (Provider, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case "fake":
+		return NewFakeProvider(), nil
+	}
+	return nil, fmt.Errorf("unknown payment provider %q", name)
+}
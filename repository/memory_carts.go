@@ -0,0 +1,132 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/mauroarnedo/ecommerce/database"
+	"github.com/mauroarnedo/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type MemoryCartRepository struct {
+	products *MemoryProductRepository
+	users    *MemoryUserRepository
+}
+
+func NewMemoryCartRepository(products *MemoryProductRepository, users *MemoryUserRepository) *MemoryCartRepository {
+	return &MemoryCartRepository{products: products, users: users}
+}
+
+func (r *MemoryCartRepository) Add(ctx context.Context, userID string, productID primitive.ObjectID, quantity int) error {
+	product, err := r.products.FindByID(ctx, productID)
+	if err != nil {
+		return database.ErrCantFindProduct
+	}
+	limit, limitErr := database.CartLimit(product)
+	var addErr error
+	err = r.users.set(userID, func(user *models.User) {
+		for i := range user.User_Cart {
+			if user.User_Cart[i].Product_ID == productID {
+				if user.User_Cart[i].Quantity+quantity > limit {
+					addErr = limitErr
+					return
+				}
+				user.User_Cart[i].Quantity += quantity
+				return
+			}
+		}
+		if quantity > limit {
+			addErr = limitErr
+			return
+		}
+		user.User_Cart = append(user.User_Cart, database.CartLine(product, quantity))
+	})
+	if err != nil {
+		return err
+	}
+	return addErr
+}
+
+func (r *MemoryCartRepository) SetQuantity(ctx context.Context, userID string, productID primitive.ObjectID, quantity int) error {
+	product, err := r.products.FindByID(ctx, productID)
+	if err != nil {
+		return database.ErrCantFindProduct
+	}
+	limit, limitErr := database.CartLimit(product)
+	return r.updateLine(userID, productID, func(current int) (int, error) {
+		if quantity > limit {
+			return 0, limitErr
+		}
+		return quantity, nil
+	})
+}
+
+func (r *MemoryCartRepository) ChangeQuantity(ctx context.Context, userID string, productID primitive.ObjectID, delta int) error {
+	product, err := r.products.FindByID(ctx, productID)
+	if err != nil {
+		return database.ErrCantFindProduct
+	}
+	limit, limitErr := database.CartLimit(product)
+	return r.updateLine(userID, productID, func(current int) (int, error) {
+		if delta > 0 && current+delta > limit {
+			return 0, limitErr
+		}
+		return current + delta, nil
+	})
+}
+
+// updateLine replaces the quantity of a cart line with the result of fn and
+// removes the line when it drops to zero or below.
+func (r *MemoryCartRepository) updateLine(userID string, productID primitive.ObjectID, fn func(current int) (int, error)) error {
+	lineErr := database.ErrNotInCart
+	err := r.users.set(userID, func(user *models.User) {
+		for i := range user.User_Cart {
+			if user.User_Cart[i].Product_ID != productID {
+				continue
+			}
+			quantity, err := fn(user.User_Cart[i].Quantity)
+			if lineErr = err; err != nil {
+				return
+			}
+			if quantity <= 0 {
+				user.User_Cart = withoutProduct(user.User_Cart, productID)
+			} else {
+				user.User_Cart[i].Quantity = quantity
+			}
+			return
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return lineErr
+}
+
+func (r *MemoryCartRepository) Remove(ctx context.Context, userID string, productID primitive.ObjectID) error {
+	return r.users.set(userID, func(user *models.User) {
+		user.User_Cart = withoutProduct(user.User_Cart, productID)
+	})
+}
+
+func (r *MemoryCartRepository) Items(ctx context.Context, userID string) ([]models.ProductUser, models.Money, error) {
+	user, err := r.users.FindByID(ctx, userID)
+	if err != nil {
+		return nil, models.Money{}, err
+	}
+	total, err := database.CartTotal(user.User_Cart)
+	if err != nil {
+		return nil, models.Money{}, err
+	}
+	return user.User_Cart, total, nil
+}
+
+func (r *MemoryCartRepository) Revalidate(ctx context.Context, userID string) ([]database.CartChange, error) {
+	var changes []database.CartChange
+	err := r.users.set(userID, func(user *models.User) {
+		changes, user.User_Cart = database.CompareCart(user.User_Cart, r.products.current)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
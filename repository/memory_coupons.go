@@ -0,0 +1,114 @@
+package repository
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mauroarnedo/ecommerce/database"
+	"github.com/mauroarnedo/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type couponUser struct {
+	couponID primitive.ObjectID
+	userID   string
+}
+
+type MemoryCouponRepository struct {
+	mu          sync.Mutex
+	coupons     map[string]*models.Coupon
+	redemptions map[couponUser]int
+}
+
+func NewMemoryCouponRepository() *MemoryCouponRepository {
+	return &MemoryCouponRepository{coupons: make(map[string]*models.Coupon), redemptions: make(map[couponUser]int)}
+}
+
+func cloneCoupon(coupon *models.Coupon) *models.Coupon {
+	clone := *coupon
+	clone.Product_IDs = append([]primitive.ObjectID(nil), coupon.Product_IDs...)
+	clone.Categories = append([]string(nil), coupon.Categories...)
+	return &clone
+}
+
+func (r *MemoryCouponRepository) Create(ctx context.Context, coupon *models.Coupon) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.coupons[coupon.Code]; ok {
+		return database.ErrCouponExists
+	}
+	r.coupons[coupon.Code] = cloneCoupon(coupon)
+	return nil
+}
+
+func (r *MemoryCouponRepository) FindByCode(ctx context.Context, code string) (*models.Coupon, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	coupon, ok := r.coupons[models.NormalizeCouponCode(code)]
+	if !ok {
+		return nil, database.ErrCouponNotFound
+	}
+	return cloneCoupon(coupon), nil
+}
+
+func (r *MemoryCouponRepository) List(ctx context.Context) ([]models.Coupon, error) {
+	r.mu.Lock()
+	coupons := make([]models.Coupon, 0, len(r.coupons))
+	for _, coupon := range r.coupons {
+		coupons = append(coupons, *cloneCoupon(coupon))
+	}
+	r.mu.Unlock()
+
+	sort.Slice(coupons, func(i, j int) bool { return coupons[i].Created_At.After(coupons[j].Created_At) })
+	return coupons, nil
+}
+
+func (r *MemoryCouponRepository) SetActive(ctx context.Context, code string, active bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	coupon, ok := r.coupons[models.NormalizeCouponCode(code)]
+	if !ok {
+		return database.ErrCouponNotFound
+	}
+	coupon.Active = active
+	coupon.Updated_At = time.Now()
+	return nil
+}
+
+func (r *MemoryCouponRepository) Redemptions(ctx context.Context, couponID primitive.ObjectID, userID string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.redemptions[couponUser{couponID, userID}], nil
+}
+
+func (r *MemoryCouponRepository) Redeem(ctx context.Context, coupon *models.Coupon, userID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := couponUser{coupon.ID, userID}
+	if coupon.Max_Uses_Per_User > 0 && r.redemptions[key] >= coupon.Max_Uses_Per_User {
+		return database.ErrCouponUserLimit
+	}
+	stored, ok := r.coupons[coupon.Code]
+	if !ok || stored.ID != coupon.ID || !stored.Active || coupon.Max_Uses > 0 && stored.Uses >= coupon.Max_Uses {
+		return database.ErrCouponUsedUp
+	}
+	stored.Uses++
+	r.redemptions[key]++
+	return nil
+}
+
+func (r *MemoryCouponRepository) Release(ctx context.Context, couponID primitive.ObjectID, userID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, coupon := range r.coupons {
+		if coupon.ID == couponID && coupon.Uses > 0 {
+			coupon.Uses--
+		}
+	}
+	if key := (couponUser{couponID, userID}); r.redemptions[key] > 0 {
+		r.redemptions[key]--
+	}
+	return nil
+}
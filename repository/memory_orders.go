@@ -0,0 +1,212 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mauroarnedo/ecommerce/database"
+	"github.com/mauroarnedo/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type MemoryOrderRepository struct {
+	products  *MemoryProductRepository
+	users     *MemoryUserRepository
+	inventory *MemoryInventoryRepository
+
+	mu     sync.Mutex
+	orders map[primitive.ObjectID]*models.Order
+}
+
+func NewMemoryOrderRepository(products *MemoryProductRepository, users *MemoryUserRepository, inventory *MemoryInventoryRepository) *MemoryOrderRepository {
+	return &MemoryOrderRepository{products: products, users: users, inventory: inventory, orders: make(map[primitive.ObjectID]*models.Order)}
+}
+
+func cloneOrder(order *models.Order) *models.Order {
+	clone := *order
+	clone.Order_Cart = append([]models.ProductUser(nil), order.Order_Cart...)
+	clone.History = append([]models.StatusChange(nil), order.History...)
+	clone.Refunds = append([]models.Refund(nil), order.Refunds...)
+	return &clone
+}
+
+func (r *MemoryOrderRepository) insert(order models.Order) *models.Order {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.orders[order.Order_ID] = cloneOrder(&order)
+	return &order
+}
+
+func (r *MemoryOrderRepository) BuyFromCart(ctx context.Context, userID string, payment models.Payment, coupon *models.Coupon) (*models.Order, error) {
+	var items []models.ProductUser
+	claimed, err := r.users.modify(userID, func(user *models.User) bool {
+		if len(user.User_Cart) == 0 {
+			return false
+		}
+		items = user.User_Cart
+		user.User_Cart = make([]models.ProductUser, 0)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return nil, database.ErrCartEmpty
+	}
+
+	restoreCart := func() {
+		if err := r.users.set(userID, func(user *models.User) {
+			user.User_Cart = append(append([]models.ProductUser(nil), items...), user.User_Cart...)
+		}); err != nil {
+			log.Println(err)
+		}
+	}
+	if changes, _ := database.CompareCart(items, r.products.current); len(changes) > 0 {
+		restoreCart()
+		return nil, database.ErrCartChanged
+	}
+	order, err := database.NewOrder(userID, items, payment, coupon)
+	if err != nil {
+		restoreCart()
+		return nil, err
+	}
+
+	reservation := r.inventory.claim(userID)
+	if err = r.products.settleStock(reservation.ReservedLines(), database.StockLines(items)); err != nil {
+		r.inventory.unclaim(reservation)
+		restoreCart()
+		return nil, err
+	}
+	return r.insert(order), nil
+}
+
+func (r *MemoryOrderRepository) InstantBuy(ctx context.Context, userID string, productID primitive.ObjectID, payment models.Payment, coupon *models.Coupon) (*models.Order, error) {
+	product, err := r.products.FindByID(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = r.users.FindByID(ctx, userID); err != nil {
+		return nil, err
+	}
+	line := database.CartLine(product, 1)
+	order, err := database.NewOrder(userID, []models.ProductUser{line}, payment, coupon)
+	if err != nil {
+		return nil, err
+	}
+	if err = r.products.takeStock(database.StockLines([]models.ProductUser{line})); err != nil {
+		return nil, err
+	}
+	return r.insert(order), nil
+}
+
+func (r *MemoryOrderRepository) FindByID(ctx context.Context, orderID primitive.ObjectID) (*models.Order, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	order, ok := r.orders[orderID]
+	if !ok {
+		return nil, database.ErrOrderNotFound
+	}
+	return cloneOrder(order), nil
+}
+
+func orderMatches(order *models.Order, filter database.OrderFilter) bool {
+	if filter.UserID != "" && order.User_ID != filter.UserID {
+		return false
+	}
+	if filter.Status != "" && order.Status != filter.Status {
+		return false
+	}
+	if !filter.From.IsZero() && order.Ordered_At.Before(filter.From) {
+		return false
+	}
+	if !filter.To.IsZero() && !order.Ordered_At.Before(filter.To) {
+		return false
+	}
+	if filter.MinTotal != nil && (order.Price.Currency != filter.MinTotal.Currency || order.Price.Amount < filter.MinTotal.Amount) {
+		return false
+	}
+	if filter.MaxTotal != nil && (order.Price.Currency != filter.MaxTotal.Currency || order.Price.Amount > filter.MaxTotal.Amount) {
+		return false
+	}
+	if filter.ProductID.IsZero() {
+		return true
+	}
+	for _, item := range order.Order_Cart {
+		if item.Product_ID == filter.ProductID {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *MemoryOrderRepository) Search(ctx context.Context, filter database.OrderFilter) ([]models.Order, int64, error) {
+	r.mu.Lock()
+	matched := make([]models.Order, 0)
+	for _, order := range r.orders {
+		if orderMatches(order, filter) {
+			matched = append(matched, *cloneOrder(order))
+		}
+	}
+	r.mu.Unlock()
+
+	sort.Slice(matched, func(i, j int) bool { return matched[i].Ordered_At.After(matched[j].Ordered_At) })
+	total := int64(len(matched))
+	if filter.Skip >= total {
+		return make([]models.Order, 0), total, nil
+	}
+	matched = matched[filter.Skip:]
+	if filter.Limit > 0 && int64(len(matched)) > filter.Limit {
+		matched = matched[:filter.Limit]
+	}
+	return matched, total, nil
+}
+
+func (r *MemoryOrderRepository) Transition(ctx context.Context, orderID primitive.ObjectID, status string, actor string, note string) (*models.Order, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	order, ok := r.orders[orderID]
+	if !ok {
+		return nil, database.ErrOrderNotFound
+	}
+	if !models.CanTransition(order.Status, status) {
+		return nil, fmt.Errorf("%w from %s to %s", models.ErrIllegalTransition, order.Status, status)
+	}
+	now := time.Now()
+	order.History = append(order.History, models.StatusChange{From: order.Status, To: status, Actor: actor, Note: note, At: now})
+	order.Status = status
+	order.Updated_At = now
+	return cloneOrder(order), nil
+}
+
+func (r *MemoryOrderRepository) AddRefund(ctx context.Context, orderID primitive.ObjectID, refund models.Refund, updatedAt time.Time) (*models.Order, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	order, ok := r.orders[orderID]
+	if !ok || !order.Updated_At.Equal(updatedAt) {
+		return nil, database.ErrOrderChanged
+	}
+	order.Refunds = append(order.Refunds, refund)
+	order.Updated_At = time.Now()
+	return cloneOrder(order), nil
+}
+
+func (r *MemoryOrderRepository) UpdateRefund(ctx context.Context, orderID primitive.ObjectID, refund models.Refund) (*models.Order, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	order, ok := r.orders[orderID]
+	if !ok {
+		return nil, database.ErrOrderChanged
+	}
+	for i := range order.Refunds {
+		if order.Refunds[i].ID == refund.ID {
+			order.Refunds[i] = refund
+			order.Updated_At = time.Now()
+			return cloneOrder(order), nil
+		}
+	}
+	return nil, database.ErrOrderChanged
+}
@@ -0,0 +1,60 @@
+package repository
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mauroarnedo/ecommerce/database"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type MemoryPasswordResetRepository struct {
+	mu     sync.Mutex
+	resets map[string]database.PasswordReset
+}
+
+func NewMemoryPasswordResetRepository() *MemoryPasswordResetRepository {
+	return &MemoryPasswordResetRepository{resets: make(map[string]database.PasswordReset)}
+}
+
+func (r *MemoryPasswordResetRepository) Create(ctx context.Context, userID string, tokenHash string, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for hash, reset := range r.resets {
+		if reset.User_ID == userID {
+			delete(r.resets, hash)
+		}
+	}
+	r.resets[tokenHash] = database.PasswordReset{
+		ID:         primitive.NewObjectID(),
+		User_ID:    userID,
+		Token_Hash: tokenHash,
+		Created_At: time.Now(),
+		Expires_At: expiresAt,
+	}
+	return nil
+}
+
+func (r *MemoryPasswordResetRepository) Consume(ctx context.Context, tokenHash string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reset, ok := r.resets[tokenHash]
+	now := time.Now()
+	if !ok || reset.Used_At != nil || !now.Before(reset.Expires_At) {
+		return "", database.ErrResetTokenInvalid
+	}
+	reset.Used_At = &now
+	r.resets[tokenHash] = reset
+	return reset.User_ID, nil
+}
+
+func (r *MemoryPasswordResetRepository) Release(ctx context.Context, tokenHash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if reset, ok := r.resets[tokenHash]; ok {
+		reset.Used_At = nil
+		r.resets[tokenHash] = reset
+	}
+	return nil
+}
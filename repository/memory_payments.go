@@ -0,0 +1,129 @@
+package repository
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mauroarnedo/ecommerce/database"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type MemoryPaymentRepository struct {
+	mu      sync.Mutex
+	intents map[primitive.ObjectID]*database.PaymentIntent
+}
+
+func NewMemoryPaymentRepository() *MemoryPaymentRepository {
+	return &MemoryPaymentRepository{intents: make(map[primitive.ObjectID]*database.PaymentIntent)}
+}
+
+func (r *MemoryPaymentRepository) Create(ctx context.Context, intent *database.PaymentIntent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clone := *intent
+	r.intents[intent.ID] = &clone
+	return nil
+}
+
+func (r *MemoryPaymentRepository) FindByOrder(ctx context.Context, orderID primitive.ObjectID) (*database.PaymentIntent, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var latest *database.PaymentIntent
+	for _, intent := range r.intents {
+		if intent.Order_ID == orderID && (latest == nil || intent.Created_At.After(latest.Created_At)) {
+			latest = intent
+		}
+	}
+	if latest == nil {
+		return nil, database.ErrPaymentNotFound
+	}
+	clone := *latest
+	return &clone, nil
+}
+
+func (r *MemoryPaymentRepository) Save(ctx context.Context, intent *database.PaymentIntent, from string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored, ok := r.intents[intent.ID]
+	if !ok || stored.Status != from {
+		return database.ErrPaymentChanged
+	}
+	intent.Updated_At = time.Now()
+	clone := *intent
+	r.intents[intent.ID] = &clone
+	return nil
+}
+
+func (r *MemoryPaymentRepository) FindByProviderRef(ctx context.Context, provider string, providerRef string) (*database.PaymentIntent, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, intent := range r.intents {
+		if intent.Provider == provider && intent.Provider_Ref == providerRef {
+			clone := *intent
+			return &clone, nil
+		}
+	}
+	return nil, database.ErrPaymentNotFound
+}
+
+type MemoryPaymentEventRepository struct {
+	mu     sync.Mutex
+	events map[string]*database.PaymentEvent
+}
+
+func NewMemoryPaymentEventRepository() *MemoryPaymentEventRepository {
+	return &MemoryPaymentEventRepository{events: make(map[string]*database.PaymentEvent)}
+}
+
+func (r *MemoryPaymentEventRepository) Claim(ctx context.Context, event database.PaymentEvent, lease time.Duration, retry ...string) (*database.PaymentEvent, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	stored, ok := r.events[event.ID]
+	if !ok {
+		event.Status = database.EventProcessing
+		event.Attempts = 1
+		event.Received_At = now
+		event.Updated_At = now
+		r.events[event.ID] = &event
+		clone := event
+		return &clone, true, nil
+	}
+	claimed := stored.Status == database.EventProcessing && stored.Updated_At.Before(now.Add(-lease))
+	for _, status := range retry {
+		if stored.Status == status {
+			claimed = true
+		}
+	}
+	if claimed {
+		stored.Status = database.EventProcessing
+		stored.Attempts++
+		stored.Updated_At = now
+	}
+	clone := *stored
+	return &clone, claimed, nil
+}
+
+func (r *MemoryPaymentEventRepository) Find(ctx context.Context, eventID string) (*database.PaymentEvent, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored, ok := r.events[eventID]
+	if !ok {
+		return nil, database.ErrPaymentEventNotFound
+	}
+	clone := *stored
+	return &clone, nil
+}
+
+func (r *MemoryPaymentEventRepository) Finish(ctx context.Context, eventID string, status string, result string, failure string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if stored, ok := r.events[eventID]; ok {
+		stored.Status = status
+		stored.Result = result
+		stored.Error = failure
+		stored.Updated_At = time.Now()
+	}
+	return nil
+}
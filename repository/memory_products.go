@@ -0,0 +1,268 @@
+package repository
+
+import (
+	"context"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/mauroarnedo/ecommerce/database"
+	"github.com/mauroarnedo/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type MemoryProductRepository struct {
+	mu       sync.RWMutex
+	products map[primitive.ObjectID]*models.Product
+	order    []primitive.ObjectID
+}
+
+func NewMemoryProductRepository() *MemoryProductRepository {
+	return &MemoryProductRepository{products: make(map[primitive.ObjectID]*models.Product)}
+}
+
+func cloneProduct(product *models.Product) *models.Product {
+	clone := *product
+	clone.Comments = append([]models.Comment(nil), product.Comments...)
+	if product.Stock != nil {
+		stock := *product.Stock
+		clone.Stock = &stock
+	}
+	return &clone
+}
+
+func (r *MemoryProductRepository) Create(ctx context.Context, product *models.Product) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.products[product.Product_ID]; !ok {
+		r.order = append(r.order, product.Product_ID)
+	}
+	r.products[product.Product_ID] = cloneProduct(product)
+	return nil
+}
+
+func (r *MemoryProductRepository) CreateMany(ctx context.Context, products []models.Product) error {
+	for i := range products {
+		if err := r.Create(ctx, &products[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *MemoryProductRepository) FindByID(ctx context.Context, productID primitive.ObjectID) (*models.Product, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	product, ok := r.products[productID]
+	if !ok {
+		return nil, ErrProductNotFound
+	}
+	return cloneProduct(product), nil
+}
+
+func (r *MemoryProductRepository) filter(match func(product *models.Product) bool) []models.Product {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	products := make([]models.Product, 0)
+	for _, id := range r.order {
+		if product, ok := r.products[id]; ok && match(product) {
+			products = append(products, *cloneProduct(product))
+		}
+	}
+	return products
+}
+
+func (r *MemoryProductRepository) List(ctx context.Context) ([]models.Product, error) {
+	return r.filter(func(*models.Product) bool { return true }), nil
+}
+
+func (r *MemoryProductRepository) SearchByName(ctx context.Context, name string) ([]models.Product, error) {
+	pattern, err := regexp.Compile("(?i)" + name)
+	if err != nil {
+		return nil, err
+	}
+	return r.filter(func(product *models.Product) bool {
+		return product.Product_Name != nil && pattern.MatchString(*product.Product_Name)
+	}), nil
+}
+
+func (r *MemoryProductRepository) Delete(ctx context.Context, productID primitive.ObjectID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.products, productID)
+	return nil
+}
+
+func (r *MemoryProductRepository) AddComment(ctx context.Context, productID primitive.ObjectID, comment models.Comment) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	product, ok := r.products[productID]
+	if !ok {
+		return ErrProductNotFound
+	}
+	product.Comments = append(product.Comments, comment)
+	return nil
+}
+
+func (r *MemoryProductRepository) RemoveUserComments(ctx context.Context, productID primitive.ObjectID, userID primitive.ObjectID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	product, ok := r.products[productID]
+	if !ok {
+		return nil
+	}
+	kept := make([]models.Comment, 0, len(product.Comments))
+	for _, comment := range product.Comments {
+		if comment.User.ID != userID {
+			kept = append(kept, comment)
+		}
+	}
+	product.Comments = kept
+	return nil
+}
+
+// current returns the product as it is now, nil when it was deleted.
+func (r *MemoryProductRepository) current(productID primitive.ObjectID) *models.Product {
+	product, err := r.FindByID(context.Background(), productID)
+	if err != nil {
+		return nil
+	}
+	return product
+}
+
+// takeStock takes every line or, when one product is short, none of them.
+func (r *MemoryProductRepository) takeStock(lines []database.StockLine) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, line := range lines {
+		product, ok := r.products[line.Product_ID]
+		if !ok {
+			return database.ErrCantFindProduct
+		}
+		if product.Stock != nil && *product.Stock < line.Quantity {
+			return database.OutOfStock(product)
+		}
+	}
+	for _, line := range lines {
+		if stock := r.products[line.Product_ID].Stock; stock != nil {
+			*stock -= line.Quantity
+		}
+	}
+	return nil
+}
+
+func (r *MemoryProductRepository) returnStock(lines []database.StockLine) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, line := range lines {
+		if product, ok := r.products[line.Product_ID]; ok && product.Stock != nil {
+			*product.Stock += line.Quantity
+		}
+	}
+}
+
+func (r *MemoryProductRepository) settleStock(reserved []database.StockLine, wanted []database.StockLine) error {
+	take, give := database.StockDiff(reserved, wanted)
+	if err := r.takeStock(take); err != nil {
+		return err
+	}
+	r.returnStock(give)
+	return nil
+}
+
+type MemoryInventoryRepository struct {
+	products *MemoryProductRepository
+
+	mu           sync.Mutex
+	reservations map[primitive.ObjectID]*database.Reservation
+}
+
+func NewMemoryInventoryRepository(products *MemoryProductRepository) *MemoryInventoryRepository {
+	return &MemoryInventoryRepository{products: products, reservations: make(map[primitive.ObjectID]*database.Reservation)}
+}
+
+func (r *MemoryInventoryRepository) SetStock(ctx context.Context, productID primitive.ObjectID, stock *int) error {
+	r.products.mu.Lock()
+	defer r.products.mu.Unlock()
+	product, ok := r.products.products[productID]
+	if !ok {
+		return database.ErrCantFindProduct
+	}
+	product.Stock = nil
+	if stock != nil {
+		value := *stock
+		product.Stock = &value
+	}
+	return nil
+}
+
+func (r *MemoryInventoryRepository) Hold(ctx context.Context, userID string, lines []database.StockLine, ttl time.Duration) (*database.Reservation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.release(func(reservation *database.Reservation) bool { return reservation.User_ID == userID })
+	if err := r.products.takeStock(lines); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	reservation := &database.Reservation{
+		ID:         primitive.NewObjectID(),
+		User_ID:    userID,
+		Lines:      lines,
+		Status:     database.ReservationHeld,
+		Created_At: now,
+		Expires_At: now.Add(ttl),
+	}
+	r.reservations[reservation.ID] = reservation
+	clone := *reservation
+	return &clone, nil
+}
+
+func (r *MemoryInventoryRepository) ReleaseExpired(ctx context.Context, now time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.release(func(reservation *database.Reservation) bool { return !reservation.Expires_At.After(now) }), nil
+}
+
+func (r *MemoryInventoryRepository) Return(ctx context.Context, lines []database.StockLine) error {
+	r.products.returnStock(lines)
+	return nil
+}
+
+// release returns the stock of the held reservations matching and forgets
+// them. The caller holds r.mu.
+func (r *MemoryInventoryRepository) release(match func(reservation *database.Reservation) bool) int {
+	released := 0
+	for id, reservation := range r.reservations {
+		if reservation.Status == database.ReservationHeld && match(reservation) {
+			r.products.returnStock(reservation.Lines)
+			delete(r.reservations, id)
+			released++
+		}
+	}
+	return released
+}
+
+func (r *MemoryInventoryRepository) claim(userID string) *database.Reservation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for _, reservation := range r.reservations {
+		if reservation.User_ID == userID && reservation.Status == database.ReservationHeld && reservation.Expires_At.After(now) {
+			reservation.Status = database.ReservationCommitted
+			clone := *reservation
+			return &clone
+		}
+	}
+	return nil
+}
+
+func (r *MemoryInventoryRepository) unclaim(reservation *database.Reservation) {
+	if reservation == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if held, ok := r.reservations[reservation.ID]; ok && held.Status == database.ReservationCommitted {
+		held.Status = database.ReservationHeld
+	}
+}
@@ -0,0 +1,78 @@
+package repository
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mauroarnedo/ecommerce/database"
+	"github.com/mauroarnedo/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type MemoryReturnRepository struct {
+	mu      sync.Mutex
+	returns map[primitive.ObjectID]*models.ReturnRequest
+}
+
+func NewMemoryReturnRepository() *MemoryReturnRepository {
+	return &MemoryReturnRepository{returns: make(map[primitive.ObjectID]*models.ReturnRequest)}
+}
+
+func cloneReturn(request *models.ReturnRequest) *models.ReturnRequest {
+	clone := *request
+	clone.Lines = append([]models.ReturnLine(nil), request.Lines...)
+	clone.History = append([]models.StatusChange(nil), request.History...)
+	return &clone
+}
+
+func (r *MemoryReturnRepository) Create(ctx context.Context, request *models.ReturnRequest) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.returns[request.ID] = cloneReturn(request)
+	return nil
+}
+
+func (r *MemoryReturnRepository) FindByID(ctx context.Context, returnID primitive.ObjectID) (*models.ReturnRequest, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	request, ok := r.returns[returnID]
+	if !ok {
+		return nil, database.ErrReturnNotFound
+	}
+	return cloneReturn(request), nil
+}
+
+func (r *MemoryReturnRepository) List(ctx context.Context, filter database.ReturnFilter) ([]models.ReturnRequest, error) {
+	r.mu.Lock()
+	matched := make([]models.ReturnRequest, 0)
+	for _, request := range r.returns {
+		if filter.UserID != "" && request.User_ID != filter.UserID {
+			continue
+		}
+		if !filter.OrderID.IsZero() && request.Order_ID != filter.OrderID {
+			continue
+		}
+		if filter.Status != "" && request.Status != filter.Status {
+			continue
+		}
+		matched = append(matched, *cloneReturn(request))
+	}
+	r.mu.Unlock()
+
+	sort.Slice(matched, func(i, j int) bool { return matched[i].Created_At.After(matched[j].Created_At) })
+	return matched, nil
+}
+
+func (r *MemoryReturnRepository) Save(ctx context.Context, request *models.ReturnRequest, from string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored, ok := r.returns[request.ID]
+	if !ok || stored.Status != from {
+		return database.ErrReturnChanged
+	}
+	request.Updated_At = time.Now()
+	r.returns[request.ID] = cloneReturn(request)
+	return nil
+}
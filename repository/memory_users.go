@@ -0,0 +1,390 @@
+package repository
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mauroarnedo/ecommerce/database"
+	"github.com/mauroarnedo/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryUserRepository keeps users in a map. It mirrors the semantics of
+// MongoUserRepository closely enough to run the HTTP API without a database.
+type MemoryUserRepository struct {
+	mu    sync.RWMutex
+	users map[string]*models.User
+}
+
+func NewMemoryUserRepository() *MemoryUserRepository {
+	return &MemoryUserRepository{users: make(map[string]*models.User)}
+}
+
+func cloneUser(user *models.User) *models.User {
+	clone := *user
+	clone.User_Cart = append([]models.ProductUser(nil), user.User_Cart...)
+	clone.User_Favorites = append([]models.ProductUser(nil), user.User_Favorites...)
+	clone.Address_Details = append([]models.Address(nil), user.Address_Details...)
+	clone.Recovery_Codes = append([]string(nil), user.Recovery_Codes...)
+	return &clone
+}
+
+func (r *MemoryUserRepository) get(userID string) (*models.User, error) {
+	if _, err := primitive.ObjectIDFromHex(userID); err != nil {
+		return nil, database.ErrUserIDIsNotValid
+	}
+	user, ok := r.users[userID]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return user, nil
+}
+
+// modify runs fn on the stored user under the write lock.
+func (r *MemoryUserRepository) modify(userID string, fn func(user *models.User) bool) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, err := r.get(userID)
+	if err != nil {
+		return false, err
+	}
+	if !fn(user) {
+		return false, nil
+	}
+	user.Updated_At = time.Now()
+	return true, nil
+}
+
+func (r *MemoryUserRepository) Create(ctx context.Context, user *models.User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.users[user.ID.Hex()] = cloneUser(user)
+	return nil
+}
+
+func (r *MemoryUserRepository) CreateBootstrapAdmin(ctx context.Context, user *models.User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, stored := range r.users {
+		if stored.Bootstrap_Admin {
+			return ErrAdminExists
+		}
+	}
+	user.Bootstrap_Admin = true
+	r.users[user.ID.Hex()] = cloneUser(user)
+	return nil
+}
+
+func (r *MemoryUserRepository) exists(match func(user *models.User) bool) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, user := range r.users {
+		if match(user) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *MemoryUserRepository) EmailExists(ctx context.Context, email string) (bool, error) {
+	return r.exists(func(user *models.User) bool { return user.Email != nil && *user.Email == email }), nil
+}
+
+func (r *MemoryUserRepository) PhoneExists(ctx context.Context, phone string) (bool, error) {
+	return r.exists(func(user *models.User) bool { return user.Phone != nil && *user.Phone == phone }), nil
+}
+
+func (r *MemoryUserRepository) CountByRole(ctx context.Context, role string) (int64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var count int64
+	for _, user := range r.users {
+		if user.Role == role {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (r *MemoryUserRepository) FindByID(ctx context.Context, userID string) (*models.User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	user, err := r.get(userID)
+	if err != nil {
+		return nil, err
+	}
+	return cloneUser(user), nil
+}
+
+func (r *MemoryUserRepository) FindByEmail(ctx context.Context, email string) (*models.User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, user := range r.users {
+		if user.Email != nil && *user.Email == email {
+			return cloneUser(user), nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+func (r *MemoryUserRepository) FindProfile(ctx context.Context, userID string) (*models.UserProfile, error) {
+	user, err := r.FindByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &models.UserProfile{
+		ID:              user.ID,
+		User_ID:         user.User_ID,
+		First_Name:      user.First_Name,
+		Last_Name:       user.Last_Name,
+		Email:           user.Email,
+		Phone:           user.Phone,
+		Email_Verified:  user.Email_Verified,
+		Phone_Verified:  user.Phone_Verified,
+		TOTP_Enabled:    user.TOTP_Enabled,
+		User_Cart:       user.User_Cart,
+		User_Favorites:  user.User_Favorites,
+		Address_Details: user.Address_Details,
+		Store_Credit:    user.Store_Credit,
+	}, nil
+}
+
+func (r *MemoryUserRepository) FindAdminView(ctx context.Context, userID string) (*models.AdminUserView, error) {
+	user, err := r.FindByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &models.AdminUserView{
+		ID:             user.ID,
+		User_ID:        user.User_ID,
+		First_Name:     user.First_Name,
+		Last_Name:      user.Last_Name,
+		Email:          user.Email,
+		Phone:          user.Phone,
+		Role:           user.Role,
+		Email_Verified: user.Email_Verified,
+		Phone_Verified: user.Phone_Verified,
+		TOTP_Enabled:   user.TOTP_Enabled,
+		Created_At:     user.Created_At,
+		Updated_At:     user.Updated_At,
+	}, nil
+}
+
+func (r *MemoryUserRepository) FindPublic(ctx context.Context, userID string) (*models.PublicUser, error) {
+	user, err := r.FindByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &models.PublicUser{ID: user.ID, First_Name: user.First_Name, Last_Name: user.Last_Name}, nil
+}
+
+func (r *MemoryUserRepository) Delete(ctx context.Context, userID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.users, userID)
+	return nil
+}
+
+func (r *MemoryUserRepository) set(userID string, fn func(user *models.User)) error {
+	_, err := r.modify(userID, func(user *models.User) bool {
+		fn(user)
+		return true
+	})
+	return err
+}
+
+func (r *MemoryUserRepository) SetRole(ctx context.Context, userID string, role string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, err := r.get(userID)
+	if err != nil {
+		return false, err
+	}
+	if user.Role == role {
+		return false, nil
+	}
+	if user.Role == models.RoleAdmin {
+		admins := 0
+		for _, other := range r.users {
+			if other.Role == models.RoleAdmin {
+				admins++
+			}
+		}
+		if admins == 1 {
+			return false, ErrLastAdmin
+		}
+	}
+	user.Role = role
+	user.Updated_At = time.Now()
+	return true, nil
+}
+
+func (r *MemoryUserRepository) SetPassword(ctx context.Context, userID string, passwordHash string) error {
+	return r.set(userID, func(user *models.User) { user.Password = &passwordHash })
+}
+
+func (r *MemoryUserRepository) SetEmailVerified(ctx context.Context, userID string) error {
+	return r.set(userID, func(user *models.User) { user.Email_Verified = true })
+}
+
+func (r *MemoryUserRepository) SetPhoneVerified(ctx context.Context, userID string) error {
+	return r.set(userID, func(user *models.User) { user.Phone_Verified = true })
+}
+
+func (r *MemoryUserRepository) UpdateTokens(ctx context.Context, userID string, token string, refreshToken string) error {
+	return r.set(userID, func(user *models.User) {
+		user.Token = &token
+		user.Refresh_Token = &refreshToken
+	})
+}
+
+func (r *MemoryUserRepository) ReplaceRefreshToken(ctx context.Context, userID string, current string, token string, refreshToken string) (bool, error) {
+	return r.modify(userID, func(user *models.User) bool {
+		if user.Refresh_Token == nil || *user.Refresh_Token != current {
+			return false
+		}
+		user.Token = &token
+		user.Refresh_Token = &refreshToken
+		return true
+	})
+}
+
+func (r *MemoryUserRepository) ClearTokens(ctx context.Context, userID string, onlyIfRefreshToken string) error {
+	_, err := r.modify(userID, func(user *models.User) bool {
+		if onlyIfRefreshToken != "" && (user.Refresh_Token == nil || *user.Refresh_Token != onlyIfRefreshToken) {
+			return false
+		}
+		empty := ""
+		user.Token = &empty
+		user.Refresh_Token = &empty
+		return true
+	})
+	return err
+}
+
+func (r *MemoryUserRepository) SetPendingTOTP(ctx context.Context, userID string, secret string) error {
+	return r.set(userID, func(user *models.User) { user.TOTP_Pending = secret })
+}
+
+func (r *MemoryUserRepository) EnableTOTP(ctx context.Context, userID string, pending string, step int64, recoveryHashes []string) (bool, error) {
+	return r.modify(userID, func(user *models.User) bool {
+		if user.TOTP_Pending != pending {
+			return false
+		}
+		user.TOTP_Enabled = true
+		user.TOTP_Secret = pending
+		user.TOTP_Pending = ""
+		user.TOTP_Last_Step = step
+		user.Recovery_Codes = append([]string(nil), recoveryHashes...)
+		return true
+	})
+}
+
+func (r *MemoryUserRepository) DisableTOTP(ctx context.Context, userID string) error {
+	return r.set(userID, func(user *models.User) {
+		user.TOTP_Enabled = false
+		user.TOTP_Secret = ""
+		user.TOTP_Pending = ""
+		user.TOTP_Last_Step = 0
+		user.Recovery_Codes = nil
+	})
+}
+
+func (r *MemoryUserRepository) AdvanceTOTPStep(ctx context.Context, userID string, step int64) (bool, error) {
+	return r.modify(userID, func(user *models.User) bool {
+		if user.TOTP_Last_Step >= step {
+			return false
+		}
+		user.TOTP_Last_Step = step
+		return true
+	})
+}
+
+func (r *MemoryUserRepository) ConsumeRecoveryCode(ctx context.Context, userID string, hash string) (bool, error) {
+	return r.modify(userID, func(user *models.User) bool {
+		for i, code := range user.Recovery_Codes {
+			if code == hash {
+				user.Recovery_Codes = append(user.Recovery_Codes[:i], user.Recovery_Codes[i+1:]...)
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (r *MemoryUserRepository) AddFavorite(ctx context.Context, userID string, product models.ProductUser) error {
+	return r.set(userID, func(user *models.User) { user.User_Favorites = append(user.User_Favorites, product) })
+}
+
+func withoutProduct(products []models.ProductUser, productID primitive.ObjectID) []models.ProductUser {
+	kept := make([]models.ProductUser, 0, len(products))
+	for _, product := range products {
+		if product.Product_ID != productID {
+			kept = append(kept, product)
+		}
+	}
+	return kept
+}
+
+func (r *MemoryUserRepository) RemoveFavorite(ctx context.Context, userID string, productID primitive.ObjectID) error {
+	return r.set(userID, func(user *models.User) { user.User_Favorites = withoutProduct(user.User_Favorites, productID) })
+}
+
+func (r *MemoryUserRepository) RemoveFavoriteFromAll(ctx context.Context, productID primitive.ObjectID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, user := range r.users {
+		user.User_Favorites = withoutProduct(user.User_Favorites, productID)
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) AddAddress(ctx context.Context, userID string, address models.Address) error {
+	added, err := r.modify(userID, func(user *models.User) bool {
+		if len(user.Address_Details) >= 2 {
+			return false
+		}
+		user.Address_Details = append(user.Address_Details, address)
+		return true
+	})
+	if err == nil && !added {
+		return ErrAddressLimit
+	}
+	return err
+}
+
+func (r *MemoryUserRepository) EditAddress(ctx context.Context, userID string, index int, address models.Address) error {
+	return r.set(userID, func(user *models.User) {
+		for len(user.Address_Details) <= index {
+			user.Address_Details = append(user.Address_Details, models.Address{})
+		}
+		current := &user.Address_Details[index]
+		current.House, current.Street, current.City, current.Pin_Code = address.House, address.Street, address.City, address.Pin_Code
+	})
+}
+
+func (r *MemoryUserRepository) ClearAddresses(ctx context.Context, userID string) error {
+	return r.set(userID, func(user *models.User) { user.Address_Details = make([]models.Address, 0) })
+}
+
+func (r *MemoryUserRepository) AddStoreCredit(ctx context.Context, userID string, amount models.Money) error {
+	var addErr error
+	err := r.set(userID, func(user *models.User) {
+		var balance models.Money
+		if user.Store_Credit != nil {
+			balance = *user.Store_Credit
+		}
+		if balance, addErr = balance.Add(amount); addErr == nil {
+			user.Store_Credit = &balance
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return addErr
+}
+
+func (r *MemoryUserRepository) SetCartCoupon(ctx context.Context, userID string, code string) error {
+	return r.set(userID, func(user *models.User) { user.Cart_Coupon = code })
+}
@@ -0,0 +1,70 @@
+package repository
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mauroarnedo/ecommerce/database"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type MemoryVerificationRepository struct {
+	mu      sync.Mutex
+	pending map[string]*database.Verification
+}
+
+func NewMemoryVerificationRepository() *MemoryVerificationRepository {
+	return &MemoryVerificationRepository{pending: make(map[string]*database.Verification)}
+}
+
+func (r *MemoryVerificationRepository) Save(ctx context.Context, userID string, channel string, target string, codeHash string, expiresAt time.Time, policy database.ResendPolicy) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	key := userID + ":" + channel
+	windowStart, sentCount := now, 1
+	if previous, ok := r.pending[key]; ok {
+		if now.Sub(previous.Last_Sent_At) < policy.MinInterval {
+			return database.ErrResendTooSoon
+		}
+		if now.Sub(previous.Window_Start) < policy.Window {
+			if previous.Sent_Count >= policy.MaxPerWindow {
+				return database.ErrResendTooSoon
+			}
+			windowStart, sentCount = previous.Window_Start, previous.Sent_Count+1
+		}
+	}
+	r.pending[key] = &database.Verification{
+		ID:           primitive.NewObjectID(),
+		User_ID:      userID,
+		Channel:      channel,
+		Target:       target,
+		Code_Hash:    codeHash,
+		Expires_At:   expiresAt,
+		Last_Sent_At: now,
+		Window_Start: windowStart,
+		Sent_Count:   sentCount,
+	}
+	return nil
+}
+
+func (r *MemoryVerificationRepository) Check(ctx context.Context, channel string, target string, hash func(userID string) string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, pending := range r.pending {
+		if pending.Channel != channel || pending.Target != target {
+			continue
+		}
+		if pending.Attempts >= database.MaxVerificationAttempts {
+			return "", database.ErrVerificationLocked
+		}
+		pending.Attempts++
+		if time.Now().After(pending.Expires_At) || hash(pending.User_ID) != pending.Code_Hash {
+			return "", database.ErrVerificationInvalid
+		}
+		delete(r.pending, key)
+		return pending.User_ID, nil
+	}
+	return "", database.ErrVerificationInvalid
+}
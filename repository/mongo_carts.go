@@ -0,0 +1,60 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/mauroarnedo/ecommerce/database"
+	"github.com/mauroarnedo/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type MongoCartRepository struct {
+	productCollection *mongo.Collection
+	userCollection    *mongo.Collection
+}
+
+func NewMongoCartRepository(productCollection, userCollection *mongo.Collection) *MongoCartRepository {
+	return &MongoCartRepository{productCollection: productCollection, userCollection: userCollection}
+}
+
+func (r *MongoCartRepository) Add(ctx context.Context, userID string, productID primitive.ObjectID, quantity int) error {
+	return database.AddProductToCart(ctx, r.productCollection, r.userCollection, productID, userID, quantity)
+}
+
+func (r *MongoCartRepository) SetQuantity(ctx context.Context, userID string, productID primitive.ObjectID, quantity int) error {
+	return database.SetCartQuantity(ctx, r.productCollection, r.userCollection, productID, userID, quantity)
+}
+
+func (r *MongoCartRepository) ChangeQuantity(ctx context.Context, userID string, productID primitive.ObjectID, delta int) error {
+	return database.ChangeCartQuantity(ctx, r.productCollection, r.userCollection, productID, userID, delta)
+}
+
+func (r *MongoCartRepository) Remove(ctx context.Context, userID string, productID primitive.ObjectID) error {
+	return database.RemoveCartItem(ctx, r.productCollection, r.userCollection, productID, userID)
+}
+
+func (r *MongoCartRepository) Items(ctx context.Context, userID string) ([]models.ProductUser, models.Money, error) {
+	filter, err := userFilter(userID)
+	if err != nil {
+		return nil, models.Money{}, err
+	}
+
+	var filledCart models.User
+	err = r.userCollection.FindOne(ctx, filter).Decode(&filledCart)
+	if err == mongo.ErrNoDocuments {
+		return nil, models.Money{}, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, models.Money{}, err
+	}
+	total, err := database.CartTotal(filledCart.User_Cart)
+	if err != nil {
+		return nil, models.Money{}, err
+	}
+	return filledCart.User_Cart, total, nil
+}
+
+func (r *MongoCartRepository) Revalidate(ctx context.Context, userID string) ([]database.CartChange, error) {
+	return database.RevalidateCart(ctx, r.productCollection, r.userCollection, userID)
+}
@@ -0,0 +1,47 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/mauroarnedo/ecommerce/database"
+	"github.com/mauroarnedo/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type MongoCouponRepository struct {
+	couponCollection     *mongo.Collection
+	redemptionCollection *mongo.Collection
+}
+
+func NewMongoCouponRepository(couponCollection, redemptionCollection *mongo.Collection) *MongoCouponRepository {
+	return &MongoCouponRepository{couponCollection: couponCollection, redemptionCollection: redemptionCollection}
+}
+
+func (r *MongoCouponRepository) Create(ctx context.Context, coupon *models.Coupon) error {
+	return database.CreateCoupon(ctx, r.couponCollection, coupon)
+}
+
+func (r *MongoCouponRepository) FindByCode(ctx context.Context, code string) (*models.Coupon, error) {
+	return database.FindCoupon(ctx, r.couponCollection, code)
+}
+
+func (r *MongoCouponRepository) List(ctx context.Context) ([]models.Coupon, error) {
+	return database.ListCoupons(ctx, r.couponCollection)
+}
+
+func (r *MongoCouponRepository) SetActive(ctx context.Context, code string, active bool) error {
+	return database.SetCouponActive(ctx, r.couponCollection, code, active)
+}
+
+func (r *MongoCouponRepository) Redemptions(ctx context.Context, couponID primitive.ObjectID, userID string) (int, error) {
+	return database.CountRedemptions(ctx, r.redemptionCollection, couponID, userID)
+}
+
+func (r *MongoCouponRepository) Redeem(ctx context.Context, coupon *models.Coupon, userID string) error {
+	return database.RedeemCoupon(ctx, r.couponCollection, r.redemptionCollection, coupon, userID)
+}
+
+func (r *MongoCouponRepository) Release(ctx context.Context, couponID primitive.ObjectID, userID string) error {
+	return database.ReleaseCoupon(ctx, r.couponCollection, r.redemptionCollection, couponID, userID)
+}
@@ -0,0 +1,57 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/mauroarnedo/ecommerce/database"
+	"github.com/mauroarnedo/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type MongoOrderRepository struct {
+	productCollection     *mongo.Collection
+	userCollection        *mongo.Collection
+	orderCollection       *mongo.Collection
+	reservationCollection *mongo.Collection
+	checkoutStrategy      string
+}
+
+func NewMongoOrderRepository(productCollection, userCollection, orderCollection, reservationCollection *mongo.Collection, checkoutStrategy string) *MongoOrderRepository {
+	return &MongoOrderRepository{
+		productCollection:     productCollection,
+		userCollection:        userCollection,
+		orderCollection:       orderCollection,
+		reservationCollection: reservationCollection,
+		checkoutStrategy:      checkoutStrategy,
+	}
+}
+
+func (r *MongoOrderRepository) BuyFromCart(ctx context.Context, userID string, payment models.Payment, coupon *models.Coupon) (*models.Order, error) {
+	return database.BuyItemFromCart(ctx, r.productCollection, r.userCollection, r.orderCollection, r.reservationCollection, userID, payment, coupon, r.checkoutStrategy)
+}
+
+func (r *MongoOrderRepository) InstantBuy(ctx context.Context, userID string, productID primitive.ObjectID, payment models.Payment, coupon *models.Coupon) (*models.Order, error) {
+	return database.InstantBuy(ctx, r.productCollection, r.userCollection, r.orderCollection, productID, userID, payment, coupon)
+}
+
+func (r *MongoOrderRepository) FindByID(ctx context.Context, orderID primitive.ObjectID) (*models.Order, error) {
+	return database.FindOrder(ctx, r.orderCollection, orderID)
+}
+
+func (r *MongoOrderRepository) Search(ctx context.Context, filter database.OrderFilter) ([]models.Order, int64, error) {
+	return database.SearchOrders(ctx, r.orderCollection, filter)
+}
+
+func (r *MongoOrderRepository) Transition(ctx context.Context, orderID primitive.ObjectID, status string, actor string, note string) (*models.Order, error) {
+	return database.TransitionOrder(ctx, r.orderCollection, orderID, status, actor, note)
+}
+
+func (r *MongoOrderRepository) AddRefund(ctx context.Context, orderID primitive.ObjectID, refund models.Refund, updatedAt time.Time) (*models.Order, error) {
+	return database.AddRefund(ctx, r.orderCollection, orderID, refund, updatedAt)
+}
+
+func (r *MongoOrderRepository) UpdateRefund(ctx context.Context, orderID primitive.ObjectID, refund models.Refund) (*models.Order, error) {
+	return database.UpdateRefund(ctx, r.orderCollection, orderID, refund)
+}
@@ -0,0 +1,29 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/mauroarnedo/ecommerce/database"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type MongoPasswordResetRepository struct {
+	collection *mongo.Collection
+}
+
+func NewMongoPasswordResetRepository(collection *mongo.Collection) *MongoPasswordResetRepository {
+	return &MongoPasswordResetRepository{collection: collection}
+}
+
+func (r *MongoPasswordResetRepository) Create(ctx context.Context, userID string, tokenHash string, expiresAt time.Time) error {
+	return database.CreatePasswordReset(ctx, r.collection, userID, tokenHash, expiresAt)
+}
+
+func (r *MongoPasswordResetRepository) Consume(ctx context.Context, tokenHash string) (string, error) {
+	return database.ConsumePasswordReset(ctx, r.collection, tokenHash)
+}
+
+func (r *MongoPasswordResetRepository) Release(ctx context.Context, tokenHash string) error {
+	return database.ReleasePasswordReset(ctx, r.collection, tokenHash)
+}
@@ -0,0 +1,54 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/mauroarnedo/ecommerce/database"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type MongoPaymentRepository struct {
+	paymentCollection *mongo.Collection
+}
+
+func NewMongoPaymentRepository(paymentCollection *mongo.Collection) *MongoPaymentRepository {
+	return &MongoPaymentRepository{paymentCollection: paymentCollection}
+}
+
+func (r *MongoPaymentRepository) Create(ctx context.Context, intent *database.PaymentIntent) error {
+	return database.CreatePaymentIntent(ctx, r.paymentCollection, intent)
+}
+
+func (r *MongoPaymentRepository) FindByOrder(ctx context.Context, orderID primitive.ObjectID) (*database.PaymentIntent, error) {
+	return database.FindOrderPayment(ctx, r.paymentCollection, orderID)
+}
+
+func (r *MongoPaymentRepository) Save(ctx context.Context, intent *database.PaymentIntent, from string) error {
+	return database.SavePaymentIntent(ctx, r.paymentCollection, intent, from)
+}
+
+func (r *MongoPaymentRepository) FindByProviderRef(ctx context.Context, provider string, providerRef string) (*database.PaymentIntent, error) {
+	return database.FindProviderPayment(ctx, r.paymentCollection, provider, providerRef)
+}
+
+type MongoPaymentEventRepository struct {
+	eventCollection *mongo.Collection
+}
+
+func NewMongoPaymentEventRepository(eventCollection *mongo.Collection) *MongoPaymentEventRepository {
+	return &MongoPaymentEventRepository{eventCollection: eventCollection}
+}
+
+func (r *MongoPaymentEventRepository) Claim(ctx context.Context, event database.PaymentEvent, lease time.Duration, retry ...string) (*database.PaymentEvent, bool, error) {
+	return database.ClaimPaymentEvent(ctx, r.eventCollection, event, lease, retry...)
+}
+
+func (r *MongoPaymentEventRepository) Find(ctx context.Context, eventID string) (*database.PaymentEvent, error) {
+	return database.FindPaymentEvent(ctx, r.eventCollection, eventID)
+}
+
+func (r *MongoPaymentEventRepository) Finish(ctx context.Context, eventID string, status string, result string, failure string) error {
+	return database.FinishPaymentEvent(ctx, r.eventCollection, eventID, status, result, failure)
+}
@@ -0,0 +1,116 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/mauroarnedo/ecommerce/database"
+	"github.com/mauroarnedo/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type MongoProductRepository struct {
+	collection *mongo.Collection
+}
+
+func NewMongoProductRepository(collection *mongo.Collection) *MongoProductRepository {
+	return &MongoProductRepository{collection: collection}
+}
+
+func (r *MongoProductRepository) Create(ctx context.Context, product *models.Product) error {
+	_, err := r.collection.InsertOne(ctx, product)
+	return err
+}
+
+func (r *MongoProductRepository) CreateMany(ctx context.Context, products []models.Product) error {
+	productsInterface := make([]interface{}, len(products))
+	for i := range products {
+		productsInterface[i] = products[i]
+	}
+	_, err := r.collection.InsertMany(ctx, productsInterface)
+	return err
+}
+
+func (r *MongoProductRepository) FindByID(ctx context.Context, productID primitive.ObjectID) (*models.Product, error) {
+	var product models.Product
+	err := r.collection.FindOne(ctx, bson.M{"_id": productID}).Decode(&product)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrProductNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &product, nil
+}
+
+func (r *MongoProductRepository) find(ctx context.Context, filter interface{}) ([]models.Product, error) {
+	cursor, err := r.collection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	products := make([]models.Product, 0)
+	if err = cursor.All(ctx, &products); err != nil {
+		return nil, err
+	}
+	return products, cursor.Err()
+}
+
+func (r *MongoProductRepository) List(ctx context.Context) ([]models.Product, error) {
+	return r.find(ctx, bson.D{{}})
+}
+
+func (r *MongoProductRepository) SearchByName(ctx context.Context, name string) ([]models.Product, error) {
+	return r.find(ctx, bson.M{"product_name": bson.M{"$regex": name, "$options": "i"}})
+}
+
+func (r *MongoProductRepository) Delete(ctx context.Context, productID primitive.ObjectID) error {
+	_, err := r.collection.DeleteOne(ctx, bson.M{"_id": productID})
+	return err
+}
+
+func (r *MongoProductRepository) AddComment(ctx context.Context, productID primitive.ObjectID, comment models.Comment) error {
+	update := bson.D{{Key: "$push", Value: bson.D{primitive.E{Key: "product_comments", Value: comment}}}}
+	result, err := r.collection.UpdateOne(ctx, bson.M{"_id": productID}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrProductNotFound
+	}
+	return nil
+}
+
+func (r *MongoProductRepository) RemoveUserComments(ctx context.Context, productID primitive.ObjectID, userID primitive.ObjectID) error {
+	update := bson.M{"$pull": bson.M{"product_comments": bson.M{"user._id": userID}}}
+	_, err := r.collection.UpdateOne(ctx, bson.M{"_id": productID}, update)
+	return err
+}
+
+type MongoInventoryRepository struct {
+	productCollection     *mongo.Collection
+	reservationCollection *mongo.Collection
+}
+
+func NewMongoInventoryRepository(productCollection, reservationCollection *mongo.Collection) *MongoInventoryRepository {
+	return &MongoInventoryRepository{productCollection: productCollection, reservationCollection: reservationCollection}
+}
+
+func (r *MongoInventoryRepository) SetStock(ctx context.Context, productID primitive.ObjectID, stock *int) error {
+	return database.SetStock(ctx, r.productCollection, productID, stock)
+}
+
+func (r *MongoInventoryRepository) Hold(ctx context.Context, userID string, lines []database.StockLine, ttl time.Duration) (*database.Reservation, error) {
+	return database.HoldStock(ctx, r.productCollection, r.reservationCollection, userID, lines, ttl)
+}
+
+func (r *MongoInventoryRepository) ReleaseExpired(ctx context.Context, now time.Time) (int, error) {
+	return database.ReleaseExpiredReservations(ctx, r.productCollection, r.reservationCollection, now)
+}
+
+func (r *MongoInventoryRepository) Return(ctx context.Context, lines []database.StockLine) error {
+	return database.ReturnStock(ctx, r.productCollection, lines)
+}
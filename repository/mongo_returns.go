@@ -0,0 +1,34 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/mauroarnedo/ecommerce/database"
+	"github.com/mauroarnedo/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type MongoReturnRepository struct {
+	returnCollection *mongo.Collection
+}
+
+func NewMongoReturnRepository(returnCollection *mongo.Collection) *MongoReturnRepository {
+	return &MongoReturnRepository{returnCollection: returnCollection}
+}
+
+func (r *MongoReturnRepository) Create(ctx context.Context, request *models.ReturnRequest) error {
+	return database.CreateReturn(ctx, r.returnCollection, request)
+}
+
+func (r *MongoReturnRepository) FindByID(ctx context.Context, returnID primitive.ObjectID) (*models.ReturnRequest, error) {
+	return database.FindReturn(ctx, r.returnCollection, returnID)
+}
+
+func (r *MongoReturnRepository) List(ctx context.Context, filter database.ReturnFilter) ([]models.ReturnRequest, error) {
+	return database.ListReturns(ctx, r.returnCollection, filter)
+}
+
+func (r *MongoReturnRepository) Save(ctx context.Context, request *models.ReturnRequest, from string) error {
+	return database.SaveReturn(ctx, r.returnCollection, request, from)
+}
@@ -0,0 +1,321 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mauroarnedo/ecommerce/database"
+	"github.com/mauroarnedo/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type MongoUserRepository struct {
+	collection *mongo.Collection
+}
+
+func NewMongoUserRepository(collection *mongo.Collection) *MongoUserRepository {
+	return &MongoUserRepository{collection: collection}
+}
+
+func userFilter(userID string) (bson.M, error) {
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, database.ErrUserIDIsNotValid
+	}
+	return bson.M{"_id": id}, nil
+}
+
+func (r *MongoUserRepository) Create(ctx context.Context, user *models.User) error {
+	_, err := r.collection.InsertOne(ctx, user)
+	return err
+}
+
+func (r *MongoUserRepository) CreateBootstrapAdmin(ctx context.Context, user *models.User) error {
+	user.Bootstrap_Admin = true
+	_, err := r.collection.InsertOne(ctx, user)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrAdminExists
+	}
+	return err
+}
+
+func (r *MongoUserRepository) EmailExists(ctx context.Context, email string) (bool, error) {
+	count, err := r.collection.CountDocuments(ctx, bson.M{"email": email})
+	return count > 0, err
+}
+
+func (r *MongoUserRepository) PhoneExists(ctx context.Context, phone string) (bool, error) {
+	count, err := r.collection.CountDocuments(ctx, bson.M{"phone": phone})
+	return count > 0, err
+}
+
+func (r *MongoUserRepository) CountByRole(ctx context.Context, role string) (int64, error) {
+	return r.collection.CountDocuments(ctx, bson.M{"role": role})
+}
+
+func (r *MongoUserRepository) findOne(ctx context.Context, filter bson.M, projection bson.M, out interface{}) error {
+	opts := options.FindOne()
+	if projection != nil {
+		opts.SetProjection(projection)
+	}
+	err := r.collection.FindOne(ctx, filter, opts).Decode(out)
+	if err == mongo.ErrNoDocuments {
+		return ErrUserNotFound
+	}
+	return err
+}
+
+func (r *MongoUserRepository) findByID(ctx context.Context, userID string, projection bson.M, out interface{}) error {
+	filter, err := userFilter(userID)
+	if err != nil {
+		return err
+	}
+	return r.findOne(ctx, filter, projection, out)
+}
+
+func (r *MongoUserRepository) FindByID(ctx context.Context, userID string) (*models.User, error) {
+	var user models.User
+	if err := r.findByID(ctx, userID, nil, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *MongoUserRepository) FindByEmail(ctx context.Context, email string) (*models.User, error) {
+	var user models.User
+	if err := r.findOne(ctx, bson.M{"email": email}, database.LoginProjection, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *MongoUserRepository) FindProfile(ctx context.Context, userID string) (*models.UserProfile, error) {
+	var user models.UserProfile
+	if err := r.findByID(ctx, userID, database.UserProfileProjection, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *MongoUserRepository) FindAdminView(ctx context.Context, userID string) (*models.AdminUserView, error) {
+	var user models.AdminUserView
+	if err := r.findByID(ctx, userID, database.AdminUserProjection, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *MongoUserRepository) FindPublic(ctx context.Context, userID string) (*models.PublicUser, error) {
+	var user models.PublicUser
+	if err := r.findByID(ctx, userID, database.PublicUserProjection, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *MongoUserRepository) Delete(ctx context.Context, userID string) error {
+	filter, err := userFilter(userID)
+	if err != nil {
+		return err
+	}
+	_, err = r.collection.DeleteOne(ctx, filter)
+	return err
+}
+
+func (r *MongoUserRepository) update(ctx context.Context, userID string, extra bson.M, update bson.M) (bool, error) {
+	filter, err := userFilter(userID)
+	if err != nil {
+		return false, err
+	}
+	for k, v := range extra {
+		filter[k] = v
+	}
+	result, err := r.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+func (r *MongoUserRepository) set(ctx context.Context, userID string, fields bson.M) error {
+	fields["updated_at"] = time.Now()
+	matched, err := r.update(ctx, userID, nil, bson.M{"$set": fields})
+	if err == nil && !matched {
+		return ErrUserNotFound
+	}
+	return err
+}
+
+// SetRole cannot check the other admins in the same write, so a demoted
+// admin is counted afterwards and promoted back when none is left. Two
+// admins demoting each other concurrently both end up kept.
+func (r *MongoUserRepository) SetRole(ctx context.Context, userID string, role string) (bool, error) {
+	filter, err := userFilter(userID)
+	if err != nil {
+		return false, err
+	}
+	update := bson.M{"$set": bson.M{"role": role, "updated_at": time.Now()}}
+	opts := options.FindOneAndUpdate().SetProjection(bson.M{"role": 1})
+	var before struct {
+		Role string `bson:"role"`
+	}
+	err = r.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&before)
+	if err == mongo.ErrNoDocuments {
+		return false, ErrUserNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+	if before.Role != models.RoleAdmin || role == models.RoleAdmin {
+		return before.Role != role, nil
+	}
+	admins, err := r.CountByRole(ctx, models.RoleAdmin)
+	if err != nil || admins > 0 {
+		return true, err
+	}
+	if err = r.set(ctx, userID, bson.M{"role": models.RoleAdmin}); err != nil {
+		return true, err
+	}
+	return false, ErrLastAdmin
+}
+
+func (r *MongoUserRepository) SetPassword(ctx context.Context, userID string, passwordHash string) error {
+	return r.set(ctx, userID, bson.M{"password": passwordHash})
+}
+
+func (r *MongoUserRepository) SetEmailVerified(ctx context.Context, userID string) error {
+	return r.set(ctx, userID, bson.M{"email_verified": true})
+}
+
+func (r *MongoUserRepository) SetPhoneVerified(ctx context.Context, userID string) error {
+	return r.set(ctx, userID, bson.M{"phone_verified": true})
+}
+
+func (r *MongoUserRepository) UpdateTokens(ctx context.Context, userID string, token string, refreshToken string) error {
+	return r.set(ctx, userID, bson.M{"token": token, "refresh_token": refreshToken})
+}
+
+func (r *MongoUserRepository) ReplaceRefreshToken(ctx context.Context, userID string, current string, token string, refreshToken string) (bool, error) {
+	update := bson.M{"$set": bson.M{"token": token, "refresh_token": refreshToken, "updated_at": time.Now()}}
+	return r.update(ctx, userID, bson.M{"refresh_token": current}, update)
+}
+
+func (r *MongoUserRepository) ClearTokens(ctx context.Context, userID string, onlyIfRefreshToken string) error {
+	var extra bson.M
+	if onlyIfRefreshToken != "" {
+		extra = bson.M{"refresh_token": onlyIfRefreshToken}
+	}
+	update := bson.M{"$set": bson.M{"token": "", "refresh_token": "", "updated_at": time.Now()}}
+	_, err := r.update(ctx, userID, extra, update)
+	return err
+}
+
+func (r *MongoUserRepository) SetPendingTOTP(ctx context.Context, userID string, secret string) error {
+	return r.set(ctx, userID, bson.M{"totp_pending": secret})
+}
+
+func (r *MongoUserRepository) EnableTOTP(ctx context.Context, userID string, pending string, step int64, recoveryHashes []string) (bool, error) {
+	update := bson.M{"$set": bson.M{
+		"totp_enabled":   true,
+		"totp_secret":    pending,
+		"totp_pending":   "",
+		"totp_last_step": step,
+		"recovery_codes": recoveryHashes,
+		"updated_at":     time.Now(),
+	}}
+	return r.update(ctx, userID, bson.M{"totp_pending": pending}, update)
+}
+
+func (r *MongoUserRepository) DisableTOTP(ctx context.Context, userID string) error {
+	update := bson.M{
+		"$set":   bson.M{"totp_enabled": false, "updated_at": time.Now()},
+		"$unset": bson.M{"totp_secret": "", "totp_pending": "", "totp_last_step": "", "recovery_codes": ""},
+	}
+	_, err := r.update(ctx, userID, nil, update)
+	return err
+}
+
+func (r *MongoUserRepository) AdvanceTOTPStep(ctx context.Context, userID string, step int64) (bool, error) {
+	return r.update(ctx, userID, bson.M{"totp_last_step": bson.M{"$lt": step}}, bson.M{"$set": bson.M{"totp_last_step": step}})
+}
+
+func (r *MongoUserRepository) ConsumeRecoveryCode(ctx context.Context, userID string, hash string) (bool, error) {
+	return r.update(ctx, userID, bson.M{"recovery_codes": hash}, bson.M{"$pull": bson.M{"recovery_codes": hash}})
+}
+
+func (r *MongoUserRepository) AddFavorite(ctx context.Context, userID string, product models.ProductUser) error {
+	_, err := r.update(ctx, userID, nil, bson.M{"$push": bson.M{"user_favorites": product}})
+	return err
+}
+
+func (r *MongoUserRepository) RemoveFavorite(ctx context.Context, userID string, productID primitive.ObjectID) error {
+	_, err := r.update(ctx, userID, nil, bson.M{"$pull": bson.M{"user_favorites": bson.M{"_id": productID}}})
+	return err
+}
+
+func (r *MongoUserRepository) RemoveFavoriteFromAll(ctx context.Context, productID primitive.ObjectID) error {
+	_, err := r.collection.UpdateMany(ctx, bson.M{}, bson.M{"$pull": bson.M{"user_favorites": bson.M{"_id": productID}}})
+	return err
+}
+
+// AddAddress pushes only while the user has fewer than two addresses; the
+// condition is part of the update so concurrent requests cannot exceed it.
+func (r *MongoUserRepository) AddAddress(ctx context.Context, userID string, address models.Address) error {
+	matched, err := r.update(ctx, userID, bson.M{"address.1": bson.M{"$exists": false}}, bson.M{"$push": bson.M{"address": address}})
+	if err != nil {
+		return err
+	}
+	if !matched {
+		if _, err = r.FindPublic(ctx, userID); err != nil {
+			return err
+		}
+		return ErrAddressLimit
+	}
+	return nil
+}
+
+func (r *MongoUserRepository) EditAddress(ctx context.Context, userID string, index int, address models.Address) error {
+	prefix := fmt.Sprintf("address.%d.", index)
+	update := bson.M{"$set": bson.M{
+		prefix + "house":    address.House,
+		prefix + "street":   address.Street,
+		prefix + "city":     address.City,
+		prefix + "pin_code": address.Pin_Code,
+	}}
+	_, err := r.update(ctx, userID, nil, update)
+	return err
+}
+
+func (r *MongoUserRepository) ClearAddresses(ctx context.Context, userID string) error {
+	_, err := r.update(ctx, userID, nil, bson.M{"$set": bson.M{"address": make([]models.Address, 0)}})
+	return err
+}
+
+// AddStoreCredit adds amount to the user's balance, which is only ever kept
+// in one currency.
+func (r *MongoUserRepository) AddStoreCredit(ctx context.Context, userID string, amount models.Money) error {
+	sameCurrency := bson.M{"$or": bson.A{
+		bson.M{"store_credit": bson.M{"$exists": false}},
+		bson.M{"store_credit.currency": amount.Currency},
+	}}
+	update := bson.M{
+		"$inc": bson.M{"store_credit.amount": amount.Amount},
+		"$set": bson.M{"store_credit.currency": amount.Currency, "updated_at": time.Now()},
+	}
+	matched, err := r.update(ctx, userID, sameCurrency, update)
+	if err != nil || matched {
+		return err
+	}
+	if _, err = r.FindByID(ctx, userID); err != nil {
+		return err
+	}
+	return models.ErrCurrencyMismatch
+}
+
+func (r *MongoUserRepository) SetCartCoupon(ctx context.Context, userID string, code string) error {
+	return r.set(ctx, userID, bson.M{"cart_coupon": code})
+}
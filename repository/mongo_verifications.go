@@ -0,0 +1,25 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/mauroarnedo/ecommerce/database"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type MongoVerificationRepository struct {
+	collection *mongo.Collection
+}
+
+func NewMongoVerificationRepository(collection *mongo.Collection) *MongoVerificationRepository {
+	return &MongoVerificationRepository{collection: collection}
+}
+
+func (r *MongoVerificationRepository) Save(ctx context.Context, userID string, channel string, target string, codeHash string, expiresAt time.Time, policy database.ResendPolicy) error {
+	return database.SaveVerificationCode(ctx, r.collection, userID, channel, target, codeHash, expiresAt, policy)
+}
+
+func (r *MongoVerificationRepository) Check(ctx context.Context, channel string, target string, hash func(userID string) string) (string, error) {
+	return database.CheckVerificationCode(ctx, r.collection, channel, target, hash)
+}
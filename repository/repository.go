@@ -0,0 +1,208 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mauroarnedo/ecommerce/database"
+	"github.com/mauroarnedo/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	ErrUserNotFound    = errors.New("user not found")
+	ErrProductNotFound = errors.New("product not found")
+	ErrAddressLimit    = errors.New("a user can have at most two addresses")
+	ErrAdminExists     = errors.New("an admin already exists")
+	ErrLastAdmin       = errors.New("the last admin cannot be demoted")
+)
+
+type UserRepository interface {
+	Create(ctx context.Context, user *models.User) error
+	// CreateBootstrapAdmin creates user as the bootstrap admin, or fails
+	// with ErrAdminExists when one was created before.
+	CreateBootstrapAdmin(ctx context.Context, user *models.User) error
+	EmailExists(ctx context.Context, email string) (bool, error)
+	PhoneExists(ctx context.Context, phone string) (bool, error)
+	CountByRole(ctx context.Context, role string) (int64, error)
+	FindByID(ctx context.Context, userID string) (*models.User, error)
+	FindByEmail(ctx context.Context, email string) (*models.User, error)
+	FindProfile(ctx context.Context, userID string) (*models.UserProfile, error)
+	FindAdminView(ctx context.Context, userID string) (*models.AdminUserView, error)
+	FindPublic(ctx context.Context, userID string) (*models.PublicUser, error)
+	Delete(ctx context.Context, userID string) error
+
+	// SetRole reports whether the role changed. Demoting the only admin
+	// fails with ErrLastAdmin and leaves the role as it was.
+	SetRole(ctx context.Context, userID string, role string) (bool, error)
+	SetPassword(ctx context.Context, userID string, passwordHash string) error
+	SetEmailVerified(ctx context.Context, userID string) error
+	SetPhoneVerified(ctx context.Context, userID string) error
+
+	UpdateTokens(ctx context.Context, userID string, token string, refreshToken string) error
+	ReplaceRefreshToken(ctx context.Context, userID string, current string, token string, refreshToken string) (bool, error)
+	ClearTokens(ctx context.Context, userID string, onlyIfRefreshToken string) error
+
+	SetPendingTOTP(ctx context.Context, userID string, secret string) error
+	EnableTOTP(ctx context.Context, userID string, pending string, step int64, recoveryHashes []string) (bool, error)
+	DisableTOTP(ctx context.Context, userID string) error
+	AdvanceTOTPStep(ctx context.Context, userID string, step int64) (bool, error)
+	ConsumeRecoveryCode(ctx context.Context, userID string, hash string) (bool, error)
+
+	AddFavorite(ctx context.Context, userID string, product models.ProductUser) error
+	RemoveFavorite(ctx context.Context, userID string, productID primitive.ObjectID) error
+	RemoveFavoriteFromAll(ctx context.Context, productID primitive.ObjectID) error
+
+	AddAddress(ctx context.Context, userID string, address models.Address) error
+	EditAddress(ctx context.Context, userID string, index int, address models.Address) error
+	ClearAddresses(ctx context.Context, userID string) error
+
+	AddStoreCredit(ctx context.Context, userID string, amount models.Money) error
+	SetCartCoupon(ctx context.Context, userID string, code string) error
+}
+
+type ProductRepository interface {
+	Create(ctx context.Context, product *models.Product) error
+	CreateMany(ctx context.Context, products []models.Product) error
+	FindByID(ctx context.Context, productID primitive.ObjectID) (*models.Product, error)
+	List(ctx context.Context) ([]models.Product, error)
+	SearchByName(ctx context.Context, name string) ([]models.Product, error)
+	Delete(ctx context.Context, productID primitive.ObjectID) error
+	AddComment(ctx context.Context, productID primitive.ObjectID, comment models.Comment) error
+	RemoveUserComments(ctx context.Context, productID primitive.ObjectID, userID primitive.ObjectID) error
+}
+
+type CartRepository interface {
+	Add(ctx context.Context, userID string, productID primitive.ObjectID, quantity int) error
+	SetQuantity(ctx context.Context, userID string, productID primitive.ObjectID, quantity int) error
+	ChangeQuantity(ctx context.Context, userID string, productID primitive.ObjectID, delta int) error
+	Remove(ctx context.Context, userID string, productID primitive.ObjectID) error
+	Items(ctx context.Context, userID string) ([]models.ProductUser, models.Money, error)
+	Revalidate(ctx context.Context, userID string) ([]database.CartChange, error)
+}
+
+type OrderRepository interface {
+	BuyFromCart(ctx context.Context, userID string, payment models.Payment, coupon *models.Coupon) (*models.Order, error)
+	InstantBuy(ctx context.Context, userID string, productID primitive.ObjectID, payment models.Payment, coupon *models.Coupon) (*models.Order, error)
+	FindByID(ctx context.Context, orderID primitive.ObjectID) (*models.Order, error)
+	Search(ctx context.Context, filter database.OrderFilter) ([]models.Order, int64, error)
+	Transition(ctx context.Context, orderID primitive.ObjectID, status string, actor string, note string) (*models.Order, error)
+	AddRefund(ctx context.Context, orderID primitive.ObjectID, refund models.Refund, updatedAt time.Time) (*models.Order, error)
+	UpdateRefund(ctx context.Context, orderID primitive.ObjectID, refund models.Refund) (*models.Order, error)
+}
+
+// InventoryRepository manages product stock and the reservations that hold
+// it while a checkout is in progress.
+type InventoryRepository interface {
+	SetStock(ctx context.Context, productID primitive.ObjectID, stock *int) error
+	Hold(ctx context.Context, userID string, lines []database.StockLine, ttl time.Duration) (*database.Reservation, error)
+	ReleaseExpired(ctx context.Context, now time.Time) (int, error)
+	Return(ctx context.Context, lines []database.StockLine) error
+}
+
+// PaymentRepository stores the payment intents of orders paid digitally.
+// Save only succeeds while the stored intent is still in status from.
+type PaymentRepository interface {
+	Create(ctx context.Context, intent *database.PaymentIntent) error
+	FindByOrder(ctx context.Context, orderID primitive.ObjectID) (*database.PaymentIntent, error)
+	FindByProviderRef(ctx context.Context, provider string, providerRef string) (*database.PaymentIntent, error)
+	Save(ctx context.Context, intent *database.PaymentIntent, from string) error
+}
+
+// PaymentEventRepository keeps webhook deliveries, see
+// database.ClaimPaymentEvent.
+type PaymentEventRepository interface {
+	Claim(ctx context.Context, event database.PaymentEvent, lease time.Duration, retry ...string) (*database.PaymentEvent, bool, error)
+	Find(ctx context.Context, eventID string) (*database.PaymentEvent, error)
+	Finish(ctx context.Context, eventID string, status string, result string, failure string) error
+}
+
+// CouponRepository stores promotion codes and how often each user redeemed
+// them, see database.RedeemCoupon.
+type CouponRepository interface {
+	Create(ctx context.Context, coupon *models.Coupon) error
+	FindByCode(ctx context.Context, code string) (*models.Coupon, error)
+	List(ctx context.Context) ([]models.Coupon, error)
+	SetActive(ctx context.Context, code string, active bool) error
+	Redemptions(ctx context.Context, couponID primitive.ObjectID, userID string) (int, error)
+	Redeem(ctx context.Context, coupon *models.Coupon, userID string) error
+	Release(ctx context.Context, couponID primitive.ObjectID, userID string) error
+}
+
+// ReturnRepository stores customers' return requests. Save only succeeds
+// while the stored return is still in status from.
+type ReturnRepository interface {
+	Create(ctx context.Context, request *models.ReturnRequest) error
+	FindByID(ctx context.Context, returnID primitive.ObjectID) (*models.ReturnRequest, error)
+	List(ctx context.Context, filter database.ReturnFilter) ([]models.ReturnRequest, error)
+	Save(ctx context.Context, request *models.ReturnRequest, from string) error
+}
+
+// PasswordResetRepository keeps reset tokens. Consume redeems a token once;
+// Release gives it back when the reset could not be completed.
+type PasswordResetRepository interface {
+	Create(ctx context.Context, userID string, tokenHash string, expiresAt time.Time) error
+	Consume(ctx context.Context, tokenHash string) (string, error)
+	Release(ctx context.Context, tokenHash string) error
+}
+
+type VerificationRepository interface {
+	Save(ctx context.Context, userID string, channel string, target string, codeHash string, expiresAt time.Time, policy database.ResendPolicy) error
+	Check(ctx context.Context, channel string, target string, hash func(userID string) string) (string, error)
+}
+
+// Repositories bundles every store the HTTP handlers depend on.
+type Repositories struct {
+	Users          UserRepository
+	Products       ProductRepository
+	Carts          CartRepository
+	Orders         OrderRepository
+	Inventory      InventoryRepository
+	Payments       PaymentRepository
+	PaymentEvents  PaymentEventRepository
+	Returns        ReturnRepository
+	Coupons        CouponRepository
+	PasswordResets PasswordResetRepository
+	Verifications  VerificationRepository
+}
+
+func NewMongoRepositories(db *mongo.Database, checkoutStrategy string) *Repositories {
+	users := database.UserData(db, "users")
+	products := database.ProductData(db, "products")
+	orders := database.OrderData(db, "orders")
+	reservations := database.ReservationData(db, "reservations")
+	return &Repositories{
+		Users:          NewMongoUserRepository(users),
+		Products:       NewMongoProductRepository(products),
+		Carts:          NewMongoCartRepository(products, users),
+		Orders:         NewMongoOrderRepository(products, users, orders, reservations, checkoutStrategy),
+		Inventory:      NewMongoInventoryRepository(products, reservations),
+		Payments:       NewMongoPaymentRepository(database.PaymentIntentData(db, "payment_intents")),
+		PaymentEvents:  NewMongoPaymentEventRepository(database.PaymentEventData(db, "payment_events")),
+		Returns:        NewMongoReturnRepository(database.ReturnData(db, "returns")),
+		Coupons:        NewMongoCouponRepository(database.CouponData(db, "coupons"), database.CouponRedemptionData(db, "coupon_redemptions")),
+		PasswordResets: NewMongoPasswordResetRepository(database.PasswordResetData(db, "password_resets")),
+		Verifications:  NewMongoVerificationRepository(database.VerificationData(db, "verifications")),
+	}
+}
+
+func NewMemoryRepositories() *Repositories {
+	users := NewMemoryUserRepository()
+	products := NewMemoryProductRepository()
+	inventory := NewMemoryInventoryRepository(products)
+	return &Repositories{
+		Users:          users,
+		Products:       products,
+		Carts:          NewMemoryCartRepository(products, users),
+		Orders:         NewMemoryOrderRepository(products, users, inventory),
+		Inventory:      inventory,
+		Payments:       NewMemoryPaymentRepository(),
+		PaymentEvents:  NewMemoryPaymentEventRepository(),
+		Returns:        NewMemoryReturnRepository(),
+		Coupons:        NewMemoryCouponRepository(),
+		PasswordResets: NewMemoryPasswordResetRepository(),
+		Verifications:  NewMemoryVerificationRepository(),
+	}
+}
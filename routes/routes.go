@@ -3,18 +3,70 @@ package routes
 import (
 	"github.com/gin-gonic/gin"
 	"github.com/mauroarnedo/ecommerce/controllers"
+	"github.com/mauroarnedo/ecommerce/middleware"
+	"github.com/mauroarnedo/ecommerce/models"
+	"github.com/mauroarnedo/ecommerce/tokens"
 )
 
-func UserRoutes(router *gin.Engine) {
-	router.POST("/users/signup", controllers.SignUp())
-	router.POST("/users/login", controllers.Login())
-	router.GET("/users/userinfo", controllers.GetUser())
-	router.DELETE("/users/userdelete", controllers.DeleteUser())
-	router.POST("/admin/addproduct", controllers.ProductViewerAdmin())
-	router.POST("/admin/addmanyproducts", controllers.ProductViewerAdminBulk())
-	router.DELETE("/admin/deleteProduct", controllers.DeleteProduct())
-	router.GET("/users/productview", controllers.SearchProduct())
-	router.GET("/users/search", controllers.SearchProductByQuery())
-	router.GET("/users/addfavorites", controllers.AddFavorite())
-	router.GET("/users/removefavorites", controllers.RemoveFavorites())
+func UserRoutes(router *gin.Engine, app *controllers.Application, tm *tokens.Manager) {
+	router.POST("/users/signup", app.SignUp())
+	router.POST("/users/login", app.Login())
+	router.POST("/users/login/2fa", app.LoginTOTP())
+	router.POST("/users/refresh", app.RefreshToken())
+	router.POST("/users/request-reset", app.RequestPasswordReset())
+	router.POST("/users/confirm-reset", app.ConfirmPasswordReset())
+	router.POST("/users/verify-email", app.VerifyEmailAddress())
+	router.GET("/users/verify-email", app.VerifyEmailAddress())
+	router.POST("/users/verify-phone", app.VerifyPhoneNumber())
+	router.GET("/.well-known/jwks.json", app.JWKS())
+	router.GET("/users/productview", app.SearchProduct())
+	router.GET("/users/search", app.SearchProductByQuery())
+	router.GET("/users/profile", app.GetPublicProfile())
+
+	users := router.Group("/users", middleware.Authentication(tm), middleware.Authorization(models.RoleCustomer, models.RoleAdmin))
+	users.POST("/logout", app.Logout())
+	users.POST("/logout-all", app.LogoutAll())
+	users.POST("/resend-verification", app.ResendVerification())
+	users.POST("/2fa/enroll", app.EnrollTOTP())
+	users.POST("/2fa/confirm", app.ConfirmTOTP())
+	users.POST("/2fa/disable", app.DisableTOTP())
+	users.GET("/userinfo", app.GetUser())
+	users.DELETE("/userdelete", app.DeleteUser())
+	users.GET("/addfavorites", app.AddFavorite())
+	users.GET("/removefavorites", app.RemoveFavorites())
+	users.GET("/orders", app.ListOrders())
+	users.GET("/orders/detail", app.GetOrder())
+	users.POST("/orders/cancel", app.CancelOrder())
+	users.POST("/returns", app.RequestReturn())
+	users.GET("/returns", app.ListReturns())
+}
+
+func AdminRoutes(router *gin.Engine, app *controllers.Application, tm *tokens.Manager) {
+	router.POST("/admin/bootstrap", app.BootstrapAdmin())
+
+	admin := router.Group("/admin", middleware.Authentication(tm), middleware.Authorization(models.RoleAdmin))
+	admin.POST("/addproduct", app.ProductViewerAdmin())
+	admin.POST("/addmanyproducts", app.ProductViewerAdminBulk())
+	admin.DELETE("/deleteProduct", app.DeleteProduct())
+	admin.PUT("/setstock", app.SetStock())
+	admin.PUT("/setrole", app.SetUserRole())
+	admin.POST("/unlock", app.UnlockAccount())
+	admin.GET("/orders", app.SearchOrders())
+	admin.POST("/orders/transition", app.TransitionOrder())
+	admin.POST("/orders/refund", app.RefundOrder())
+	admin.POST("/coupons", app.CreateCoupon())
+	admin.GET("/coupons", app.ListCoupons())
+	admin.POST("/coupons/active", app.SetCouponActive())
+	admin.GET("/returns", app.SearchReturns())
+	admin.POST("/returns/approve", app.ApproveReturn())
+	admin.POST("/returns/reject", app.RejectReturn())
+	admin.POST("/returns/receive", app.ReceiveReturn())
+	admin.POST("/returns/resolve", app.ResolveReturn())
+	admin.POST("/payments/events/replay", app.ReplayPaymentEvent())
+}
+
+// PaymentRoutes registers the endpoints called by the payment provider,
+// which authenticate with a signature instead of a token.
+func PaymentRoutes(router *gin.Engine, app *controllers.Application) {
+	router.POST("/payments/webhook", app.PaymentWebhook())
 }
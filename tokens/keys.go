@@ -0,0 +1,317 @@
+package tokens
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+var (
+	ErrNoSigningKey = errors.New("no signing key configured, set SECRET_KEY or JWT_KEYS_FILE")
+	ErrUnknownKey   = errors.New("token was signed with an unknown key")
+	ErrKeyRetired   = errors.New("token was signed with a retired key")
+)
+
+type SigningKey struct {
+	Kid       string
+	Method    jwt.SigningMethod
+	RetiredAt time.Time
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// KeyRing holds every key tokens may be verified with, identified by the kid
+// header. One of them signs new tokens; retired keys keep verifying until
+// their grace period ends so tokens issued before a rotation stay valid.
+type KeyRing struct {
+	mu      sync.RWMutex
+	keys    map[string]*SigningKey
+	signing string
+	grace   time.Duration
+}
+
+func NewKeyRing(grace time.Duration) *KeyRing {
+	return &KeyRing{keys: make(map[string]*SigningKey), grace: grace}
+}
+
+func (r *KeyRing) Add(key *SigningKey) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys[key.Kid] = key
+}
+
+func (r *KeyRing) SetSigningKey(kid string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key, ok := r.keys[kid]
+	if !ok || key.signKey == nil || !key.RetiredAt.IsZero() {
+		return fmt.Errorf("key %q cannot sign tokens", kid)
+	}
+	r.signing = kid
+	return nil
+}
+
+func (r *KeyRing) Retire(kid string, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if key, ok := r.keys[kid]; ok {
+		key.RetiredAt = at
+	}
+	if r.signing == kid {
+		r.signing = ""
+	}
+}
+
+func (r *KeyRing) Sign(claims jwt.Claims) (string, error) {
+	if r == nil {
+		return "", ErrNoSigningKey
+	}
+	r.mu.RLock()
+	key, ok := r.keys[r.signing]
+	r.mu.RUnlock()
+	if !ok {
+		return "", ErrNoSigningKey
+	}
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.Kid
+	return token.SignedString(key.signKey)
+}
+
+// Keyfunc resolves the verification key for a token from its kid header,
+// rejecting algorithms that do not match the key.
+func (r *KeyRing) Keyfunc(token *jwt.Token) (interface{}, error) {
+	if r == nil {
+		return nil, ErrNoSigningKey
+	}
+	kid, _ := token.Header["kid"].(string)
+	r.mu.RLock()
+	key, ok := r.keys[kid]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s for key %s", token.Method.Alg(), kid)
+	}
+	if !r.verifies(key, time.Now()) {
+		return nil, ErrKeyRetired
+	}
+	return key.verifyKey, nil
+}
+
+func (r *KeyRing) verifies(key *SigningKey, now time.Time) bool {
+	return key.RetiredAt.IsZero() || now.Before(key.RetiredAt.Add(r.grace))
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS publishes the public half of every asymmetric key that still
+// verifies tokens. HMAC secrets are never exposed.
+func (r *KeyRing) JWKS() JWKSet {
+	set := JWKSet{Keys: make([]JWK, 0)}
+	if r == nil {
+		return set
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	now := time.Now()
+	for _, key := range r.keys {
+		if !r.verifies(key, now) {
+			continue
+		}
+		switch pub := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				Kty: "RSA",
+				Kid: key.Kid,
+				Use: "sig",
+				Alg: key.Method.Alg(),
+				N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				Kty: "OKP",
+				Kid: key.Kid,
+				Use: "sig",
+				Alg: key.Method.Alg(),
+				Crv: "Ed25519",
+				X:   base64.RawURLEncoding.EncodeToString(pub),
+			})
+		}
+	}
+	return set
+}
+
+type keyFile struct {
+	Signing_Kid  string      `json:"signing_kid"`
+	Grace_Period string      `json:"grace_period"`
+	Keys         []keyConfig `json:"keys"`
+}
+
+type keyConfig struct {
+	Kid              string    `json:"kid"`
+	Alg              string    `json:"alg"`
+	Secret           string    `json:"secret"`
+	Secret_Env       string    `json:"secret_env"`
+	Private_Key_File string    `json:"private_key_file"`
+	Public_Key_File  string    `json:"public_key_file"`
+	Retired_At       time.Time `json:"retired_at"`
+}
+
+// LoadKeys builds the key ring from keysFile when it is set, or from a
+// single HS256 secret otherwise. It fails when no usable signing key is
+// configured.
+func LoadKeys(keysFile string, secret string, grace time.Duration) (*KeyRing, error) {
+	if keysFile != "" {
+		return loadKeyFile(keysFile, grace)
+	}
+
+	if secret == "" {
+		return nil, ErrNoSigningKey
+	}
+	ring := NewKeyRing(grace)
+	key := hmacKey(secret)
+	ring.Add(key)
+	if err := ring.SetSigningKey(key.Kid); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+func hmacKey(secret string) *SigningKey {
+	sum := sha256.Sum256([]byte(secret))
+	return &SigningKey{
+		Kid:       "hs-" + hex.EncodeToString(sum[:6]),
+		Method:    jwt.SigningMethodHS256,
+		signKey:   []byte(secret),
+		verifyKey: []byte(secret),
+	}
+}
+
+func loadKeyFile(path string, grace time.Duration) (*KeyRing, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file keyFile
+	if err = json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if file.Grace_Period != "" {
+		if grace, err = time.ParseDuration(file.Grace_Period); err != nil {
+			return nil, fmt.Errorf("%s: grace_period: %w", path, err)
+		}
+	}
+
+	ring := NewKeyRing(grace)
+	for _, cfg := range file.Keys {
+		key, err := parseKey(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: key %q: %w", path, cfg.Kid, err)
+		}
+		ring.Add(key)
+	}
+	if file.Signing_Kid == "" {
+		return nil, ErrNoSigningKey
+	}
+	if err = ring.SetSigningKey(file.Signing_Kid); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+func parseKey(cfg keyConfig) (*SigningKey, error) {
+	if cfg.Kid == "" {
+		return nil, errors.New("kid is required")
+	}
+	key := &SigningKey{Kid: cfg.Kid, RetiredAt: cfg.Retired_At}
+
+	switch cfg.Alg {
+	case "HS256":
+		secret := cfg.Secret
+		if cfg.Secret_Env != "" {
+			secret = os.Getenv(cfg.Secret_Env)
+		}
+		if secret == "" {
+			return nil, errors.New("secret is empty")
+		}
+		key.Method = jwt.SigningMethodHS256
+		key.signKey = []byte(secret)
+		key.verifyKey = []byte(secret)
+	case "RS256":
+		key.Method = jwt.SigningMethodRS256
+		if cfg.Private_Key_File != "" {
+			pem, err := os.ReadFile(cfg.Private_Key_File)
+			if err != nil {
+				return nil, err
+			}
+			private, err := jwt.ParseRSAPrivateKeyFromPEM(pem)
+			if err != nil {
+				return nil, err
+			}
+			key.signKey = private
+			key.verifyKey = &private.PublicKey
+		} else if cfg.Public_Key_File != "" {
+			pem, err := os.ReadFile(cfg.Public_Key_File)
+			if err != nil {
+				return nil, err
+			}
+			if key.verifyKey, err = jwt.ParseRSAPublicKeyFromPEM(pem); err != nil {
+				return nil, err
+			}
+		}
+	case "EdDSA":
+		key.Method = jwt.SigningMethodEdDSA
+		if cfg.Private_Key_File != "" {
+			pem, err := os.ReadFile(cfg.Private_Key_File)
+			if err != nil {
+				return nil, err
+			}
+			private, err := jwt.ParseEdPrivateKeyFromPEM(pem)
+			if err != nil {
+				return nil, err
+			}
+			key.signKey = private
+			key.verifyKey = private.(ed25519.PrivateKey).Public()
+		} else if cfg.Public_Key_File != "" {
+			pem, err := os.ReadFile(cfg.Public_Key_File)
+			if err != nil {
+				return nil, err
+			}
+			if key.verifyKey, err = jwt.ParseEdPublicKeyFromPEM(pem); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", cfg.Alg)
+	}
+	if key.verifyKey == nil {
+		return nil, errors.New("private_key_file or public_key_file is required")
+	}
+	return key, nil
+}
@@ -0,0 +1,153 @@
+package tokens
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RevocationStore remembers tokens that must be rejected before they expire.
+// Single tokens, and the families of a login, are revoked by id. Every token
+// also carries the generation of its user at the time it was issued;
+// RevokeUser starts a new generation and so rejects every token issued
+// before, however close in time. IsRevoked reports whether any of ids was
+// revoked or generation is an old one.
+type RevocationStore interface {
+	Revoke(ctx context.Context, jti string, expiresAt time.Time) error
+	RevokeUser(ctx context.Context, uid string) error
+	Generation(ctx context.Context, uid string) (int64, error)
+	IsRevoked(ctx context.Context, uid string, generation int64, ids ...string) (bool, error)
+}
+
+// revokedToken is a revoked jti, or the generation of a user. Generations
+// have no expiry: they must outlive every token issued under them.
+type revokedToken struct {
+	ID         string    `bson:"_id"`
+	Generation int64     `bson:"generation,omitempty"`
+	Expires_At time.Time `bson:"expires_at,omitempty"`
+}
+
+type MongoRevocationStore struct {
+	collection *mongo.Collection
+}
+
+// NewMongoRevocationStore stores revocations in collection. Revoked jtis
+// carry the expiry of their token and a TTL index drops them once the token
+// would be rejected anyway.
+func NewMongoRevocationStore(collection *mongo.Collection) *MongoRevocationStore {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	return &MongoRevocationStore{collection: collection}
+}
+
+func (s *MongoRevocationStore) Revoke(ctx context.Context, jti string, expiresAt time.Time) error {
+	update := bson.M{"$max": bson.M{"expires_at": expiresAt}}
+	_, err := s.collection.UpdateOne(ctx, bson.M{"_id": "jti:" + jti}, update, options.Update().SetUpsert(true))
+	return err
+}
+
+func (s *MongoRevocationStore) RevokeUser(ctx context.Context, uid string) error {
+	update := bson.M{"$inc": bson.M{"generation": 1}}
+	_, err := s.collection.UpdateOne(ctx, bson.M{"_id": "user:" + uid}, update, options.Update().SetUpsert(true))
+	return err
+}
+
+func (s *MongoRevocationStore) Generation(ctx context.Context, uid string) (int64, error) {
+	var entry revokedToken
+	err := s.collection.FindOne(ctx, bson.M{"_id": "user:" + uid}).Decode(&entry)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	return entry.Generation, err
+}
+
+func (s *MongoRevocationStore) IsRevoked(ctx context.Context, uid string, generation int64, ids ...string) (bool, error) {
+	keys := bson.A{"user:" + uid}
+	for _, id := range ids {
+		keys = append(keys, "jti:"+id)
+	}
+	cursor, err := s.collection.Find(ctx, bson.M{"_id": bson.M{"$in": keys}})
+	if err != nil {
+		return false, err
+	}
+	var entries []revokedToken
+	if err = cursor.All(ctx, &entries); err != nil {
+		return false, err
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		if entry.ID == "user:"+uid {
+			if generation < entry.Generation {
+				return true, nil
+			}
+			continue
+		}
+		if entry.Expires_At.After(now) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type MemoryRevocationStore struct {
+	mu          sync.Mutex
+	jtis        map[string]time.Time
+	generations map[string]int64
+}
+
+func NewMemoryRevocationStore() *MemoryRevocationStore {
+	return &MemoryRevocationStore{jtis: make(map[string]time.Time), generations: make(map[string]int64)}
+}
+
+func (s *MemoryRevocationStore) Revoke(ctx context.Context, jti string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if expiresAt.After(s.jtis[jti]) {
+		s.jtis[jti] = expiresAt
+	}
+	return nil
+}
+
+func (s *MemoryRevocationStore) RevokeUser(ctx context.Context, uid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generations[uid]++
+	return nil
+}
+
+func (s *MemoryRevocationStore) Generation(ctx context.Context, uid string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.generations[uid], nil
+}
+
+func (s *MemoryRevocationStore) IsRevoked(ctx context.Context, uid string, generation int64, ids ...string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, expiresAt := range s.jtis {
+		if expiresAt.Before(now) {
+			delete(s.jtis, id)
+		}
+	}
+	for _, id := range ids {
+		if _, ok := s.jtis[id]; ok {
+			return true, nil
+		}
+	}
+	return generation < s.generations[uid], nil
+}
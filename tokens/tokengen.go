@@ -2,66 +2,229 @@ package tokens
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"log"
-	"os"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
-	"github.com/mauroarnedo/ecommerce/database"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"github.com/mauroarnedo/ecommerce/models"
 )
 
+const (
+	AccessTokenType    = "access"
+	RefreshTokenType   = "refresh"
+	ChallengeTokenType = "challenge"
+)
+
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token is invalid or expired")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used, all sessions of this login were revoked")
+)
+
+// SignedDetails are the claims of an access token. Family is the family of
+// the refresh token minted with it.
 type SignedDetails struct {
 	Email      string
 	First_Name string
 	Last_Name  string
 	Uid        string
+	Role       string
+	Family     string
+	Token_Type string
+	Generation int64
+	jwt.RegisteredClaims
+}
+
+// RefreshDetails are the claims of a refresh token. Every refresh token
+// minted from the same login shares a Family, which lets a replayed token
+// revoke the whole chain.
+type RefreshDetails struct {
+	Uid        string
+	Family     string
+	Token_Type string
+	Generation int64
 	jwt.RegisteredClaims
 }
 
-var UserData *mongo.Collection = database.UserData(database.Client, "users")
-var SECRET_KEY = os.Getenv("SECRET_KEY")
+// ChallengeDetails are the claims of the short-lived token returned by the
+// first login step of accounts with two-factor authentication. It proves
+// the password was checked and can only be exchanged for real tokens.
+type ChallengeDetails struct {
+	Uid        string
+	Token_Type string
+	Generation int64
+	jwt.RegisteredClaims
+}
+
+// UserStore is the part of the user repository the token manager needs to
+// keep the stored tokens in sync.
+type UserStore interface {
+	FindByID(ctx context.Context, userID string) (*models.User, error)
+	UpdateTokens(ctx context.Context, userID string, token string, refreshToken string) error
+	ReplaceRefreshToken(ctx context.Context, userID string, current string, token string, refreshToken string) (bool, error)
+	ClearTokens(ctx context.Context, userID string, onlyIfRefreshToken string) error
+}
+
+// Manager issues, validates and revokes tokens.
+type Manager struct {
+	Keys        *KeyRing
+	Users       UserStore
+	Revocations RevocationStore
+	AccessTTL   time.Duration
+	RefreshTTL  time.Duration
+}
 
-func TokenGenerator(email string, firstname string, lastname string, uid string) (signedtoken string, signedrefreshtroken string, err error) {
+func NewManager(keys *KeyRing, users UserStore, revocations RevocationStore, accessTTL time.Duration, refreshTTL time.Duration) *Manager {
+	return &Manager{Keys: keys, Users: users, Revocations: revocations, AccessTTL: accessTTL, RefreshTTL: refreshTTL}
+}
+
+func (m *Manager) TokenGenerator(ctx context.Context, email string, firstname string, lastname string, uid string, role string) (signedtoken string, signedrefreshtroken string, err error) {
+	family, err := newFamily()
+	if err != nil {
+		return "", "", err
+	}
+	return m.generateTokens(ctx, email, firstname, lastname, uid, role, family)
+}
+
+// generateTokens stamps the tokens with the user's current generation, so a
+// LogoutAll that runs while they are signed rejects them too.
+func (m *Manager) generateTokens(ctx context.Context, email string, firstname string, lastname string, uid string, role string, family string) (signedtoken string, signedrefreshtroken string, err error) {
+	if role == "" {
+		role = models.RoleCustomer
+	}
+	generation, err := m.Revocations.Generation(ctx, uid)
+	if err != nil {
+		return "", "", err
+	}
+	accessID, err := newTokenID()
+	if err != nil {
+		return "", "", err
+	}
+	refreshID, err := newTokenID()
+	if err != nil {
+		return "", "", err
+	}
 	claims := &SignedDetails{
 		Email:      email,
 		First_Name: firstname,
 		Last_Name:  lastname,
 		Uid:        uid,
+		Role:       role,
+		Family:     family,
+		Token_Type: AccessTokenType,
+		Generation: generation,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Local().Add(time.Hour * time.Duration(24))),
+			ID:        accessID,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Local().Add(m.AccessTTL)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
-	refreshClaims := &SignedDetails{
+	refreshClaims := &RefreshDetails{
+		Uid:        uid,
+		Family:     family,
+		Token_Type: RefreshTokenType,
+		Generation: generation,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Local().Add(time.Hour * time.Duration(168))),
+			ID:        refreshID,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Local().Add(m.RefreshTTL)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
-	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(SECRET_KEY))
+	token, err := m.Keys.Sign(claims)
 	if err != nil {
 		return "", "", err
 	}
-	refreshToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims).SignedString([]byte(SECRET_KEY))
+	refreshToken, err := m.Keys.Sign(refreshClaims)
 	if err != nil {
-		log.Panicln(err)
-		return
+		return "", "", err
 	}
 	return token, refreshToken, err
 }
-func ValidateToken(signedToken string) (claims *SignedDetails, msg string) {
-	token, err := jwt.ParseWithClaims(signedToken, &SignedDetails{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(SECRET_KEY), nil
-	})
+
+func newFamily() (string, error) {
+	return newTokenID()
+}
+
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (m *Manager) GenerateChallengeToken(ctx context.Context, uid string) (string, error) {
+	generation, err := m.Revocations.Generation(ctx, uid)
+	if err != nil {
+		return "", err
+	}
+	id, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	claims := &ChallengeDetails{
+		Uid:        uid,
+		Token_Type: ChallengeTokenType,
+		Generation: generation,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        id,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(5 * time.Minute)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+	return m.Keys.Sign(claims)
+}
+
+func (m *Manager) ValidateChallengeToken(signedToken string) (claims *ChallengeDetails, msg string) {
+	token, err := jwt.ParseWithClaims(signedToken, &ChallengeDetails{}, m.Keys.Keyfunc)
+	if err != nil {
+		msg = err.Error()
+		return
+	}
+	claims, ok := token.Claims.(*ChallengeDetails)
+	if !ok || claims.Token_Type != ChallengeTokenType || claims.ID == "" || claims.Uid == "" {
+		msg = "The challenge token is invalid"
+		return
+	}
+	if claims.ExpiresAt == nil || claims.ExpiresAt.Unix() < time.Now().Unix() {
+		msg = "Challenge token is expired"
+		return
+	}
+	return claims, msg
+}
+
+// IsRevoked reports whether claims belong to a token that was logged out,
+// either on its own, with the rest of its family or through a logout of all
+// the user's sessions. Challenge tokens have no family.
+func (m *Manager) IsRevoked(ctx context.Context, jti string, family string, uid string, generation int64) (bool, error) {
+	ids := []string{jti}
+	if family != "" {
+		ids = append(ids, familyID(family))
+	}
+	return m.Revocations.IsRevoked(ctx, uid, generation, ids...)
+}
+
+func familyID(family string) string {
+	return "family:" + family
+}
+
+// revokeFamily rejects every token minted from the login of family. None of
+// them outlives a refresh token issued now.
+func (m *Manager) revokeFamily(ctx context.Context, family string) error {
+	return m.Revocations.Revoke(ctx, familyID(family), time.Now().Add(m.RefreshTTL))
+}
+
+func (m *Manager) ValidateToken(signedToken string) (claims *SignedDetails, msg string) {
+	token, err := jwt.ParseWithClaims(signedToken, &SignedDetails{}, m.Keys.Keyfunc)
 
 	if err != nil {
 		msg = err.Error()
 		return
 	}
 	claims, ok := token.Claims.(*SignedDetails)
-	if !ok {
+	if !ok || claims.Token_Type != AccessTokenType || claims.ID == "" {
 		msg = "The token is invalid"
 		return
 	}
@@ -72,26 +235,111 @@ func ValidateToken(signedToken string) (claims *SignedDetails, msg string) {
 	return claims, msg
 }
 
-func UpdateAllTokens(signedToken string, signedRefreshToken string, userID string) {
-	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
-	var updateObj primitive.D
+func (m *Manager) ValidateRefreshToken(signedToken string) (claims *RefreshDetails, msg string) {
+	token, err := jwt.ParseWithClaims(signedToken, &RefreshDetails{}, m.Keys.Keyfunc)
 
-	updateObj = append(updateObj, bson.E{Key: "token", Value: signedToken})
-	updateObj = append(updateObj, bson.E{Key: "refresh_token", Value: signedRefreshToken})
-	updated_at, _ := time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
-	updateObj = append(updateObj, bson.E{Key: "updateat", Value: updated_at})
-	upsert := true
-	filter := bson.M{"user_id": userID}
-	opt := options.UpdateOptions{
-		Upsert: &upsert,
-	}
-	_, err := UserData.UpdateOne(ctx, filter, bson.D{
-		{Key: "$set", Value: updateObj},
-	},
-		&opt)
-	defer cancel()
 	if err != nil {
-		log.Panic(err)
+		msg = err.Error()
 		return
 	}
+	claims, ok := token.Claims.(*RefreshDetails)
+	if !ok || claims.Token_Type != RefreshTokenType || claims.ID == "" || claims.Uid == "" || claims.Family == "" {
+		msg = "The refresh token is invalid"
+		return
+	}
+	if claims.ExpiresAt == nil || claims.ExpiresAt.Unix() < time.Now().Local().Unix() {
+		msg = "Refresh token is expired"
+		return
+	}
+	return claims, msg
+}
+
+// RefreshAllTokens exchanges a refresh token for a new token pair. The
+// stored refresh token is swapped atomically, so only the most recent token
+// of a family can be redeemed; presenting an older one means it leaked and
+// the family is revoked, access tokens included. The stored token is
+// cleared as well unless it belongs to another login.
+func (m *Manager) RefreshAllTokens(ctx context.Context, signedRefreshToken string) (signedToken string, newRefreshToken string, err error) {
+	claims, msg := m.ValidateRefreshToken(signedRefreshToken)
+	if msg != "" {
+		log.Println(msg)
+		return "", "", ErrRefreshTokenInvalid
+	}
+	revoked, err := m.IsRevoked(ctx, claims.ID, claims.Family, claims.Uid, claims.Generation)
+	if err != nil {
+		return "", "", err
+	}
+	if revoked {
+		return "", "", ErrRefreshTokenInvalid
+	}
+
+	user, err := m.Users.FindByID(ctx, claims.Uid)
+	if err != nil {
+		log.Println(err)
+		return "", "", ErrRefreshTokenInvalid
+	}
+
+	signedToken, newRefreshToken, err = m.generateTokens(ctx, *user.Email, *user.First_Name, *user.Last_Name, user.User_ID, user.Role, claims.Family)
+	if err != nil {
+		return "", "", err
+	}
+
+	rotated, err := m.Users.ReplaceRefreshToken(ctx, claims.Uid, signedRefreshToken, signedToken, newRefreshToken)
+	if err != nil {
+		return "", "", err
+	}
+	if rotated {
+		return signedToken, newRefreshToken, nil
+	}
+
+	if err = m.revokeFamily(ctx, claims.Family); err != nil {
+		return "", "", err
+	}
+	if user.Refresh_Token != nil && *user.Refresh_Token != "" {
+		current, msg := m.ValidateRefreshToken(*user.Refresh_Token)
+		if msg != "" || current.Family == claims.Family {
+			if err = m.Users.ClearTokens(ctx, claims.Uid, *user.Refresh_Token); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	return "", "", ErrRefreshTokenReused
+}
+
+// Logout revokes the access token identified by jti together with the
+// refresh token currently stored for the user.
+func (m *Manager) Logout(ctx context.Context, uid string, jti string, expiresAt time.Time) error {
+	if err := m.Revocations.Revoke(ctx, jti, expiresAt); err != nil {
+		return err
+	}
+
+	user, err := m.Users.FindByID(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if user.Refresh_Token != nil && *user.Refresh_Token != "" {
+		if refreshClaims, msg := m.ValidateRefreshToken(*user.Refresh_Token); msg == "" {
+			if err = m.Revocations.Revoke(ctx, refreshClaims.ID, refreshClaims.ExpiresAt.Time); err != nil {
+				return err
+			}
+		}
+	}
+	return m.Users.ClearTokens(ctx, uid, "")
+}
+
+// LogoutAll revokes every token issued to the user so far.
+func (m *Manager) LogoutAll(ctx context.Context, uid string) error {
+	if err := m.Revocations.RevokeUser(ctx, uid); err != nil {
+		return err
+	}
+	return m.Users.ClearTokens(ctx, uid, "")
+}
+
+func (m *Manager) UpdateAllTokens(ctx context.Context, signedToken string, signedRefreshToken string, userID string) error {
+	return m.Users.UpdateTokens(ctx, userID, signedToken, signedRefreshToken)
+}
+
+// JWKS publishes the verification keys, see KeyRing.JWKS.
+func (m *Manager) JWKS() JWKSet {
+	return m.Keys.JWKS()
 }